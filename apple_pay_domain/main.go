@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/applepaydomain"
+)
+
+// Body of a registration request. DomainName defaults to the host the request was sent to.
+type RegisterDomainRequest struct {
+    DomainName string `json:"domain_name"`
+}
+
+// Struct to keep the secret key and more params if needed
+type AWSParams struct {
+	stripeKey      string
+	associationURL string   // Where the domain-association file is downloaded from
+	allowedDomains []string // Domains that may be registered, from /application/dev/apple_pay_domains
+}
+
+// Stripe's domain-association file, used unless /application/dev/apple_pay_association_url names another one
+const stripeAssociationURL = "https://stripe.com/files/apple-pay/apple-developer-merchantid-domain-association"
+
+// Globals
+var awsParams AWSParams
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// The domain-association file, downloaded once per container
+var association struct {
+    sync.Mutex
+    file []byte
+}
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// header returns a request header, whichever case API Gateway passed its name in.
+func header(headers map[string]string, name string) string {
+    for key, value := range headers {
+        if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(name) {
+            return value
+        }
+    }
+    return ""
+}
+
+// parseDomains splits the comma-separated list of domains in /application/dev/apple_pay_domains.
+func parseDomains(list string) []string {
+    var domains []string
+    for _, domain := range strings.Split(list, ",") {
+        if domain = strings.TrimSpace(domain); domain != "" {
+            domains = append(domains, domain)
+        }
+    }
+    return domains
+}
+
+// domainAllowed reports whether domainName is one of the domains that may be registered.
+func domainAllowed(domainName string) bool {
+    for _, domain := range awsParams.allowedDomains {
+        if strings.EqualFold(domain, domainName) {
+            return true
+        }
+    }
+    return false
+}
+
+// associationFile returns the domain-association file, downloading it on first use. A failed download is not
+// cached, so the next request tries again.
+func associationFile(ctx context.Context) ([]byte, error) {
+    association.Lock()
+    defer association.Unlock()
+    if association.file != nil {
+        return association.file, nil
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsParams.associationURL, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("associationFile: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("associationFile: %s returned %s", awsParams.associationURL, resp.Status)
+    }
+    file, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("associationFile: %v", err)
+    }
+
+    association.file = file
+    return file, nil
+}
+
+// findDomain returns the Apple Pay domain registered with Stripe under domainName, or nil if there is none.
+func findDomain(domainName string) (*stripe.ApplePayDomain, error) {
+    iter := applepaydomain.List(&stripe.ApplePayDomainListParams{})
+    for iter.Next() {
+        if domain := iter.ApplePayDomain(); strings.EqualFold(domain.DomainName, domainName) {
+            return domain, nil
+        }
+    }
+    return nil, iter.Err()
+}
+
+// This function lets the frontend's domain take Apple Pay. Apple checks a domain by fetching the domain-association
+// file from it, so the API must be served on the same domain as the frontend for that path.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest from AWS Lambda.
+//
+// Returns:
+// - APIGatewayProxyResponse: Struct containing the HTTP status code, body, and headers of the response.
+// - error: Error object detailing any issues encountered during the execution of the function. If the operation is successful, the error is nil.
+//
+// applePayDomain():
+// - GET serves the domain-association file at /.well-known/apple-developer-merchantid-domain-association.
+// - POST registers a domain with Stripe, which has Apple verify it. The domain is domain_name from the body, or the
+//   host the request was sent to, and must be listed in /application/dev/apple_pay_domains; any other is refused
+//   with 403. A domain that is already registered is returned as it is, so the call can be repeated safely.
+//   Registration is an admin operation: the route must also be protected by IAM authorization.
+//
+// Google Pay needs no registration.
+func applePayDomain(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    stripe.Key = awsParams.stripeKey
+
+    switch request.HTTPMethod {
+        case http.MethodGet:
+            file, err := associationFile(ctx)
+            if err != nil {
+                log.Printf("Error loading domain-association file: %v", err)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadGateway}, err
+            }
+            return events.APIGatewayProxyResponse{
+                StatusCode: http.StatusOK,
+                Body:       string(file),
+                Headers:    map[string]string{"Content-Type": "text/plain"},
+            }, nil
+
+        case http.MethodPost:
+            var body RegisterDomainRequest
+            if request.Body != "" {
+                if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+                    return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+                }
+            }
+            domainName := body.DomainName
+            if domainName == "" {
+                domainName = header(request.Headers, "Host")
+            }
+            if domainName == "" {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "domain_name is required"}, nil
+            }
+            if !domainAllowed(domainName) {
+                log.Printf("Refused to register Apple Pay domain %s, which is not in the allowed domains", domainName)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: "Domain " + domainName + " is not allowed"}, nil
+            }
+
+            existing, err := findDomain(domainName)
+            if err != nil {
+                log.Printf("Error listing Apple Pay domains: %v", err)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+            }
+            if existing != nil {
+                return jsonResponse(http.StatusOK, existing)
+            }
+
+            domain, err := applepaydomain.New(&stripe.ApplePayDomainParams{DomainName: stripe.String(domainName)})
+            if err != nil {
+                var stripeErr *stripe.Error
+                if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+                    // Usually Apple could not fetch the domain-association file from the domain
+                    return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: stripeErr.Msg}, nil
+                }
+                log.Printf("Error registering Apple Pay domain: %v", err)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+            }
+            log.Printf("Registered Apple Pay domain %s", domain.DomainName)
+            return jsonResponse(http.StatusCreated, domain)
+
+        default:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+    }
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    awsParams.stripeKey, err = getParameter(region, "/application/dev/stripe_key")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    log.Printf("Successfully retrieved stripe key!")
+
+    awsParams.associationURL, err = getParameter(region, "/application/dev/apple_pay_association_url")
+    if err != nil {
+        awsParams.associationURL = stripeAssociationURL
+    }
+
+    // Without the list no domain can be registered
+    allowedDomains, err := getParameter(region, "/application/dev/apple_pay_domains")
+    if err != nil {
+        log.Printf("Apple Pay domain registration is disabled: %v", err)
+    }
+    awsParams.allowedDomains = parseDomains(allowedDomains)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := applePayDomain(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(applePayDomain)
+}
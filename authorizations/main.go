@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// These values come from the fraud checks. Reason is used when canceling and defaults to "fraudulent". Currency is
+// only used when capturing a deposit recorded without its currency; any other is captured in the currency it was
+// authorised in.
+type AuthorizationRequest struct {
+    Reason   string `json:"reason"`
+    Currency string `json:"currency"`
+}
+
+// Cancellation reasons Stripe accepts
+var cancellationReasons = map[string]bool{
+    "abandoned":             true,
+    "duplicate":             true,
+    "fraudulent":            true,
+    "requested_by_customer": true,
+}
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// This function captures or cancels a deposit that was only authorised, because createPaymentIntent was called with
+// capture_method "manual". It is called by the fraud checks once they pass or fail, and must be protected by IAM
+// authorization.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest from AWS Lambda. The path holds the payment intent ID and the action.
+//
+// Returns:
+// - APIGatewayProxyResponse: Struct containing the HTTP status code, body, and headers of the response.
+// - error: Error object detailing any issues encountered during the execution of the function. If the operation is successful, the error is nil.
+//
+// authorizations():
+// 1. Loads the "Authorized" deposit with the payment intent ID from TransactionHistory.
+// 2. POST /authorizations/{id}/capture captures the whole authorised amount, in the currency recorded on the deposit,
+//    with the provider that took the deposit.
+// 3. POST /authorizations/{id}/cancel cancels it with the given reason, releasing the funds on the user's card.
+// 4. Returns the payment intent ID, its status and the provider.
+//
+// The ledger is left to the webhook: "payment_intent.succeeded" completes a captured deposit and makes it available,
+// and "payment_intent.canceled" drops a canceled one from the pending balance.
+func authorizations(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    intentID := request.PathParameters["id"]
+    action := request.PathParameters["action"]
+    if intentID == "" {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Payment intent ID is required"}, nil
+    }
+    if action != "capture" && action != "cancel" {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Unknown action " + action}, nil
+    }
+
+    var body AuthorizationRequest
+    if request.Body != "" {
+        if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+        }
+    }
+
+    deposit, err := transactions.GetTransaction(ctx, intentID)
+    if errors.Is(err, repository.ErrNotFound) {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Deposit not found"}, nil
+    }
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving deposit"}, err
+    }
+    if deposit.TransactionType != "Deposit" || deposit.TransactionStatus != "Authorized" {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusConflict,
+            Body:       "Deposit is " + deposit.TransactionStatus + ", not Authorized",
+        }, nil
+    }
+
+    provider, err := router.Provider(payments.ProviderName(deposit.ProviderName()))
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    var intent *payments.Intent
+    switch action {
+        case "capture":
+            currency := deposit.Currency
+            if currency == "" {
+                currency = body.Currency
+            }
+            intent, err = provider.CaptureIntent(ctx, &payments.CaptureParams{
+                IntentID:       intentID,
+                Amount:         deposit.Amount,
+                Currency:       currency,
+                IdempotencyKey: "capture_" + intentID,
+            })
+
+        case "cancel":
+            reason := body.Reason
+            if reason == "" {
+                reason = "fraudulent"
+            }
+            if !cancellationReasons[reason] {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Invalid reason " + reason}, nil
+            }
+            intent, err = provider.CancelIntent(ctx, &payments.CancelParams{IntentID: intentID, Reason: reason})
+    }
+    if errors.Is(err, payments.ErrNotFound) {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Payment intent not found"}, nil
+    }
+    if errors.Is(err, payments.ErrUnsupported) {
+        // Adyen needs the currency, and the deposit was recorded without one
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Currency is required to capture this deposit"}, nil
+    }
+    if err != nil {
+        log.Printf("Error trying to %s payment %s: %v", action, intentID, err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    log.Printf("Requested %s of payment %s, now %s", action, intentID, intent.Status)
+    return jsonResponse(http.StatusOK, map[string]string{
+        "payment_intent_id": intent.ID,
+        "status":            string(intent.Status),
+        "provider":          string(intent.Provider),
+    })
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := authorizations(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(authorizations)
+}
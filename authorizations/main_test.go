@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// fakeProvider records the captures and cancels it is asked for. authorizations uses no other method of
+// PaymentProvider; calling one panics on the nil embedded interface.
+type fakeProvider struct {
+	payments.PaymentProvider
+	name     payments.ProviderName
+	captures []*payments.CaptureParams
+	cancels  []*payments.CancelParams
+}
+
+func (p *fakeProvider) Name() payments.ProviderName { return p.name }
+
+func (p *fakeProvider) CaptureIntent(ctx context.Context, params *payments.CaptureParams) (*payments.Intent, error) {
+	p.captures = append(p.captures, params)
+	return &payments.Intent{ID: params.IntentID, Provider: p.name, Status: payments.StatusSucceeded}, nil
+}
+
+func (p *fakeProvider) CancelIntent(ctx context.Context, params *payments.CancelParams) (*payments.Intent, error) {
+	p.cancels = append(p.cancels, params)
+	return &payments.Intent{ID: params.IntentID, Provider: p.name, Status: payments.StatusCanceled}, nil
+}
+
+// setUp points the handler at memory repositories holding the given deposits and at a fake Stripe and Adyen, and
+// returns the fakes by name.
+func setUp(t *testing.T, deposits ...*repository.Transaction) map[payments.ProviderName]*fakeProvider {
+	t.Helper()
+	memory := repository.NewMemoryTransactionRepository()
+	for _, deposit := range deposits {
+		if err := memory.InsertTransaction(context.Background(), deposit); err != nil {
+			t.Fatalf("InsertTransaction: %v", err)
+		}
+	}
+	fakes := map[payments.ProviderName]*fakeProvider{
+		payments.Stripe: {name: payments.Stripe},
+		payments.Adyen:  {name: payments.Adyen},
+	}
+
+	previousTransactions, previousRouter := transactions, router
+	transactions = memory
+	router = payments.NewRouter(payments.RoutingConfig{Default: payments.Stripe}, func(name payments.ProviderName) (payments.PaymentProvider, error) {
+		return fakes[name], nil
+	})
+	t.Cleanup(func() { transactions, router = previousTransactions, previousRouter })
+	return fakes
+}
+
+func authorizedDeposit(id, provider, currency string) *repository.Transaction {
+	return &repository.Transaction{
+		TransactionID:     id,
+		UserID:            "user_1",
+		TransactionType:   "Deposit",
+		Amount:            5000,
+		TransactionStatus: "Authorized",
+		TransactionDate:   "2024-01-01 00:00:00",
+		Provider:          provider,
+		Currency:          currency,
+	}
+}
+
+func request(id, action, body string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{PathParameters: map[string]string{"id": id, "action": action}, Body: body}
+}
+
+func TestAuthorizationsCapture(t *testing.T) {
+	tests := []struct {
+		name         string
+		deposit      *repository.Transaction
+		body         string
+		wantProvider payments.ProviderName
+		wantCurrency string
+	}{
+		{"stripe", authorizedDeposit("pi_1", "stripe", "usd"), "", payments.Stripe, "usd"},
+		{"no provider recorded", authorizedDeposit("pi_1", "", "usd"), "", payments.Stripe, "usd"},
+		{"adyen", authorizedDeposit("pi_1", "adyen", "eur"), "", payments.Adyen, "eur"},
+		{"no currency recorded", authorizedDeposit("pi_1", "adyen", ""), `{"currency":"eur"}`, payments.Adyen, "eur"},
+		// The currency in the body is only a fallback
+		{"currency recorded", authorizedDeposit("pi_1", "stripe", "usd"), `{"currency":"eur"}`, payments.Stripe, "usd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := setUp(t, tt.deposit)
+
+			response, err := authorizations(context.Background(), request("pi_1", "capture", tt.body))
+			if err != nil || response.StatusCode != http.StatusOK {
+				t.Fatalf("authorizations = %d, %v; want 200", response.StatusCode, err)
+			}
+			var body map[string]string
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("error decoding response: %v", err)
+			}
+			if body["provider"] != string(tt.wantProvider) || body["status"] != string(payments.StatusSucceeded) {
+				t.Errorf("response = %v, want a succeeded %s payment", body, tt.wantProvider)
+			}
+
+			captures := fakes[tt.wantProvider].captures
+			if len(captures) != 1 {
+				t.Fatalf("%s captured %d times, want once", tt.wantProvider, len(captures))
+			}
+			want := payments.CaptureParams{IntentID: "pi_1", Amount: 5000, Currency: tt.wantCurrency, IdempotencyKey: "capture_pi_1"}
+			if *captures[0] != want {
+				t.Errorf("capture = %+v, want %+v", *captures[0], want)
+			}
+		})
+	}
+}
+
+func TestAuthorizationsCancel(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantReason string // Reason the provider is called with, or "" if it isn't called
+	}{
+		{"default reason", "", http.StatusOK, "fraudulent"},
+		{"given reason", `{"reason":"duplicate"}`, http.StatusOK, "duplicate"},
+		{"invalid reason", `{"reason":"bored"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := setUp(t, authorizedDeposit("pi_1", "stripe", "usd"))
+
+			response, err := authorizations(context.Background(), request("pi_1", "cancel", tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("authorizations = %d, %v; want %d", response.StatusCode, err, tt.wantStatus)
+			}
+			cancels := fakes[payments.Stripe].cancels
+			if tt.wantReason == "" {
+				if len(cancels) != 0 {
+					t.Errorf("canceled %d times, want none", len(cancels))
+				}
+				return
+			}
+			if len(cancels) != 1 || cancels[0].IntentID != "pi_1" || cancels[0].Reason != tt.wantReason {
+				t.Errorf("cancels = %+v, want pi_1 with reason %s", cancels, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestAuthorizationsRejected(t *testing.T) {
+	completed := authorizedDeposit("pi_2", "stripe", "usd")
+	completed.TransactionStatus = "Completed"
+	stake := authorizedDeposit("bet_1-stake", "", "")
+	stake.TransactionType = "BetStake"
+
+	tests := []struct {
+		name       string
+		id, action string
+		wantStatus int
+	}{
+		{"no ID", "", "capture", http.StatusBadRequest},
+		{"unknown action", "pi_1", "refund", http.StatusNotFound},
+		{"unknown deposit", "pi_3", "capture", http.StatusNotFound},
+		{"not authorized", "pi_2", "capture", http.StatusConflict},
+		{"not a deposit", "bet_1-stake", "cancel", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := setUp(t, authorizedDeposit("pi_1", "stripe", "usd"), completed, stake)
+
+			response, err := authorizations(context.Background(), request(tt.id, tt.action, ""))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Errorf("authorizations = %d, %v; want %d", response.StatusCode, err, tt.wantStatus)
+			}
+			for name, fake := range fakes {
+				if len(fake.captures)+len(fake.cancels) > 0 {
+					t.Errorf("%s was called", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/betchya/lambdas/auto_top_up
+
+go 1.21.4
+
+require (
+	github.com/betchya/lambdas/internal v0.0.0-00010101000000-000000000000
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/aws/aws-lambda-go v1.47.0 // indirect
+	github.com/aws/aws-sdk-go v1.52.3 // indirect
+	github.com/go-sql-driver/mysql v1.8.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/lib/pq v1.10.9 // indirect
+	github.com/mattn/go-sqlite3 v1.14.22 // indirect
+	github.com/stripe/stripe-go v70.15.0+incompatible // indirect
+)
+
+replace github.com/betchya/lambdas/internal => ../internal
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// BalanceChangedEvent is the payload this Lambda is invoked with whenever a user's AccountBalance changes.
+type BalanceChangedEvent struct {
+    UserID string `json:"UserID"`
+}
+
+// AutoTopUpSettings is a row of the AutoTopUpSettings table. Threshold and ReloadAmount are in minor units (cents).
+type AutoTopUpSettings struct {
+    Enabled         bool
+    Threshold       int64
+    ReloadAmount    int64
+    Currency        string
+    PaymentMethodID string
+}
+
+// Minimum time between two automatic reloads for the same user
+const autoTopUpMinInterval = 1 * time.Hour
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var transactions repository.TransactionRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// recordPendingDeposit logs an auto top-up deposit as "Pending" and adds it to the user's pending balance. Both are
+// written in one database transaction under the user's lock, and only if the webhook hasn't recorded the deposit already.
+func recordPendingDeposit(ctx context.Context, deposit *repository.Transaction) error {
+    return database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        _, err := repository.RecordPendingDeposit(ctx, repository.NewSQLUserRepository(tx, dialect), repository.NewSQLTransactionRepository(tx), deposit)
+        return err
+    })
+}
+
+func getAutoTopUpSettings(userID string) (*AutoTopUpSettings, error) {
+    query := `SELECT Enabled, Threshold, ReloadAmount, Currency, PaymentMethodID FROM AutoTopUpSettings WHERE UserID = ?`
+
+    var settings AutoTopUpSettings
+    err := db.QueryRow(query, userID).Scan(&settings.Enabled, &settings.Threshold, &settings.ReloadAmount, &settings.Currency, &settings.PaymentMethodID)
+    if err != nil {
+        return nil, err
+    }
+    return &settings, nil
+}
+
+// depositLimitHeadroom returns how much more the user may deposit, in minor units, before hitting the tightest
+// of their daily and monthly deposit limits. Deposits still in flight count against the limits as well as completed
+// ones. ok is false when the user has no deposit limits configured.
+func depositLimitHeadroom(ctx context.Context, userID string, now time.Time) (headroom int64, ok bool, err error) {
+    query := `SELECT DailyLimit, MonthlyLimit FROM DepositLimits WHERE UserID = ?`
+
+    var daily, monthly sql.NullInt64
+    err = db.QueryRow(query, userID).Scan(&daily, &monthly)
+    if err == sql.ErrNoRows {
+        return 0, false, nil
+    }
+    if err != nil {
+        return 0, false, fmt.Errorf("depositLimitHeadroom: %v", err)
+    }
+
+    headroom = math.MaxInt64
+    if daily.Valid {
+        deposited, err := repository.DepositedSince(ctx, transactions, userID, now.Add(-24*time.Hour).Format(mysqlDateTimeLayout))
+        if err != nil {
+            return 0, false, err
+        }
+        headroom = daily.Int64 - deposited
+    }
+    if monthly.Valid {
+        deposited, err := repository.DepositedSince(ctx, transactions, userID, now.AddDate(0, -1, 0).Format(mysqlDateTimeLayout))
+        if err != nil {
+            return 0, false, err
+        }
+        if remaining := monthly.Int64 - deposited; remaining < headroom {
+            headroom = remaining
+        }
+    }
+    if headroom < 0 {
+        headroom = 0
+    }
+    return headroom, daily.Valid || monthly.Valid, nil
+}
+
+// claimAutoTopUp records that a reload is starting. It only succeeds when the previous reload is older than
+// autoTopUpMinInterval, which both rate limits reloads and stops concurrent invocations from charging twice.
+func claimAutoTopUp(userID string, now time.Time) (bool, error) {
+    query := `UPDATE AutoTopUpSettings SET LastTriggeredAt = ?
+              WHERE UserID = ? AND Enabled = TRUE AND (LastTriggeredAt IS NULL OR LastTriggeredAt < ?)`
+
+    result, err := db.Exec(query, now.Format(mysqlDateTimeLayout), userID, now.Add(-autoTopUpMinInterval).Format(mysqlDateTimeLayout))
+    if err != nil {
+        return false, fmt.Errorf("claimAutoTopUp: %v", err)
+    }
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return false, fmt.Errorf("claimAutoTopUp: %v", err)
+    }
+    return rows == 1, nil
+}
+
+func disableAutoTopUp(userID string) error {
+    query := `UPDATE AutoTopUpSettings SET Enabled = FALSE WHERE UserID = ?`
+    _, err := db.Exec(query, userID)
+    if err != nil {
+        return fmt.Errorf("disableAutoTopUp: %v", err)
+    }
+    return nil
+}
+
+func notifyUser(userID, message string) error {
+    query := `INSERT INTO UserNotifications (UserID, Message, CreatedAt) VALUES (?, ?, ?)`
+    _, err := db.Exec(query, userID, message, time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil {
+        return fmt.Errorf("notifyUser: %v", err)
+    }
+    return nil
+}
+
+// failAutoTopUp turns auto top-up off after a failed reload and tells the user why.
+func failAutoTopUp(userID, reason string) {
+    log.Printf("Auto top-up failed for user %s: %s", userID, reason)
+    if err := disableAutoTopUp(userID); err != nil {
+        log.Printf("Error disabling auto top-up: %v", err)
+    }
+    if err := notifyUser(userID, "Auto top-up has been turned off because a reload failed: "+reason); err != nil {
+        log.Printf("Error notifying user: %v", err)
+    }
+}
+
+// autoTopUp() reloads a user's wallet when a balance change has left them below their auto top-up threshold.
+// It is invoked asynchronously with a BalanceChangedEvent after every balance update.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The BalanceChangedEvent naming the user whose balance changed.
+//
+// Returns:
+// - error: Only returned for infrastructure errors before a charge is attempted. Failed charges disable
+//   auto top-up instead, so that Lambda's async retries never charge the user twice.
+//
+// autoTopUp():
+// 1. Loads the user's auto top-up settings and returns early if they are missing or disabled.
+// 2. Compares the current AccountBalance against the threshold.
+// 3. Skips the reload if it would exceed the user's deposit limits.
+// 4. Claims the reload, which enforces autoTopUpMinInterval between reloads.
+// 5. Creates and confirms an off-session payment intent for the reload amount with the saved payment method.
+// 6. Records the deposit as "Pending" so the webhook credits it like any other deposit, or disables
+//    auto top-up and notifies the user if the charge failed.
+func autoTopUp(ctx context.Context, event BalanceChangedEvent) error {
+    userID := event.UserID
+
+    settings, err := getAutoTopUpSettings(userID)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error retrieving auto top-up settings: %w", err)
+    }
+    if !settings.Enabled {
+        return nil
+    }
+
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return fmt.Errorf("error retrieving user: %w", err)
+    }
+    if user.AccountBalance >= settings.Threshold {
+        return nil
+    }
+
+    now := time.Now().UTC()
+    headroom, limited, err := depositLimitHeadroom(ctx, userID, now)
+    if err != nil {
+        return err
+    }
+    if limited && settings.ReloadAmount > headroom {
+        log.Printf("Skipping auto top-up for user %s: reload of %d exceeds deposit limit headroom of %d", userID, settings.ReloadAmount, headroom)
+        if err := notifyUser(userID, "Auto top-up was skipped because it would exceed your deposit limit."); err != nil {
+            log.Printf("Error notifying user: %v", err)
+        }
+        return nil
+    }
+
+    claimed, err := claimAutoTopUp(userID, now)
+    if err != nil {
+        return err
+    }
+    if !claimed {
+        log.Printf("Auto top-up for user %s is rate limited", userID)
+        return nil
+    }
+
+    if user.StripeCustomerID == nil {
+        failAutoTopUp(userID, "no Stripe customer on file")
+        return nil
+    }
+
+    // The payment method is saved at Stripe, so the reload is pinned to it rather than failed over
+    intent, err := router.CreateIntent(ctx, payments.Deposit{Currency: settings.Currency, Amount: settings.ReloadAmount, Provider: payments.Stripe}, &payments.IntentParams{
+        UserID:          userID,
+        CustomerID:      *user.StripeCustomerID,
+        Amount:          settings.ReloadAmount,
+        Currency:        settings.Currency,
+        PaymentMethodID: settings.PaymentMethodID,
+        OffSession:      true,
+        Confirm:         true,
+        IdempotencyKey:  fmt.Sprintf("auto-top-up-%s-%d", userID, now.Unix()),
+        Metadata:        map[string]string{"Source": "auto_top_up"},
+    })
+    if err != nil {
+        failAutoTopUp(userID, err.Error())
+        return nil
+    }
+    if intent.Status != payments.StatusSucceeded {
+        failAutoTopUp(userID, "payment ended in status "+string(intent.Status))
+        return nil
+    }
+
+    deposit := &repository.Transaction{
+        TransactionID:     intent.ID,
+        UserID:            userID,
+        TransactionType:   "Deposit",
+        Amount:            intent.Amount,
+        TransactionStatus: "Pending",
+        TransactionDate:   now.Format(mysqlDateTimeLayout),
+        Provider:          string(intent.Provider),
+        Currency:          intent.Currency,
+    }
+    if err := recordPendingDeposit(ctx, deposit); err != nil {
+        log.Printf("Error recording auto top-up deposit: %v", err)
+    }
+    log.Printf("Auto top-up of %d %s started for user %s with payment intent %s", intent.Amount, intent.Currency, userID, intent.ID)
+    return nil
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event BalanceChangedEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    ctx := context.Background()
+    if err := autoTopUp(ctx, event); err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Println("Auto top-up check finished")
+
+    //lambda.Start(autoTopUp)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// AutoTopUpSettings is a row of the AutoTopUpSettings table. Threshold and ReloadAmount are in minor units (cents).
+type AutoTopUpSettings struct {
+    Enabled         bool   `json:"enabled"`
+    Threshold       int64  `json:"threshold"`
+    ReloadAmount    int64  `json:"reload_amount"`
+    Currency        string `json:"currency"`
+    PaymentMethodID string `json:"PaymentMethodID"`
+}
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+func getAutoTopUpSettings(userID string) (*AutoTopUpSettings, error) {
+    query := `SELECT Enabled, Threshold, ReloadAmount, Currency, PaymentMethodID FROM AutoTopUpSettings WHERE UserID = ?`
+
+    var settings AutoTopUpSettings
+    err := db.QueryRow(query, userID).Scan(&settings.Enabled, &settings.Threshold, &settings.ReloadAmount, &settings.Currency, &settings.PaymentMethodID)
+    if err != nil {
+        return nil, err
+    }
+    return &settings, nil
+}
+
+func upsertAutoTopUpSettings(userID string, settings AutoTopUpSettings) error {
+    var assignments []string
+    for _, column := range []string{"Enabled", "Threshold", "ReloadAmount", "Currency", "PaymentMethodID"} {
+        assignments = append(assignments, column+" = "+dialect.Excluded(column))
+    }
+    query := `INSERT INTO AutoTopUpSettings (UserID, Enabled, Threshold, ReloadAmount, Currency, PaymentMethodID)
+              VALUES (?, ?, ?, ?, ?, ?) ` + dialect.OnConflictUpdate("UserID", assignments...)
+
+    _, err := db.Exec(query, userID, settings.Enabled, settings.Threshold, settings.ReloadAmount, settings.Currency, settings.PaymentMethodID)
+    if err != nil {
+        return fmt.Errorf("upsertAutoTopUpSettings: %v", err)
+    }
+    return nil
+}
+
+func disableAutoTopUp(userID string) error {
+    query := `UPDATE AutoTopUpSettings SET Enabled = FALSE WHERE UserID = ?`
+    _, err := db.Exec(query, userID)
+    if err != nil {
+        return fmt.Errorf("disableAutoTopUp: %v", err)
+    }
+    return nil
+}
+
+// autoTopUpSettings() lets a user read and change their auto top-up settings. The HTTP method selects the operation:
+// GET returns the current settings, PUT creates or replaces them, and DELETE turns auto top-up off.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest; for PUT the body holds an AutoTopUpSettings object.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, response body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+//
+// Before saving, the payment method is checked against the caller's Stripe customer so that the balance-change
+// trigger in autoTopUp can only ever charge the user's own saved payment method off-session.
+func autoTopUpSettings(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+
+    switch request.HTTPMethod {
+        case http.MethodGet:
+            settings, err := getAutoTopUpSettings(userID)
+            if err == sql.ErrNoRows {
+                return jsonResponse(http.StatusOK, AutoTopUpSettings{})
+            }
+            if err != nil {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusInternalServerError,
+                    Body:       "Error retrieving auto top-up settings",
+                }, err
+            }
+            return jsonResponse(http.StatusOK, settings)
+
+        case http.MethodPut:
+            var settings AutoTopUpSettings
+            if err := json.Unmarshal([]byte(request.Body), &settings); err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+            }
+            if settings.Threshold < 0 || settings.ReloadAmount <= 0 || settings.Currency == "" || settings.PaymentMethodID == "" {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusBadRequest,
+                    Body:       "threshold, reload_amount, currency and PaymentMethodID are required",
+                }, nil
+            }
+
+            user, err := users.GetUser(ctx, userID)
+            if err != nil {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusInternalServerError,
+                    Body:       "Error retrieving user from database",
+                    Headers:    map[string]string{"Content-Type": "application/json"},
+                }, err
+            }
+            if user.StripeCustomerID == nil {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusOK,
+                    Body:       "Customer does not have a Stripe customer ID. Are they registered as a customer?",
+                    Headers:    map[string]string{"Content-Type": "application/json"},
+                }, nil
+            }
+
+            provider, err := router.Provider(payments.Stripe)
+            if err != nil {
+                log.Printf("Error opening Stripe: %v", err)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+            }
+            pm, err := provider.GetPaymentMethod(ctx, settings.PaymentMethodID)
+            if err != nil {
+                log.Printf("Error retrieving payment method: %v", err)
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+            }
+            if pm.CustomerID != *user.StripeCustomerID {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusForbidden,
+                    Body:       "Payment method is not saved for this customer",
+                }, nil
+            }
+
+            if err := upsertAutoTopUpSettings(userID, settings); err != nil {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusInternalServerError,
+                    Body:       "Error saving auto top-up settings",
+                }, err
+            }
+            return jsonResponse(http.StatusOK, settings)
+
+        case http.MethodDelete:
+            if err := disableAutoTopUp(userID); err != nil {
+                return events.APIGatewayProxyResponse{
+                    StatusCode: http.StatusInternalServerError,
+                    Body:       "Error disabling auto top-up",
+                }, err
+            }
+            return events.APIGatewayProxyResponse{
+                StatusCode: http.StatusOK,
+                Body:       "Auto top-up disabled",
+            }, nil
+
+        default:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+    }
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := autoTopUpSettings(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(autoTopUpSettings)
+}
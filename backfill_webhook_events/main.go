@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/event"
+)
+
+// BackfillOptions is read from the "detail" of the scheduled event. All fields are optional.
+type BackfillOptions struct {
+    Since  string `json:"since"`   // RFC 3339. Start from here instead of the stored checkpoint.
+    DryRun bool   `json:"dry_run"` // List the events that would be queued without queueing them
+}
+
+// BackfillResult summarises one run
+type BackfillResult struct {
+    Listed     int   `json:"listed"`
+    Skipped    int   `json:"skipped"` // Already processed by the webhook worker
+    Queued     int   `json:"queued"`
+    Failed     int   `json:"failed"`
+    Checkpoint int64 `json:"checkpoint"` // Created time of the last event processed in order
+}
+
+// Struct to keep the secret key and more params if needed
+type AWSParams struct {
+	stripeKey string
+	queueURL  string // SQS queue consumed by processWebhookEvents
+}
+
+// Event types handled by the webhook. Other events are not backfilled.
+var webhookEventTypes = []string{
+    "payment_intent.processing",
+    "payment_intent.amount_capturable_updated",
+    "payment_intent.succeeded",
+    "payment_intent.payment_failed",
+    "payment_intent.canceled",
+    "charge.refunded",
+    "charge.dispute.created",
+    "charge.dispute.closed",
+    "checkout.session.completed",
+    "checkout.session.expired",
+}
+
+const (
+    // Name of this job's row in WebhookCheckpoints
+    checkpointName = "stripe_events_backfill"
+    // How far back the first run looks when there is no checkpoint yet. Stripe keeps events for 30 days.
+    defaultBackfillWindow = 3 * 24 * time.Hour
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var awsParams AWSParams
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+
+// loadCheckpoint returns the created time of the last event the backfill processed, or found false on the first run.
+func loadCheckpoint() (created int64, found bool, err error) {
+    query := `SELECT LastEventCreated FROM WebhookCheckpoints WHERE Name = ?`
+    err = db.QueryRow(query, checkpointName).Scan(&created)
+    if err == sql.ErrNoRows {
+        return 0, false, nil
+    }
+    if err != nil {
+        return 0, false, fmt.Errorf("loadCheckpoint: %v", err)
+    }
+    return created, true, nil
+}
+
+func saveCheckpoint(created int64) error {
+    query := `INSERT INTO WebhookCheckpoints (Name, LastEventCreated) VALUES (?, ?)
+              ` + dialect.OnConflictUpdate("Name", "LastEventCreated = "+dialect.Excluded("LastEventCreated"))
+    _, err := db.Exec(query, checkpointName, created)
+    if err != nil {
+        return fmt.Errorf("saveCheckpoint: %v", err)
+    }
+    return nil
+}
+
+// eventProcessed reports whether the webhook worker already processed the event with the given ID.
+func eventProcessed(eventID string) (bool, error) {
+    var count int
+    query := `SELECT COUNT(*) FROM WebhookEvents WHERE EventID = ? AND Status = 'Processed'`
+    if err := db.QueryRow(query, eventID).Scan(&count); err != nil {
+        return false, fmt.Errorf("eventProcessed: %v", err)
+    }
+    return count > 0, nil
+}
+
+// listEventsSince returns the webhook's event types created at or after since, oldest first. The checkpoint's own
+// second is included again, since events created in the same second may not all have been processed; they are
+// skipped by ID if they were.
+func listEventsSince(since int64) ([]*stripe.Event, error) {
+    params := &stripe.EventListParams{
+        CreatedRange: &stripe.RangeQueryParams{GreaterThanOrEqual: since},
+        Types:        stripe.StringSlice(webhookEventTypes),
+    }
+
+    // Stripe lists newest first
+    var listed []*stripe.Event
+    i := event.List(params)
+    for i.Next() {
+        listed = append(listed, i.Event())
+    }
+    if err := i.Err(); err != nil {
+        return nil, fmt.Errorf("listing events: %v", err)
+    }
+
+    for l, r := 0, len(listed)-1; l < r; l, r = l+1, r-1 {
+        listed[l], listed[r] = listed[r], listed[l]
+    }
+    return listed, nil
+}
+
+// enqueueWebhookEvent persists e to WebhookEvents, as the webhook endpoint does, and puts it on the webhook queue.
+func enqueueWebhookEvent(e *stripe.Event) error {
+    body, err := json.Marshal(e)
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+
+    query := `INSERT INTO WebhookEvents (EventID, EventType, Payload, Status, Attempts, ReceivedAt)
+              VALUES (?, ?, ?, 'Received', 0, ?) ` + dialect.OnConflictDoNothing("EventID")
+    if _, err := db.Exec(query, e.ID, e.Type, string(body), time.Now().UTC().Format(mysqlDateTimeLayout)); err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+    _, err = sqs.New(sess).SendMessage(&sqs.SendMessageInput{
+        QueueUrl:    aws.String(awsParams.queueURL),
+        MessageBody: aws.String(string(body)),
+    })
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+    return nil
+}
+
+// backfillWebhookEvents() is triggered by an EventBridge schedule, or run from the command line, to recover
+// webhook events that were lost while the webhook was down or failing. It lists the Stripe events created since
+// the stored checkpoint, oldest first, and queues every event that WebhookEvents does not show as processed for
+// processWebhookEvents. The checkpoint only advances past events that were queued or skipped, so an event that
+// fails is retried on the next run.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The scheduled EventBridge event. Its detail may hold BackfillOptions.
+//
+// Returns:
+// - BackfillResult: Counts of the events listed, skipped and queued, and the new checkpoint.
+// - error: Non-nil if the options are invalid, or the events or checkpoint could not be read or saved.
+func backfillWebhookEvents(ctx context.Context, cwEvent events.CloudWatchEvent) (*BackfillResult, error) {
+    stripe.Key = awsParams.stripeKey
+
+    var opts BackfillOptions
+    if len(cwEvent.Detail) > 0 {
+        if err := json.Unmarshal(cwEvent.Detail, &opts); err != nil {
+            return nil, fmt.Errorf("invalid backfill options: %v", err)
+        }
+    }
+
+    since, found, err := loadCheckpoint()
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        since = time.Now().Add(-defaultBackfillWindow).Unix()
+    }
+    if opts.Since != "" {
+        t, err := time.Parse(time.RFC3339, opts.Since)
+        if err != nil {
+            return nil, fmt.Errorf("invalid since: %v", err)
+        }
+        since = t.Unix()
+    }
+
+    listed, err := listEventsSince(since)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &BackfillResult{Listed: len(listed), Checkpoint: since}
+    blocked := false
+    for _, e := range listed {
+        processed, err := eventProcessed(e.ID)
+        if err != nil {
+            return nil, err
+        }
+
+        switch {
+        case processed:
+            result.Skipped++
+        case opts.DryRun:
+            log.Printf("Would queue %s event %s", e.Type, e.ID)
+            continue
+        default:
+            if err := enqueueWebhookEvent(e); err != nil {
+                log.Printf("Error queueing %s event %s: %v", e.Type, e.ID, err)
+                result.Failed++
+                blocked = true
+                continue
+            }
+            result.Queued++
+        }
+
+        if !blocked {
+            result.Checkpoint = e.Created
+        }
+    }
+
+    if !opts.DryRun && result.Checkpoint != since {
+        if err := saveCheckpoint(result.Checkpoint); err != nil {
+            return nil, err
+        }
+    }
+
+    log.Printf("Backfill listed %d events, skipped %d, queued %d, failed %d", result.Listed, result.Skipped, result.Queued, result.Failed)
+    return result, nil
+}
+
+func main() {
+    // For local runs, -since overrides the checkpoint and -dry-run only lists what would be queued
+    since := flag.String("since", "", "backfill events created at or after this RFC 3339 timestamp")
+    dryRun := flag.Bool("dry-run", false, "list events without queueing them")
+    flag.Parse()
+
+    region := "us-west-2"
+    paramName := "/application/dev/stripe_key"
+	var err error
+
+    awsParams.stripeKey, err = getParameter(region, paramName)
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    log.Printf("Successfully retrieved stripe key!")
+
+    awsParams.queueURL, err = getParameter(region, "/application/dev/webhook_queue_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var cwEvent events.CloudWatchEvent
+    err = json.Unmarshal(file, &cwEvent)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    if *since != "" || *dryRun {
+        cwEvent.Detail, _ = json.Marshal(BackfillOptions{Since: *since, DryRun: *dryRun})
+    }
+
+    ctx := context.Background()
+    result, err := backfillWebhookEvents(ctx, cwEvent)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Printf("Handler response: %+v\n", *result)
+
+    //lambda.Start(backfillWebhookEvents)
+}
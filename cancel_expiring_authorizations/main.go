@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// CancelOptions is read from the "detail" of the scheduled event. All fields are optional.
+type CancelOptions struct {
+    MaxAge string `json:"max_age"` // Go duration, e.g. "144h". Authorisations older than this are canceled.
+}
+
+// Clock lets the job run against a fixed time locally instead of the wall clock.
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c).UTC() }
+
+// ExpiringAuthorization is an "Authorized" deposit that is about to lapse
+type ExpiringAuthorization struct {
+    TransactionID string
+    Provider      payments.ProviderName
+}
+
+const (
+    // Default age after which an authorisation is canceled. Card authorisations lapse after seven days, so this
+    // leaves a day to cancel them cleanly before the issuer drops them.
+    defaultAuthorizationMaxAge = 6 * 24 * time.Hour
+    // Maximum number of authorisations canceled per invocation
+    cancelBatchSize = 100
+    // Reason given to the provider for the cancellation
+    cancelReason = "abandoned"
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+var router *payments.Router
+var clock Clock = systemClock{}
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// findExpiringAuthorizations returns the "Deposit" rows that have been "Authorized" since before cutoff, oldest first.
+func findExpiringAuthorizations(ctx context.Context, cutoff time.Time) ([]ExpiringAuthorization, error) {
+    deposits, err := transactions.FindTransactions(ctx, &repository.TransactionQuery{
+        TransactionType: "Deposit",
+        Statuses:        []string{"Authorized"},
+        To:              cutoff.Format(mysqlDateTimeLayout),
+        Limit:           cancelBatchSize,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var authorizations []ExpiringAuthorization
+    for _, deposit := range deposits {
+        authorizations = append(authorizations, ExpiringAuthorization{
+            TransactionID: deposit.TransactionID,
+            Provider:      payments.ProviderName(deposit.ProviderName()),
+        })
+    }
+    return authorizations, nil
+}
+
+// cancelAuthorization cancels one authorisation with the provider that took it.
+func cancelAuthorization(ctx context.Context, authorization ExpiringAuthorization) error {
+    provider, err := router.Provider(authorization.Provider)
+    if err != nil {
+        return err
+    }
+
+    intent, err := provider.CancelIntent(ctx, &payments.CancelParams{
+        IntentID: authorization.TransactionID,
+        Reason:   cancelReason,
+    })
+    if err != nil {
+        return err
+    }
+    log.Printf("Canceled authorisation %s with %s, now %s", intent.ID, authorization.Provider, intent.Status)
+    return nil
+}
+
+// cancelExpiringAuthorizations() is triggered by an EventBridge schedule. It finds deposits that have been
+// "Authorized" for longer than the configured age, because the fraud checks never captured or canceled them, and
+// cancels each with its provider before the authorisation lapses on the user's card.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The scheduled EventBridge event. Its detail may hold CancelOptions.
+//
+// Returns:
+// - error: Non-nil if the options are invalid or the authorisations could not be loaded. Failures of individual
+//   rows are logged, and the row is retried on the next run.
+//
+// Like the authorizations endpoint, this leaves the ledger to the webhook: "payment_intent.canceled" drops the
+// deposit from the user's pending balance.
+func cancelExpiringAuthorizations(ctx context.Context, event events.CloudWatchEvent) error {
+    var opts CancelOptions
+    if len(event.Detail) > 0 {
+        if err := json.Unmarshal(event.Detail, &opts); err != nil {
+            return fmt.Errorf("invalid cancel options: %v", err)
+        }
+    }
+    maxAge := defaultAuthorizationMaxAge
+    if opts.MaxAge != "" {
+        parsed, err := time.ParseDuration(opts.MaxAge)
+        if err != nil || parsed <= 0 {
+            return fmt.Errorf("invalid max_age %q", opts.MaxAge)
+        }
+        maxAge = parsed
+    }
+
+    authorizations, err := findExpiringAuthorizations(ctx, clock.Now().Add(-maxAge))
+    if err != nil {
+        return err
+    }
+    log.Printf("Found %d deposits authorised for more than %s", len(authorizations), maxAge)
+
+    for _, authorization := range authorizations {
+        if err := cancelAuthorization(ctx, authorization); err != nil {
+            log.Printf("Error canceling authorisation %s: %v", authorization.TransactionID, err)
+        }
+    }
+    return nil
+}
+
+func main() {
+    // For local runs, -now pins the clock and -max-age overrides the age given in event.json
+    fakeNow := flag.String("now", "", "run as if the current time were this RFC 3339 timestamp")
+    maxAge := flag.String("max-age", "", "cancel authorisations older than this duration")
+    flag.Parse()
+    if *fakeNow != "" {
+        parsed, err := time.Parse(time.RFC3339, *fakeNow)
+        if err != nil {
+            log.Fatalf("Invalid -now: %v", err)
+        }
+        clock = fixedClock(parsed)
+    }
+
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event events.CloudWatchEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    if *maxAge != "" {
+        event.Detail, _ = json.Marshal(CancelOptions{MaxAge: *maxAge})
+    }
+
+    ctx := context.Background()
+    if err := cancelExpiringAuthorizations(ctx, event); err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Println("Expiring authorisation cancel finished")
+
+    //lambda.Start(cancelExpiringAuthorizations)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// fakeProvider records the payments it is asked to cancel, and fails to cancel the ones in fail.
+// cancelExpiringAuthorizations uses no other method of PaymentProvider; calling one panics on the nil embedded
+// interface.
+type fakeProvider struct {
+	payments.PaymentProvider
+	name     payments.ProviderName
+	fail     map[string]bool
+	canceled []string
+}
+
+func (p *fakeProvider) Name() payments.ProviderName { return p.name }
+
+func (p *fakeProvider) CancelIntent(ctx context.Context, params *payments.CancelParams) (*payments.Intent, error) {
+	if params.Reason != cancelReason {
+		return nil, errors.New("unexpected reason " + params.Reason)
+	}
+	if p.fail[params.IntentID] {
+		return nil, payments.ErrProviderUnavailable
+	}
+	p.canceled = append(p.canceled, params.IntentID)
+	return &payments.Intent{ID: params.IntentID, Provider: p.name, Status: payments.StatusCanceled}, nil
+}
+
+// now is the time the tests run at
+var now = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+// setUp points the job at a new SQLite database holding the given deposits of user_1, at a fake Stripe and Adyen
+// and at a clock fixed to now. It returns the fakes by name.
+func setUp(t *testing.T, deposits ...*repository.Transaction) map[payments.ProviderName]*fakeProvider {
+	t.Helper()
+	t.Setenv("STAGE", "local")
+	t.Setenv("LOCAL_DB_PATH", filepath.Join(t.TempDir(), "test.db"))
+	testDB, testDialect, err := database.Open("us-west-2")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	_, err = testDB.Exec(`INSERT INTO Users (UserID, Username, Email, DateOfBirth) VALUES ('user_1', 'user_1', 'user_1@example.com', '2000-01-01')`)
+	if err != nil {
+		t.Fatalf("error inserting user_1: %v", err)
+	}
+	testTransactions := repository.NewSQLTransactionRepository(testDB)
+	for _, deposit := range deposits {
+		if err := testTransactions.InsertTransaction(context.Background(), deposit); err != nil {
+			t.Fatalf("InsertTransaction: %v", err)
+		}
+	}
+
+	fakes := map[payments.ProviderName]*fakeProvider{
+		payments.Stripe: {name: payments.Stripe},
+		payments.Adyen:  {name: payments.Adyen},
+	}
+	previousDB, previousDialect, previousTransactions, previousRouter, previousClock := db, dialect, transactions, router, clock
+	db, dialect, transactions, clock = testDB, testDialect, testTransactions, fixedClock(now)
+	router = payments.NewRouter(payments.RoutingConfig{Default: payments.Stripe}, func(name payments.ProviderName) (payments.PaymentProvider, error) {
+		return fakes[name], nil
+	})
+	t.Cleanup(func() {
+		db, dialect, transactions, router, clock = previousDB, previousDialect, previousTransactions, previousRouter, previousClock
+		testDB.Close()
+	})
+	return fakes
+}
+
+// deposit returns a deposit of user_1 dated age before now.
+func deposit(id, status, provider string, age time.Duration) *repository.Transaction {
+	return &repository.Transaction{
+		TransactionID:     id,
+		UserID:            "user_1",
+		TransactionType:   "Deposit",
+		Amount:            5000,
+		TransactionStatus: status,
+		TransactionDate:   now.Add(-age).Format(mysqlDateTimeLayout),
+		Provider:          provider,
+		Currency:          "usd",
+	}
+}
+
+func TestCancelExpiringAuthorizations(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	deposits := []*repository.Transaction{
+		deposit("pi_old", "Authorized", "stripe", week),
+		deposit("pi_no_provider", "Authorized", "", week),
+		deposit("psp_old", "Authorized", "adyen", week),
+		deposit("pi_recent", "Authorized", "stripe", 24*time.Hour),
+		deposit("pi_completed", "Completed", "stripe", week),
+	}
+
+	tests := []struct {
+		name       string
+		maxAge     string
+		wantStripe []string
+		wantAdyen  []string
+	}{
+		{"default age", "", []string{"pi_no_provider", "pi_old"}, []string{"psp_old"}},
+		{"shorter age", "12h", []string{"pi_no_provider", "pi_old", "pi_recent"}, []string{"psp_old"}},
+		{"longer age", "192h", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := setUp(t, deposits...)
+
+			var event events.CloudWatchEvent
+			if tt.maxAge != "" {
+				event.Detail, _ = json.Marshal(CancelOptions{MaxAge: tt.maxAge})
+			}
+			if err := cancelExpiringAuthorizations(context.Background(), event); err != nil {
+				t.Fatalf("cancelExpiringAuthorizations: %v", err)
+			}
+
+			for name, want := range map[payments.ProviderName][]string{payments.Stripe: tt.wantStripe, payments.Adyen: tt.wantAdyen} {
+				canceled := fakes[name].canceled
+				sort.Strings(canceled)
+				if !reflect.DeepEqual(canceled, want) {
+					t.Errorf("%s canceled %v, want %v", name, canceled, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelExpiringAuthorizationsFailures(t *testing.T) {
+	week := 7 * 24 * time.Hour
+	fakes := setUp(t, deposit("pi_1", "Authorized", "stripe", week+time.Hour), deposit("pi_2", "Authorized", "stripe", week))
+	fakes[payments.Stripe].fail = map[string]bool{"pi_1": true}
+
+	// A failed cancel is left for the next run and doesn't stop the others
+	if err := cancelExpiringAuthorizations(context.Background(), events.CloudWatchEvent{}); err != nil {
+		t.Fatalf("cancelExpiringAuthorizations: %v", err)
+	}
+	if canceled := fakes[payments.Stripe].canceled; !reflect.DeepEqual(canceled, []string{"pi_2"}) {
+		t.Errorf("canceled %v, want [pi_2]", canceled)
+	}
+
+	for _, maxAge := range []string{"soon", "-1h"} {
+		event := events.CloudWatchEvent{Detail: json.RawMessage(`{"max_age":"` + maxAge + `"}`)}
+		if err := cancelExpiringAuthorizations(context.Background(), event); err == nil {
+			t.Errorf("max_age %q: err = nil, want an error", maxAge)
+		}
+	}
+}
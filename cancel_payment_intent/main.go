@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// Body of a cancel request, optional. Reason is one of cancellationReasons and defaults to "abandoned". Provider is
+// the provider createPaymentIntent returned with the intent, only needed when no deposit was recorded for it; the
+// default provider if it is empty.
+type CancelPaymentIntentRequest struct {
+    Reason   string `json:"reason"`
+    Provider string `json:"provider"`
+}
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Cancellation reasons a user may give. "fraudulent" is kept for the fraud checks, see authorizations.
+var cancellationReasons = map[string]bool{
+    "abandoned":             true,
+    "duplicate":             true,
+    "requested_by_customer": true,
+}
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var transactions repository.TransactionRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// ownsIntent reports whether a payment belongs to the user: its customer at the provider is the user's, or, at a
+// provider without customer records, it was created for the user.
+func ownsIntent(intent *payments.Intent, user *repository.User) bool {
+    if intent.CustomerID != "" {
+        return user.StripeCustomerID != nil && *user.StripeCustomerID == intent.CustomerID
+    }
+    return intent.UserID != "" && intent.UserID == user.UserID
+}
+
+// markDepositCanceled marks the user's deposit for a canceled payment intent "Canceled" and returns its status, or
+// "" if nothing was recorded for it. A deposit still in flight is dropped from the pending balance; a "Failed" one
+// was dropped already, and one repository.CanTransition doesn't allow to be canceled, such as a "Completed" one, is
+// left alone.
+func markDepositCanceled(ctx context.Context, userID, intentID string) (string, error) {
+    var status string
+    err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        txUsers := repository.NewSQLUserRepository(tx, dialect)
+        txTransactions := repository.NewSQLTransactionRepository(tx)
+        if err := txUsers.LockUser(ctx, userID); err != nil {
+            return err
+        }
+
+        deposit, err := txTransactions.GetTransaction(ctx, intentID)
+        if errors.Is(err, repository.ErrNotFound) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if deposit.UserID != userID || deposit.TransactionType != "Deposit" {
+            return nil
+        }
+
+        status = deposit.TransactionStatus
+        moved, err := txTransactions.TransitionTransaction(ctx, intentID, status, "Canceled", time.Now().UTC().Format(mysqlDateTimeLayout))
+        if errors.Is(err, repository.ErrIllegalTransition) {
+            return nil
+        }
+        if err != nil || !moved {
+            return err
+        }
+        wasPending := status != "Failed"
+        status = "Canceled"
+        if !wasPending {
+            return nil
+        }
+        return txUsers.AddPendingBalance(ctx, userID, -deposit.Amount)
+    })
+    return status, err
+}
+
+// This function cancels a deposit the user abandoned, so its payment no longer holds their payment method.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest from AWS Lambda. The path holds the payment intent ID.
+//
+// Returns:
+// - APIGatewayProxyResponse: Struct containing the HTTP status code, body, and headers of the response.
+// - error: Error object detailing any issues encountered during the execution of the function. If the operation is successful, the error is nil.
+//
+// cancelPaymentIntent():
+// 1. Loads the deposit recorded for the payment intent, if any, and checks that it is the caller's.
+// 2. Retrieves the payment from the provider that took the deposit, or the one named in the body, and checks that it
+//    belongs to the caller. Adyen can't look payments up, so an Adyen payment must have a deposit recorded for it.
+// 3. Cancels it with the reason from the body, unless it is canceled already, so the call can be repeated safely.
+// 4. Once the provider reports it canceled, marks the deposit "Canceled" and drops it from the user's pending balance.
+// 5. Returns the payment intent ID, its status, its provider and the status of the deposit.
+//
+// Adyen cancels asynchronously and answers "processing"; its cancellation, like the "payment_intent.canceled" event
+// Stripe sends afterwards, reaches the deposit through the webhook.
+func cancelPaymentIntent(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    intentID := request.PathParameters["id"]
+    if intentID == "" {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Payment intent ID is required"}, nil
+    }
+
+    var body CancelPaymentIntentRequest
+    if request.Body != "" {
+        if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+        }
+    }
+    reason := body.Reason
+    if reason == "" {
+        reason = "abandoned"
+    }
+    if !cancellationReasons[reason] {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Invalid reason " + reason}, nil
+    }
+
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving user from database",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, err
+    }
+
+    // Only the caller's own payments may be canceled
+    providerName := payments.ProviderName(body.Provider)
+    if providerName == "" {
+        providerName = router.Default()
+    }
+    deposit, err := transactions.GetTransaction(ctx, intentID)
+    if err != nil && !errors.Is(err, repository.ErrNotFound) {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving deposit"}, err
+    }
+    if err == nil {
+        if deposit.UserID != userID || deposit.TransactionType != "Deposit" {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: "Payment intent does not belong to this customer"}, nil
+        }
+        providerName = payments.ProviderName(deposit.ProviderName())
+    } else {
+        deposit = nil
+    }
+
+    provider, err := router.Provider(providerName)
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    intent, err := provider.GetIntent(ctx, intentID)
+    switch {
+        case errors.Is(err, payments.ErrNotFound), errors.Is(err, payments.ErrUnsupported) && deposit == nil:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Payment intent not found"}, nil
+        case errors.Is(err, payments.ErrUnsupported):
+            // The deposit recorded for it already showed the payment is the caller's
+        case err != nil:
+            log.Printf("Error retrieving payment %s: %v", intentID, err)
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+        case !ownsIntent(intent, user):
+            return events.APIGatewayProxyResponse{
+                StatusCode: http.StatusForbidden,
+                Body:       "Payment intent does not belong to this customer",
+            }, nil
+    }
+
+    if intent == nil || intent.Status != payments.StatusCanceled {
+        intent, err = provider.CancelIntent(ctx, &payments.CancelParams{IntentID: intentID, Reason: reason})
+        if errors.Is(err, payments.ErrNotFound) {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Payment intent not found"}, nil
+        }
+        if errors.Is(err, payments.ErrUnexpectedState) {
+            // Succeeded, or processing a payment that can't be stopped any more
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusConflict, Body: "Payment can no longer be canceled"}, nil
+        }
+        if err != nil {
+            log.Printf("Error canceling payment %s: %v", intentID, err)
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+        }
+        log.Printf("Requested cancellation of payment %s (%s), now %s", intentID, reason, intent.Status)
+    }
+
+    var transactionStatus string
+    if deposit != nil {
+        transactionStatus = deposit.TransactionStatus
+    }
+    if intent.Status == payments.StatusCanceled {
+        transactionStatus, err = markDepositCanceled(ctx, userID, intentID)
+        if err != nil {
+            // The webhook marks the deposit when "payment_intent.canceled" arrives
+            log.Printf("Error marking deposit %s canceled: %v", intentID, err)
+        }
+    }
+
+    return jsonResponse(http.StatusOK, map[string]string{
+        "payment_intent_id":  intentID,
+        "status":             string(intent.Status),
+        "provider":           string(provider.Name()),
+        "transaction_status": transactionStatus,
+    })
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := cancelPaymentIntent(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(cancelPaymentIntent)
+}
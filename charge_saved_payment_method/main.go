@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// These values should come from the frontend. PaymentMethodID is a payment method that was
+// saved for off_session use by an earlier deposit through createPaymentIntent.
+type ChargeSavedPaymentMethodRequest struct {
+    Amount          int64  `json:"amount"`
+    Currency        string `json:"currency"`
+    PaymentMethodID string `json:"PaymentMethodID"`
+}
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// onSessionFallback moves a payment intent that failed off-session with authentication_required
+// back to an on-session confirmation. Because the intent is created with confirmation_method=manual,
+// confirming it again without off_session leaves it in requires_action. The client completes 3D Secure
+// with stripe.handleCardAction(client_secret) and then calls confirmPayment, which records the deposit.
+func onSessionFallback(ctx context.Context, provider payments.PaymentProvider, paymentIntentID, paymentMethodID string) (events.APIGatewayProxyResponse, error) {
+    intent, err := provider.ConfirmIntent(ctx, &payments.ConfirmParams{IntentID: paymentIntentID, PaymentMethodID: paymentMethodID})
+    if err != nil {
+        log.Printf("Error re-confirming payment intent on session: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    return jsonResponse(http.StatusOK, map[string]string{
+        "payment_intent_id": intent.ID,
+        "client_secret":     intent.ClientSecret,
+        "status":            string(intent.Status),
+    })
+}
+
+// chargeSavedPaymentMethod() performs a one-click deposit by charging a payment method the caller has
+// already saved with Stripe. The payment intent is created and confirmed server-side with off_session=true,
+// so in most cases no further interaction with the user is needed.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest containing the amount, currency and PaymentMethodID in its body.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, response body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+//
+// chargeSavedPaymentMethod():
+// 1. Parses the request body and retrieves the user's Stripe customer ID from the database.
+// 2. Verifies that the payment method is attached to the caller's Stripe customer.
+// 3. Creates and confirms a payment intent off-session.
+// 4. On success, logs the transaction as "Pending" and adds it to the pending balance exactly like confirmPayment does.
+// 5. If the bank requires authentication, falls back to an on-session 3D Secure flow and returns
+//    the client secret so the frontend can finish the payment.
+func chargeSavedPaymentMethod(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+    var body ChargeSavedPaymentMethodRequest
+    if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+    }
+
+    if body.Amount <= 0 || body.Currency == "" || body.PaymentMethodID == "" {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusBadRequest,
+            Body:       "amount, currency and PaymentMethodID are required",
+        }, nil
+    }
+
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving user from database",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, err
+    }
+
+    if user.StripeCustomerID == nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusOK,
+            Body:       "Customer does not have a Stripe customer ID. Are they registered as a customer?",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, nil
+    }
+
+    // Saved payment methods are Stripe's, so the deposit is never routed to another provider
+    provider, err := router.Provider(payments.Stripe)
+    if err != nil {
+        log.Printf("Error opening Stripe: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    // Only payment methods saved on the caller's own customer may be charged
+    pm, err := provider.GetPaymentMethod(ctx, body.PaymentMethodID)
+    if err != nil {
+        log.Printf("Error retrieving payment method: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+    if pm.CustomerID != *user.StripeCustomerID {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusForbidden,
+            Body:       "Payment method is not saved for this customer",
+        }, nil
+    }
+
+    intent, err := provider.CreateIntent(ctx, &payments.IntentParams{
+        UserID:             userID,
+        CustomerID:         *user.StripeCustomerID,
+        Amount:             body.Amount,
+        Currency:           body.Currency,
+        PaymentMethodID:    body.PaymentMethodID,
+        ManualConfirmation: true,
+        Confirm:            true,
+        OffSession:         true,
+    })
+    if err != nil {
+        var intentErr *payments.IntentError
+        if errors.Is(err, payments.ErrAuthenticationRequired) && errors.As(err, &intentErr) {
+            log.Printf("Off-session payment requires authentication, falling back to on-session flow for %s", intentErr.IntentID)
+            return onSessionFallback(ctx, provider, intentErr.IntentID, body.PaymentMethodID)
+        }
+
+        log.Printf("Error creating off-session payment intent: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    switch intent.Status {
+        case payments.StatusSucceeded:
+            deposit := &repository.Transaction{
+                TransactionID:     intent.ID,
+                UserID:            userID,
+                TransactionType:   "Deposit",
+                Amount:            intent.Amount,
+                TransactionStatus: "Pending",
+                TransactionDate:   time.Now().UTC().Format(mysqlDateTimeLayout),
+                Provider:          string(intent.Provider),
+                Currency:          intent.Currency,
+            }
+            // Recorded under the user's lock in one database transaction, unless the webhook got there first
+            err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+                _, err := repository.RecordPendingDeposit(ctx, repository.NewSQLUserRepository(tx, dialect), repository.NewSQLTransactionRepository(tx), deposit)
+                return err
+            })
+            if err != nil {
+                log.Printf("Error recording deposit: %v", err)
+            }
+            return jsonResponse(http.StatusOK, map[string]string{
+                "payment_intent_id": intent.ID,
+                "status":            string(intent.Status),
+            })
+
+        case payments.StatusRequiresAction:
+            return jsonResponse(http.StatusOK, map[string]string{
+                "payment_intent_id": intent.ID,
+                "client_secret":     intent.ClientSecret,
+                "status":            string(intent.Status),
+            })
+
+        default:
+            return events.APIGatewayProxyResponse{
+                StatusCode: 400,
+                Body:       "Unhandled payment intent status \n " + string(intent.Status),
+            }, nil
+    }
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := chargeSavedPaymentMethod(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(chargeSavedPaymentMethod)
+}
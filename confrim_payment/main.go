@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,26 +15,36 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/paymentintent"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
 )
 
-// Struct to keep the secret key and more params if needed
-type AWSParams struct {
-	stripeKey string
-}
-
+// Provider is the provider createPaymentIntent returned with the intent, the default provider if it is empty.
+// Details holds the result of an authentication step on the frontend, such as Adyen's 3D Secure redirectResult.
+// Stripe payments don't need it.
 type ConfirmPaymentRequest struct {
-    PaymentIntentID string `json:"PaymentIntentID"`
+    PaymentIntentID string            `json:"PaymentIntentID"`
+    Provider        string            `json:"provider"`
+    Details         map[string]string `json:"details"`
 }
 
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
 // Globals 
 var db *sql.DB
-var awsParams AWSParams
+var dialect database.Dialect
+var router *payments.Router
 
 // getParameter retrieves a parameter from AWS SSM.
 func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
     sess, err := session.NewSession(&aws.Config{
         Region: aws.String(region),
 		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors 
@@ -57,74 +68,56 @@ func getParameter(region, paramName string) (string, error) {
     return *param.Parameter.Value, nil
 }
 
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
 func initializeDatabase() error {
-    sess, err := session.NewSession(&aws.Config{
-        Region: aws.String("us-west-2"),
-    })
-    if err != nil {
-        log.Printf("Error creating AWS session: %v", err)
-        return err
-    }
-
-    ssmSvc := ssm.New(sess)
-    paramName := "/application/dev/database/credentials"
-    withDecryption := true
-    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
-        Name:           &paramName,
-        WithDecryption: &withDecryption,
-    })
-    if err != nil {
-        log.Printf("Error getting parameter: %v", err)
-        return err
-    }
-
-    var dbCreds struct {
-        Username string `json:"username"`
-        Password string `json:"password"`
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
-    }
-    err = json.Unmarshal([]byte(*param.Parameter.Value), &dbCreds)
-    if err != nil {
-        log.Printf("Error parsing JSON: %v", err)
-        return err
-    }
-
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/user_management", dbCreds.Username, dbCreds.Password, dbCreds.Host, dbCreds.Port)
-    db, err = sql.Open("mysql", dsn)
+    var err error
+    db, dialect, err = database.Open("us-west-2")
     if err != nil {
         log.Printf("Error opening database: %v", err)
         return err
     }
 
-    // Setting up the connection pool
-    db.SetMaxOpenConns(10)
-    db.SetMaxIdleConns(5)
-    db.SetConnMaxLifetime(0) // Connections are recycled forever
-
-    if err = db.Ping(); err != nil {
-        log.Printf("Failed to connect to database: %v", err)
-        return err
-    }
-
-    fmt.Println("Connected to the MySQL database successfully!")
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
     return nil
 }
 
-func insertTransaction(transactionID, userID, transactionType, transactionStatus, transactionDate string, amount float64) error {
-    query := `INSERT INTO TransactionHistory (TransactionID, UserID, TransactionType, Amount, TransactionStatus, TransactionDate) 
-              VALUES (?, ?, ?, ?, ?, ?)`
+// recordPendingDeposit logs the deposit as "Pending", or "Authorized" when it waits for a manual capture, and adds it
+// to the user's pending balance. Both are written in one database transaction under the user's lock, and only if the
+// webhook hasn't recorded the deposit already, so it is never counted twice.
+func recordPendingDeposit(ctx context.Context, intent *payments.Intent, userID string) {
+    deposit := &repository.Transaction{
+        TransactionID:     intent.ID,
+        UserID:            userID,
+        TransactionType:   "Deposit",
+        Amount:            intent.Amount,
+        TransactionStatus: "Pending",
+        TransactionDate:   time.Now().UTC().Format(mysqlDateTimeLayout),
+        Provider:          string(intent.Provider),
+        Wallet:            intent.Wallet,
+        Currency:          intent.Currency,
+    }
+    if intent.Status == payments.StatusRequiresCapture {
+        // Authorised for manual capture; captured or canceled later through the authorizations endpoints
+        deposit.TransactionStatus = "Authorized"
+    }
 
-    _, err := db.Exec(query, transactionID, userID, transactionType, amount, transactionStatus, transactionDate)
+    var recorded bool
+    err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        var err error
+        recorded, err = repository.RecordPendingDeposit(ctx, repository.NewSQLUserRepository(tx, dialect), repository.NewSQLTransactionRepository(tx), deposit)
+        return err
+    })
     if err != nil {
-        return fmt.Errorf("error inserting new transaction: %w", err)
+        log.Printf("Error recording deposit: %v", err)
+        return
+    }
+    if !recorded {
+        log.Printf("Deposit %s is already recorded", intent.ID)
     }
-
-    log.Printf("Inserted new transaction record successfully for user ID %s", userID)
-    return nil
 }
 
-// confirmPayment confirms a Stripe payment intent based on the request.
+// confirmPayment confirms a payment intent with the configured payment provider based on the request.
 // It attempts to confirm the payment intent and handles various outcomes based on the payment intent's status.
 // This function is triggered via an API Gateway event that passes in the request containing
 // the payment intent ID and any necessary parameters.
@@ -138,48 +131,99 @@ func insertTransaction(transactionID, userID, transactionType, transactionStatus
 // - APIGatewayProxyResponse: A struct that encapsulates the HTTP response data, including status codes
 //                            and response bodies tailored to the result of the confirmation process.
 // - error: An error object that is non-nil if an error occurs during the function's execution, such as
-//          failure to parse the request body or errors from the Stripe API.
+//          failure to parse the request body or errors from the payment provider.
 //>
 // Behavior:
 // - The function first parses the incoming JSON request body to extract the PaymentIntentID.
-// - It then attempts to confirm the payment intent using Stripe's API.
-// - Based on the Stripe payment intent status after confirmation attempt, it handles:
-//   - stripe.PaymentIntentStatusRequiresAction: Notifies the client that additional user action is needed (e.g. 3D Secure), but unsure if we'll
+// - It refuses with 403 Forbidden to confirm an intent created for another user, before confirming it where the provider
+//   can look the intent up, and otherwise before recording it.
+// - It then attempts to confirm the payment intent with the provider that created it. Adyen payments are authorised when they are
+//   created, so for Adyen this only completes an authentication step with the details from the frontend.
+// - Based on the payment intent status after confirmation attempt, it handles:
+//   - payments.StatusRequiresAction: Notifies the client that additional user action is needed (e.g. 3D Secure), but unsure if we'll
 //      3D secure, so I'm just leaving that for now.
-//   - stripe.PaymentIntentStatusSucceeded: Logs the transaction as "Pending" in the database and informs the client of a pending status.
-//   - stripe.PaymentIntentStatusRequiresConfirmation: Attempts to re-confirm the payment if the initial attempt was failed.
+//   - payments.StatusSucceeded: Logs the transaction as "Pending" in the database, adds it to the user's pending balance
+//      and informs the client of a pending status.
+//   - payments.StatusProcessing: Same as succeeded, for ACH payments that take days to settle.
+//   - payments.StatusRequiresConfirmation: Attempts to re-confirm the payment if the initial attempt was failed.
 //   - Default: Handles any unanticipated statuses by returning an error message and the status of the payment intent.
 func confirmPayment(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    stripe.Key = awsParams.stripeKey
-
     var body ConfirmPaymentRequest
     if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
         return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
     }
 
-    pi, err := paymentintent.Confirm(body.PaymentIntentID, nil)
+    providerName := payments.ProviderName(body.Provider)
+    if providerName == "" {
+        providerName = router.Default()
+    }
+    provider, err := router.Provider(providerName)
     if err != nil {
         return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
     }
 
+    callerID := request.RequestContext.Identity.CognitoIdentityPoolID
+
+    // Only the user the intent was created for may confirm it. Adyen payments can't be looked up, so they are only
+    // checked against the shopper the confirmation returns below.
+    existing, err := provider.GetIntent(ctx, body.PaymentIntentID)
+    switch {
+        case errors.Is(err, payments.ErrUnsupported):
+        case errors.Is(err, payments.ErrNotFound):
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Payment intent not found"}, nil
+        case err != nil:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+        case existing.UserID != callerID:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: "Payment intent belongs to another user"}, nil
+    }
+
+    pi, err := provider.ConfirmIntent(ctx, &payments.ConfirmParams{IntentID: body.PaymentIntentID, Details: body.Details})
+    if errors.Is(err, payments.ErrUnsupported) {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusBadRequest,
+            Body:       err.Error(),
+        }, nil
+    }
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+    if pi.UserID != callerID {
+        log.Printf("User %s confirmed payment intent %s of user %q", callerID, pi.ID, pi.UserID)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: "Payment intent belongs to another user"}, nil
+    }
+
     switch pi.Status {
-        case stripe.PaymentIntentStatusRequiresAction:
+        case payments.StatusRequiresAction:
             return events.APIGatewayProxyResponse{
                 StatusCode: 200,
                 Body:       "Additional authentication required. Possible issues with 3D secure auth \n " + string(pi.Status),
             }, nil
 
-        case stripe.PaymentIntentStatusSucceeded:
-            currentTime := time.Now()
-            insertTransaction(pi.ID, request.RequestContext.Identity.CognitoIdentityPoolID, "Deposit", "Pending", currentTime.GoString(), float64(pi.Amount))
+        case payments.StatusSucceeded:
+            recordPendingDeposit(ctx, pi, callerID)
+            return events.APIGatewayProxyResponse{
+                StatusCode: 200,
+                Body:       "Payment succeeded and is pending. Funds will be available once payment is confrimed from " + string(pi.Provider) + ".",
+            }, nil
+
+        case payments.StatusRequiresCapture:
+            recordPendingDeposit(ctx, pi, callerID)
             return events.APIGatewayProxyResponse{
                 StatusCode: 200,
-                Body:       "Payment succeeded and is pending. Funds will be available once payment is confrimed from Stripe.",
+                Body:       "Payment is authorized and is pending. Funds will be available once the payment is reviewed and captured.",
             }, nil
 
-        case stripe.PaymentIntentStatusRequiresConfirmation:
+        case payments.StatusProcessing:
+            // ACH debits stay in processing for several days; the webhook holds the funds as pending until they settle
+            recordPendingDeposit(ctx, pi, callerID)
+            return events.APIGatewayProxyResponse{
+                StatusCode: 200,
+                Body:       "Payment is processing. Funds will be pending until the bank transfer settles.",
+            }, nil
+
+        case payments.StatusRequiresConfirmation:
             // Re-confirm the payment intent if needed
-            piAttemptTwo, err := paymentintent.Confirm(pi.ID, nil)
+            piAttemptTwo, err := provider.ConfirmIntent(ctx, &payments.ConfirmParams{IntentID: pi.ID})
             if err != nil {
                 return events.APIGatewayProxyResponse{
                     StatusCode: 500,
@@ -187,12 +231,11 @@ func confirmPayment(ctx context.Context, request events.APIGatewayProxyRequest)
                 }, nil
             }
 
-            if piAttemptTwo.Status == stripe.PaymentIntentStatusSucceeded {
-                currentTime := time.Now()
-                insertTransaction(pi.ID, request.RequestContext.Identity.CognitoIdentityPoolID, "Deposit", "Pending", currentTime.GoString(), float64(piAttemptTwo.Amount))
+            if piAttemptTwo.Status == payments.StatusSucceeded {
+                recordPendingDeposit(ctx, piAttemptTwo, callerID)
                 return events.APIGatewayProxyResponse{
                     StatusCode: 200,
-                    Body:       "Payment succeeded and is pending. Funds will be available once payment is confrimed from Stripe.",
+                    Body:       "Payment succeeded and is pending. Funds will be available once payment is confrimed from " + string(pi.Provider) + ".",
                 }, nil
             } else {
                 return events.APIGatewayProxyResponse{
@@ -211,14 +254,15 @@ func confirmPayment(ctx context.Context, request events.APIGatewayProxyRequest)
 
 func main() {
     region := "us-west-2"
-    paramName := "/application/dev/stripe_key"
 	var err error
 
-    awsParams.stripeKey, err = getParameter(region, paramName)
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
     if err != nil {
-        log.Fatalf("Failed to get parameter: %v", err)
+        log.Fatalf("Failed to configure payment routing: %v", err)
     }
-    log.Printf("Successfully retrieved stripe key!")
+    log.Printf("Successfully configured payment routing!")
 
     if err := initializeDatabase(); err != nil {
         log.Fatalf("Database initialization failed: %v", err)
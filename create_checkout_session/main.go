@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+	"github.com/stripe/stripe-go"
+	checkoutsession "github.com/stripe/stripe-go/checkout/session"
+)
+
+// These values should come from the frontend. Amount is in cents.
+type CheckoutSessionRequest struct {
+    Amount   int64  `json:"amount"`
+    Currency string `json:"currency"`
+}
+
+// Struct to keep the secret key and more params if needed
+type AWSParams struct {
+	stripeKey  string
+	successURL string // Page Checkout redirects to after payment
+	cancelURL  string // Page Checkout redirects to when the user goes back
+}
+
+// Placeholder Checkout replaces with the session ID in the success URL
+const sessionIDPlaceholder = "{CHECKOUT_SESSION_ID}"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var awsParams AWSParams
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// successURL appends the session ID placeholder to the configured success URL, so the page the user lands on can
+// tell which deposit it is for.
+func successURL() string {
+    if strings.Contains(awsParams.successURL, sessionIDPlaceholder) {
+        return awsParams.successURL
+    }
+    separator := "?"
+    if strings.Contains(awsParams.successURL, "?") {
+        separator = "&"
+    }
+    return awsParams.successURL + separator + "session_id=" + sessionIDPlaceholder
+}
+
+// This function creates a Stripe Checkout Session for a deposit, so the frontend can send the user to the page Stripe
+// hosts instead of collecting card details itself.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest from AWS Lambda which includes the user and the deposit amount.
+//
+// Returns:
+// - APIGatewayProxyResponse: Struct containing the HTTP status code, body, and headers of the response.
+// - error: Error object detailing any issues encountered during the execution of the function. If the operation is successful, the error is nil.
+//
+// createCheckoutSession():
+// 1. Parses the request body and retrieves the user's Stripe customer ID from the database.
+// 2. Creates a Checkout Session in payment mode for the amount, linked to the caller's customer. The UserID is set as
+//    the session's client reference and in the metadata of the session and of the payment intent it creates, so the
+//    webhook can credit the right user.
+// 3. Returns the session ID, which the frontend passes to stripe.redirectToCheckout.
+//
+// Nothing is recorded here. The deposit reaches TransactionHistory and the user's balances through the webhook:
+// "checkout.session.completed" records it under the session's payment intent, like a deposit from createPaymentIntent,
+// and "checkout.session.expired" closes it if the user never paid.
+func createCheckoutSession(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    stripe.Key = awsParams.stripeKey
+
+    var body CheckoutSessionRequest
+    if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+    }
+
+    if body.Amount <= 0 || body.Currency == "" {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusBadRequest,
+            Body:       "amount and currency are required",
+        }, nil
+    }
+
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving user from database",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, err
+    }
+
+    if user.StripeCustomerID == nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusOK,
+            Body:       "Customer does not have a Stripe customer ID. Are they registered as a customer?",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, nil
+    }
+
+    params := &stripe.CheckoutSessionParams{
+        Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+        Customer:           stripe.String(*user.StripeCustomerID),
+        ClientReferenceID:  stripe.String(userID),
+        PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+        LineItems: []*stripe.CheckoutSessionLineItemParams{
+            {
+                Name:     stripe.String("Betchya deposit"),
+                Amount:   stripe.Int64(body.Amount),
+                Currency: stripe.String(body.Currency),
+                Quantity: stripe.Int64(1),
+            },
+        },
+        PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{},
+        SuccessURL:        stripe.String(successURL()),
+        CancelURL:         stripe.String(awsParams.cancelURL),
+    }
+    params.Context = ctx
+    params.AddMetadata("UserID", userID)
+    // Keep a record of the user ID on the payment intent too, for its own payment_intent events
+    params.PaymentIntentData.AddMetadata("UserID", userID)
+
+    checkoutSession, err := checkoutsession.New(params)
+    if err != nil {
+        log.Printf("Error creating checkout session: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    }
+
+    return jsonResponse(http.StatusOK, map[string]string{
+        "session_id": checkoutSession.ID,
+    })
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    awsParams.stripeKey, err = getParameter(region, "/application/dev/stripe_key")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    log.Printf("Successfully retrieved stripe key!")
+
+    awsParams.successURL, err = getParameter(region, "/application/dev/checkout_success_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    awsParams.cancelURL, err = getParameter(region, "/application/dev/checkout_cancel_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := createCheckoutSession(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(createCheckoutSession)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,45 +14,25 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
 )
 
-// Struct representing how a User looks in the database
-type User struct {
-    UserID                    string
-    Username                  string
-    Email                     string
-    PhoneNumber               string
-    DateOfBirth               string
-    AccountVerificationStatus string
-    CreatedAt                 string
-    UpdatedAt                 string
-    AccountBalance            string
-    StripeID*                 string // Is null if the user is not a Stripe customer
-}
-
-// Struct to keep the secret key and more params if needed
-type AWSParams struct {
-	stripeKey string
-}
-
 // Globals 
 var db *sql.DB
-var awsParams AWSParams
-
-func findCustomerByStripeID(customerID string) (*stripe.Customer, error) {
-    c, err := customer.Get(customerID, nil)
-    if err != nil {
-        return nil, err
-    }
-    // Return the found customer
-    return c, nil
-}
+var dialect database.Dialect
+var users repository.UserRepository
+var provider payments.PaymentProvider
 
 // getParameter retrieves a parameter from AWS SSM.
 func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
     sess, err := session.NewSession(&aws.Config{
         Region: aws.String(region),
 		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors 
@@ -75,57 +56,17 @@ func getParameter(region, paramName string) (string, error) {
     return *param.Parameter.Value, nil
 }
 
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
 func initializeDatabase() error {
-    sess, err := session.NewSession(&aws.Config{
-        Region: aws.String("us-west-2"),
-    })
-    if err != nil {
-        log.Printf("Error creating AWS session: %v", err)
-        return err
-    }
-
-    ssmSvc := ssm.New(sess)
-    paramName := "/application/dev/database/credentials"
-    withDecryption := true
-    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
-        Name:           &paramName,
-        WithDecryption: &withDecryption,
-    })
-    if err != nil {
-        log.Printf("Error getting parameter: %v", err)
-        return err
-    }
-
-    var dbCreds struct {
-        Username string `json:"username"`
-        Password string `json:"password"`
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
-    }
-    err = json.Unmarshal([]byte(*param.Parameter.Value), &dbCreds)
-    if err != nil {
-        log.Printf("Error parsing JSON: %v", err)
-        return err
-    }
-
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/user_management", dbCreds.Username, dbCreds.Password, dbCreds.Host, dbCreds.Port)
-    db, err = sql.Open("mysql", dsn)
+    var err error
+    db, dialect, err = database.Open("us-west-2")
     if err != nil {
         log.Printf("Error opening database: %v", err)
         return err
     }
 
-    // Setting up the connection pool
-    db.SetMaxOpenConns(10)
-    db.SetMaxIdleConns(5)
-    db.SetConnMaxLifetime(0) // Connections are recycled forever
-
-    if err = db.Ping(); err != nil {
-        log.Printf("Failed to connect to database: %v", err)
-        return err
-    }
-
-    fmt.Println("Connected to the MySQL database successfully!")
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
     return nil
 }
 
@@ -145,22 +86,21 @@ func initializeDatabase() error {
 // createCustomer():
 // 1. Retrieves user details from the database using the Cognito Identity Pool ID provided in the request context.
 // 2. Checks if the user already has a Stripe customer ID and fetches the Stripe customer details if available.
-// 3. If the user is not already a Stripe customer, creates a new Stripe customer record with the user's email and name.
+// 3. If the user is not already a Stripe customer, or the customer was deleted in Stripe, creates a new Stripe customer
+//    record with the user's email and name.
 // 4. Updates the local database with the new Stripe customer ID after successful creation.
 // 5. Returns a response indicating the outcome of the operations, including successful creation or error messages.
 //
+// Only Stripe keeps customer records, so the customer is always created in Stripe, even while deposits are routed
+// to Adyen: any deposit may fail over to Stripe. Adyen identifies the shopper by their UserID.
+//
 // Usage:
 // This function is to be triggered via an API Gateway request. It mantains consistent
 // customer records across both a local database and Stripe; the function ensures that every registered user in the
 // local database is also registered as a customer in Stripe.
 func createCustomer(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    stripe.Key = awsParams.stripeKey
-
     userID := request.RequestContext.Identity.CognitoIdentityPoolID
-    query := "SELECT * FROM Users WHERE UserID = ?"
-    
-    var user User
-    err := db.QueryRow(query, userID).Scan(&user.UserID, &user.Username, &user.Email, &user.PhoneNumber, &user.DateOfBirth, &user.AccountVerificationStatus, &user.CreatedAt, &user.UpdatedAt, &user.AccountBalance, &user.StripeID)
+    user, err := users.GetUser(ctx, userID)
     if err != nil {
         return events.APIGatewayProxyResponse{
             StatusCode: http.StatusInternalServerError,
@@ -169,9 +109,9 @@ func createCustomer(ctx context.Context, request events.APIGatewayProxyRequest)
         }, err
     }
 
-    if user.StripeID != nil {
-        customer, err := findCustomerByStripeID(*user.StripeID)
-        if err != nil {
+    if user.StripeCustomerID != nil {
+        customer, err := provider.GetCustomer(ctx, *user.StripeCustomerID)
+        if err != nil && !errors.Is(err, payments.ErrNotFound) {
             return events.APIGatewayProxyResponse{
                 StatusCode: http.StatusInternalServerError,
                 Body:       fmt.Sprintf("Error finding customer by Stripe ID: %s", err),
@@ -187,15 +127,11 @@ func createCustomer(ctx context.Context, request events.APIGatewayProxyRequest)
         }
     }
 
-    params := &stripe.CustomerParams{
-        Email: stripe.String(user.Email),
-        Name:  stripe.String(user.Username),
-    }
-
-    // Customer parameter in Stripe to keep a record of User IDs from the database
-    params.AddMetadata("UserID", userID)
-
-    c, err := customer.New(params)
+    c, err := provider.CreateCustomer(ctx, &payments.CustomerParams{
+        UserID: userID,
+        Email:  user.Email,
+        Name:   user.Username,
+    })
     if err != nil {
         return events.APIGatewayProxyResponse{
             StatusCode: http.StatusInternalServerError,
@@ -205,9 +141,7 @@ func createCustomer(ctx context.Context, request events.APIGatewayProxyRequest)
     }
 
     // Add the stripe customer ID to the database
-    updateQuery := "UPDATE Users SET stripe_customer_id = ? WHERE UserID = ?"
-    _, err = db.Exec(updateQuery, c.ID, userID)
-    if err != nil {
+    if err := users.SetStripeCustomerID(ctx, userID, c.ID); err != nil {
         return events.APIGatewayProxyResponse{
             StatusCode: http.StatusInternalServerError,
             Body:       "Error updating user with new Stripe ID",
@@ -224,18 +158,20 @@ func createCustomer(ctx context.Context, request events.APIGatewayProxyRequest)
 
 func main() {
     region := "us-west-2"
-    paramName := "/application/dev/stripe_key"
 	var err error
 
-    awsParams.stripeKey, err = getParameter(region, paramName)
+    provider, err = payments.New(payments.Stripe, func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
     if err != nil {
-        log.Fatalf("Failed to get parameter: %v", err)
+        log.Fatalf("Failed to configure Stripe: %v", err)
     }
     log.Printf("Successfully retrieved stripe key!")
 
     if err := initializeDatabase(); err != nil {
         log.Fatalf("Database initialization failed: %v", err)
     }
+    users = repository.NewSQLUserRepository(db, dialect)
 	// lambda.Start(createCustomer)
 
 	file, err := os.ReadFile("event.json")
@@ -9,49 +9,52 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/stripe/stripe-go"
-	"github.com/stripe/stripe-go/paymentintent"
-	"github.com/stripe/stripe-go/paymentmethod"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
 )
 
-// Struct representing how a User looks in the database
-type User struct {
-    UserID                    string
-    Username                  string
-    Email                     string
-    PhoneNumber               string
-    DateOfBirth               string
-    AccountVerificationStatus string
-    CreatedAt                 string
-    UpdatedAt                 string
-    AccountBalance            string
-    StripeID*                 string // Is null if the user is not a Stripe customer
-}
-
-// These values should come from the frontend
+// These values should come from the frontend. PaymentMethodType defaults to "card". For "us_bank_account" no
+// PaymentMethodID is sent; the bank account is collected afterwards on the frontend. For "apple_pay" and
+// "google_pay" the PaymentMethodID is what the wallet returned: a Stripe payment method, or an Adyen wallet token.
+// AutomaticPaymentMethods lets the payment method, wallets included, be picked on the frontend instead.
+// CaptureMethod "manual" only authorises the deposit, for it to be captured after the fraud checks pass.
+// Provider names the provider whose UI collected the PaymentMethodID, and CardBIN is the first digits of the card
+// if the frontend knows them.
 type PaymentIntentRequest struct {
-    Amount         int64   `json:"amount"`
-    Currency       string  `json:"currency"`
-    PaymentMethodID string `json:"PaymentMethodID"`
+    Amount                  int64  `json:"amount"`
+    Currency                string `json:"currency"`
+    PaymentMethodID         string `json:"PaymentMethodID"`
+    PaymentMethodType       string `json:"payment_method_type"`
+    AutomaticPaymentMethods bool   `json:"automatic_payment_methods"`
+    CaptureMethod           string `json:"capture_method"`
+    Provider                string `json:"provider"`
+    CardBIN                 string `json:"card_bin"`
 }
 
-// Struct for secret params from AWS Parameter Store
-type AWSParams struct {
-	stripeKey string
-}
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
 
 // Globals 
 var db *sql.DB
-var awsParams AWSParams
+var dialect database.Dialect
+var users repository.UserRepository
+var router *payments.Router
 
 // getParameter retrieves a parameter from AWS SSM.
 func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
     sess, err := session.NewSession(&aws.Config{
         Region: aws.String(region),
 		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors 
@@ -75,64 +78,69 @@ func getParameter(region, paramName string) (string, error) {
     return *param.Parameter.Value, nil
 }
 
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
 func initializeDatabase() error {
-    sess, err := session.NewSession(&aws.Config{
-        Region: aws.String("us-west-2"),
-    })
+    var err error
+    db, dialect, err = database.Open("us-west-2")
     if err != nil {
-        log.Printf("Error creating AWS session: %v", err)
+        log.Printf("Error opening database: %v", err)
         return err
     }
 
-    ssmSvc := ssm.New(sess)
-    paramName := "/application/dev/database/credentials"
-    withDecryption := true
-    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
-        Name:           &paramName,
-        WithDecryption: &withDecryption,
-    })
-    if err != nil {
-        log.Printf("Error getting parameter: %v", err)
-        return err
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// header returns a request header, whichever case API Gateway passed its name in.
+func header(headers map[string]string, name string) string {
+    for key, value := range headers {
+        if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(name) {
+            return value
+        }
     }
+    return ""
+}
 
-    var dbCreds struct {
-        Username string `json:"username"`
-        Password string `json:"password"`
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
+// recordPendingDeposit logs the deposit as "Pending", or "Authorized" when it waits for a manual capture, and adds it
+// to the user's pending balance, as confirmPayment does. It is needed for providers such as Adyen that authorise a
+// payment when it is created.
+func recordPendingDeposit(ctx context.Context, intent *payments.Intent, userID string) {
+    deposit := &repository.Transaction{
+        TransactionID:     intent.ID,
+        UserID:            userID,
+        TransactionType:   "Deposit",
+        Amount:            intent.Amount,
+        TransactionStatus: "Pending",
+        TransactionDate:   time.Now().UTC().Format(mysqlDateTimeLayout),
+        Provider:          string(intent.Provider),
+        Wallet:            intent.Wallet,
+        Currency:          intent.Currency,
     }
-    err = json.Unmarshal([]byte(*param.Parameter.Value), &dbCreds)
-    if err != nil {
-        log.Printf("Error parsing JSON: %v", err)
-        return err
+    if intent.Status == payments.StatusRequiresCapture {
+        // Authorised for manual capture; captured or canceled later through the authorizations endpoints
+        deposit.TransactionStatus = "Authorized"
     }
 
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/user_management", dbCreds.Username, dbCreds.Password, dbCreds.Host, dbCreds.Port)
-    db, err = sql.Open("mysql", dsn)
-    if err != nil {
-        log.Printf("Error opening database: %v", err)
+    var recorded bool
+    err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        var err error
+        recorded, err = repository.RecordPendingDeposit(ctx, repository.NewSQLUserRepository(tx, dialect), repository.NewSQLTransactionRepository(tx), deposit)
         return err
+    })
+    if err != nil {
+        log.Printf("Error recording deposit: %v", err)
+        return
     }
-
-    // Setting up the connection pool
-    db.SetMaxOpenConns(10)
-    db.SetMaxIdleConns(5)
-    db.SetConnMaxLifetime(0) // Connections are recycled forever
-
-    if err = db.Ping(); err != nil {
-        log.Printf("Failed to connect to database: %v", err)
-        return err
+    if !recorded {
+        log.Printf("Deposit %s is already recorded", intent.ID)
     }
-
-    fmt.Println("Connected to the MySQL database successfully!")
-    return nil
 }
 
-// This function extracts payment details from the incoming APIGatewayProxyRequest, which should include a PaymentMethodID recieved from Stripe,
-// retrieves the user's Stripe customer ID from the database,
-// and uses this information to initiate a payment process using Stripe's API. It handles errors throughout the process,
-// such as JSON parsing errors, database retrieval errors, and failures in creating the payment intent with Stripe.
+// This function extracts payment details from the incoming APIGatewayProxyRequest, which should include a PaymentMethodID
+// from the frontend, retrieves the user's customer ID from the database, and uses this information to initiate a payment
+// with the payment provider (Stripe or Adyen) the routing rules pick for the deposit. It handles errors throughout the
+// process, such as JSON parsing errors, database retrieval errors, and failures in creating the payment with the provider.
 //
 // Parameters:
 // - ctx: Context for managing request deadlines and cancellation signals.
@@ -145,27 +153,43 @@ func initializeDatabase() error {
 // createPaymentIntent():
 // 1. Parses the request body to extract payment details.
 // 2. Queries the database for the user's details using their Cognito Identity Pool ID from the request context.
-// 3. Validates that the user has a Stripe customer ID.
-// 4. Creates a payment intent with Stripe using the user's payment details and customer ID.
-// 5. Returns a success response with the payment intent ID or an error message detailing any issues encountered.
+// 3. Routes the deposit by its currency, amount, the user's country (from CloudFront) and card BIN, and validates that
+//    the user has a Stripe customer ID if Stripe is picked. Adyen identifies the user by their UserID.
+// 4. Creates the payment with the provider, saving the payment method for future use. If the provider is down or
+//    reports a processor error, the deposit fails over to the next provider of its route. A deposit with a
+//    PaymentMethodID stays with the provider that collected it.
+// 5. Returns a success response with the payment intent ID, its status and the provider, or an error message detailing
+//    any issues encountered.
+//
+// Without a PaymentMethodID the payment method is collected on the frontend, and the client secret is returned with
+// the ID. With automatic_payment_methods the frontend offers every payment method enabled for the account, Apple Pay
+// and Google Pay included; otherwise it collects the payment_method_type asked for. For ACH deposits
+// (payment_method_type "us_bank_account") Stripe collects and verifies the bank account through Financial
+// Connections, and Adyen's client secret is the sessionData of its Drop-in. ACH payments then sit in "processing" for
+// several days; the webhook holds the amount as pending until the provider reports success or failure.
+//
+// Wallet deposits are card payments. The wallet is recorded on the transaction when it is known: here and in
+// confirmPayment for an explicit "apple_pay" or "google_pay", and by the webhook from the charge otherwise.
+//
+// Stripe payments are confirmed by confirmPayment. Adyen authorises a payment when it is created, so a payment that
+// already succeeded or is processing is recorded as a pending deposit here.
+//
+// With capture_method "manual" the payment is only authorised. The deposit is recorded as "Authorized" and held as
+// pending until the authorizations endpoints capture or cancel it; cancelExpiringAuthorizations cancels it before
+// the authorisation expires if nobody does.
 //
 // Usage:
 // This function is intended to be triggered via AWS API Gateway as part of a serverless architecture,
 // used for secure payment processing. 
 func createPaymentIntent(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    stripe.Key = awsParams.stripeKey
-
     var paymentIntent PaymentIntentRequest
     if err := json.Unmarshal([]byte(request.Body), &paymentIntent); err != nil {
         return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
     }
 
     userID := request.RequestContext.Identity.CognitoIdentityPoolID
-    query := "SELECT * FROM Users WHERE UserID = ?"
-    
-    // Get the stripe customer ID from the DB 
-    var user User
-    err := db.QueryRow(query, userID).Scan(&user.UserID, &user.Username, &user.Email, &user.PhoneNumber, &user.DateOfBirth, &user.AccountVerificationStatus, &user.CreatedAt, &user.UpdatedAt, &user.AccountBalance, &user.StripeID)
+    // Get the stripe customer ID from the DB
+    user, err := users.GetUser(ctx, userID)
     if err != nil {
         return events.APIGatewayProxyResponse{
             StatusCode: http.StatusInternalServerError,
@@ -174,8 +198,23 @@ func createPaymentIntent(ctx context.Context, request events.APIGatewayProxyRequ
         }, err
     }
 
+    deposit := payments.Deposit{
+        Currency: paymentIntent.Currency,
+        Amount:   paymentIntent.Amount,
+        Region:   header(request.Headers, "CloudFront-Viewer-Country"),
+        CardBIN:  paymentIntent.CardBIN,
+        Provider: payments.ProviderName(paymentIntent.Provider),
+    }
+    if paymentIntent.PaymentMethodID != "" && deposit.Provider == "" {
+        // Payment methods sent without a provider were collected by the default one
+        deposit.Provider = router.Default()
+    }
+
     // The user should have a stripe cutsomer ID in the database
-    if user.StripeID == nil {                               
+    var customerID string
+    if user.StripeCustomerID != nil {
+        customerID = *user.StripeCustomerID
+    } else if router.Route(deposit)[0] == payments.Stripe {
         return events.APIGatewayProxyResponse{
             StatusCode: http.StatusOK,
             Body:       "Customer does not have a Stripe customer ID. Are they registered as a customer?",
@@ -183,34 +222,35 @@ func createPaymentIntent(ctx context.Context, request events.APIGatewayProxyRequ
         }, nil
     }
 
-    // Attach the PaymentMethod to the Customer if not already attached
-    _, err = paymentmethod.Attach(
-        paymentIntent.PaymentMethodID,
-        &stripe.PaymentMethodAttachParams{
-            Customer: stripe.String(*user.StripeID),
-        },
-    )
-    
+    intent, err := router.CreateIntent(ctx, deposit, &payments.IntentParams{
+        UserID:                  userID,
+        CustomerID:              customerID,
+        Amount:                  paymentIntent.Amount,
+        Currency:                paymentIntent.Currency,
+        PaymentMethodID:         paymentIntent.PaymentMethodID,
+        PaymentMethodType:       paymentIntent.PaymentMethodType,
+        SaveForFutureUse:        true,
+        AutomaticPaymentMethods: paymentIntent.AutomaticPaymentMethods,
+        ManualCapture:           paymentIntent.CaptureMethod == "manual",
+    })
     if err != nil {
-        log.Printf("Error attaching payment method: %v", err)
+        log.Printf("Error creating payment intent: %v", err)
         return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
     }
 
-    params := &stripe.PaymentIntentParams{
-        Amount:   stripe.Int64(paymentIntent.Amount),
-        Currency: stripe.String(paymentIntent.Currency),
-        Customer: stripe.String(*user.StripeID),
-        PaymentMethod: stripe.String(paymentIntent.PaymentMethodID),
-        SetupFutureUsage: stripe.String("off_session"),
+    if intent.Status == payments.StatusSucceeded || intent.Status == payments.StatusProcessing || intent.Status == payments.StatusRequiresCapture {
+        recordPendingDeposit(ctx, intent, userID)
     }
 
-    pi, err := paymentintent.New(params)
-    if err != nil {
-        log.Printf("Error creating payment intent: %v", err)
-        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+    body := map[string]string{
+        "payment_intent_id": intent.ID,
+        "status":            string(intent.Status),
+        "provider":          string(intent.Provider),
     }
-
-    response, err := json.Marshal(map[string]string{"payment_intent_id": pi.ID})
+    if intent.ClientSecret != "" {
+        body["client_secret"] = intent.ClientSecret
+    }
+    response, err := json.Marshal(body)
 
     if err != nil {
         log.Printf("Error marshaling response: %v", err)
@@ -225,18 +265,20 @@ func createPaymentIntent(ctx context.Context, request events.APIGatewayProxyRequ
 
 func main() {
     region := "us-west-2"
-    paramName := "/application/dev/stripe_key"
 	var err error
 
-    awsParams.stripeKey, err = getParameter(region, paramName)
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
     if err != nil {
-        log.Fatalf("Failed to get parameter: %v", err)
+        log.Fatalf("Failed to configure payment routing: %v", err)
     }
-    log.Printf("Successfully retrieved stripe key!")
+    log.Printf("Successfully configured payment routing!")
 
     if err := initializeDatabase(); err != nil {
         log.Fatalf("Database initialization failed: %v", err)
     }
+    users = repository.NewSQLUserRepository(db, dialect)
 
 	file, err := os.ReadFile("event.json")
     if err != nil {
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// DepositSchedule is a row of the DepositSchedules table. Amount is in minor units (cents).
+type DepositSchedule struct {
+    ScheduleID      int64  `json:"ScheduleID"`
+    Amount          int64  `json:"amount"`
+    Currency        string `json:"currency"`
+    PaymentMethodID string `json:"PaymentMethodID"`
+    Frequency       string `json:"frequency"`  // "weekly" or "monthly"
+    NextRunAt       string `json:"next_run_at"`
+    Status          string `json:"status"`     // "Active", "Paused" or "Suspended"
+    FailureCount    int    `json:"failure_count"`
+}
+
+// These values should come from the frontend. StartAt is optional and defaults to now.
+type DepositScheduleRequest struct {
+    Amount          int64  `json:"amount"`
+    Currency        string `json:"currency"`
+    PaymentMethodID string `json:"PaymentMethodID"`
+    Frequency       string `json:"frequency"`
+    StartAt         string `json:"start_at"` // RFC 3339
+    Status          string `json:"status"`   // Only "Active" or "Paused" can be set by the user
+}
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var router *payments.Router
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+const scheduleColumns = `ScheduleID, Amount, Currency, PaymentMethodID, Frequency, NextRunAt, Status, FailureCount`
+
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*DepositSchedule, error) {
+    var s DepositSchedule
+    if err := row.Scan(&s.ScheduleID, &s.Amount, &s.Currency, &s.PaymentMethodID, &s.Frequency, &s.NextRunAt, &s.Status, &s.FailureCount); err != nil {
+        return nil, err
+    }
+    return &s, nil
+}
+
+func listSchedules(userID string) ([]*DepositSchedule, error) {
+    query := `SELECT ` + scheduleColumns + ` FROM DepositSchedules WHERE UserID = ? ORDER BY ScheduleID`
+    rows, err := db.Query(query, userID)
+    if err != nil {
+        return nil, fmt.Errorf("listSchedules: %v", err)
+    }
+    defer rows.Close()
+
+    schedules := []*DepositSchedule{}
+    for rows.Next() {
+        s, err := scanSchedule(rows)
+        if err != nil {
+            return nil, fmt.Errorf("listSchedules: %v", err)
+        }
+        schedules = append(schedules, s)
+    }
+    return schedules, rows.Err()
+}
+
+// getSchedule only returns schedules owned by userID, so one user can never read or change another's schedule.
+func getSchedule(userID string, scheduleID int64) (*DepositSchedule, error) {
+    query := `SELECT ` + scheduleColumns + ` FROM DepositSchedules WHERE ScheduleID = ? AND UserID = ?`
+    return scanSchedule(db.QueryRow(query, scheduleID, userID))
+}
+
+// validateScheduleRequest checks the request and that the payment method is saved on the user's Stripe customer.
+func validateScheduleRequest(ctx context.Context, userID string, body DepositScheduleRequest) error {
+    if body.Amount <= 0 || body.Currency == "" || body.PaymentMethodID == "" {
+        return errors.New("amount, currency and PaymentMethodID are required")
+    }
+    if body.Frequency != "weekly" && body.Frequency != "monthly" {
+        return errors.New("frequency must be weekly or monthly")
+    }
+    if body.Status != "" && body.Status != "Active" && body.Status != "Paused" {
+        return errors.New("status must be Active or Paused")
+    }
+
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return fmt.Errorf("error retrieving user from database: %v", err)
+    }
+    if user.StripeCustomerID == nil {
+        return errors.New("customer does not have a Stripe customer ID")
+    }
+
+    provider, err := router.Provider(payments.Stripe)
+    if err != nil {
+        return fmt.Errorf("error opening Stripe: %v", err)
+    }
+    pm, err := provider.GetPaymentMethod(ctx, body.PaymentMethodID)
+    if err != nil {
+        return fmt.Errorf("error retrieving payment method: %v", err)
+    }
+    if pm.CustomerID != *user.StripeCustomerID {
+        return errors.New("payment method is not saved for this customer")
+    }
+    return nil
+}
+
+// depositSchedules() provides CRUD for a user's recurring deposits, stored in the DepositSchedules table and run
+// by runDepositSchedules. The HTTP method selects the operation and the optional {id} path parameter a single schedule:
+// - GET /schedules lists the caller's schedules, GET /schedules/{id} returns one.
+// - POST /schedules creates a schedule that first runs at start_at (or now).
+// - PUT /schedules/{id} changes the amount, payment method, frequency or status. Setting status to "Active"
+//   also resumes a schedule that was suspended after repeated failures.
+// - DELETE /schedules/{id} removes the schedule.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest; POST and PUT bodies hold a DepositScheduleRequest.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, response body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+func depositSchedules(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+
+    var scheduleID int64
+    if id, ok := request.PathParameters["id"]; ok {
+        var err error
+        scheduleID, err = strconv.ParseInt(id, 10, 64)
+        if err != nil {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Invalid schedule ID"}, nil
+        }
+    }
+
+    if scheduleID == 0 && request.HTTPMethod != http.MethodGet && request.HTTPMethod != http.MethodPost {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Schedule ID is required"}, nil
+    }
+
+    switch request.HTTPMethod {
+        case http.MethodGet:
+            if scheduleID == 0 {
+                schedules, err := listSchedules(userID)
+                if err != nil {
+                    return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving schedules"}, err
+                }
+                return jsonResponse(http.StatusOK, schedules)
+            }
+
+            schedule, err := getSchedule(userID, scheduleID)
+            if err == sql.ErrNoRows {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Schedule not found"}, nil
+            }
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving schedule"}, err
+            }
+            return jsonResponse(http.StatusOK, schedule)
+
+        case http.MethodPost:
+            var body DepositScheduleRequest
+            if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+            }
+            if err := validateScheduleRequest(ctx, userID, body); err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+            }
+
+            startAt := time.Now().UTC()
+            if body.StartAt != "" {
+                parsed, err := time.Parse(time.RFC3339, body.StartAt)
+                if err != nil {
+                    return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "start_at must be an RFC 3339 timestamp"}, nil
+                }
+                startAt = parsed.UTC()
+            }
+            status := body.Status
+            if status == "" {
+                status = "Active"
+            }
+
+            query := `INSERT INTO DepositSchedules (UserID, Amount, Currency, PaymentMethodID, Frequency, NextRunAt, Status, FailureCount, CreatedAt)
+                      VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)`
+            id, err := dialect.InsertID(ctx, db, query, "ScheduleID", userID, body.Amount, body.Currency, body.PaymentMethodID, body.Frequency,
+                startAt.Format(mysqlDateTimeLayout), status, time.Now().UTC().Format(mysqlDateTimeLayout))
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error creating schedule"}, err
+            }
+
+            schedule, err := getSchedule(userID, id)
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving schedule"}, err
+            }
+            return jsonResponse(http.StatusCreated, schedule)
+
+        case http.MethodPut:
+            var body DepositScheduleRequest
+            if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, err
+            }
+            if err := validateScheduleRequest(ctx, userID, body); err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+            }
+            status := body.Status
+            if status == "" {
+                status = "Active"
+            }
+
+            // Re-activating a schedule clears the failures and pending retry that suspended it
+            query := `UPDATE DepositSchedules SET Amount = ?, Currency = ?, PaymentMethodID = ?, Frequency = ?, Status = ?,
+                      FailureCount = IF(? = 'Active', 0, FailureCount), RetryAt = IF(? = 'Active', NULL, RetryAt)
+                      WHERE ScheduleID = ? AND UserID = ?`
+            result, err := db.Exec(query, body.Amount, body.Currency, body.PaymentMethodID, body.Frequency, status, status, status, scheduleID, userID)
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error updating schedule"}, err
+            }
+            if rows, _ := result.RowsAffected(); rows == 0 {
+                if _, err := getSchedule(userID, scheduleID); err == sql.ErrNoRows {
+                    return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Schedule not found"}, nil
+                }
+            }
+
+            schedule, err := getSchedule(userID, scheduleID)
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving schedule"}, err
+            }
+            return jsonResponse(http.StatusOK, schedule)
+
+        case http.MethodDelete:
+            result, err := db.Exec(`DELETE FROM DepositSchedules WHERE ScheduleID = ? AND UserID = ?`, scheduleID, userID)
+            if err != nil {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error deleting schedule"}, err
+            }
+            if rows, _ := result.RowsAffected(); rows == 0 {
+                return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "Schedule not found"}, nil
+            }
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "Schedule deleted"}, nil
+
+        default:
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusMethodNotAllowed}, nil
+    }
+}
+
+func main() {
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := depositSchedules(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(depositSchedules)
+}
@@ -40,4 +40,35 @@ document.addEventListener("DOMContentLoaded", function () {
         }
       });
   });
+
+  // Deposits through Stripe Checkout: the card is entered on the page Stripe hosts
+  var checkoutURL = "https://your-api-id.execute-api.us-west-2.amazonaws.com/dev/checkout-sessions"; // Replace with the createCheckoutSession endpoint
+  var checkoutForm = document.getElementById("checkout-form");
+  checkoutForm.addEventListener("submit", function (event) {
+    event.preventDefault();
+
+    var amount = Math.round(
+      parseFloat(document.getElementById("checkout-amount").value) * 100
+    );
+    fetch(checkoutURL, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ amount: amount, currency: "usd" }),
+    })
+      .then(function (response) {
+        return response.json();
+      })
+      .then(function (session) {
+        return stripe.redirectToCheckout({ sessionId: session.session_id });
+      })
+      .then(function (result) {
+        if (result && result.error) {
+          document.getElementById("payment-result").textContent =
+            result.error.message;
+        }
+      })
+      .catch(function (error) {
+        document.getElementById("payment-result").textContent = error.message;
+      });
+  });
 });
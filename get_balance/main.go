@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// BalanceResponse is returned by getBalance. All amounts are in minor units (cents).
+type BalanceResponse struct {
+    Currency     string `json:"currency"`
+    Available    int64  `json:"available"`    // Spendable now
+    Pending      int64  `json:"pending"`      // Deposits confirmed but not yet settled
+    Held         int64  `json:"held"`         // Reserved for open bets and disputes
+    Withdrawable int64  `json:"withdrawable"` // Part of the available balance that can be withdrawn
+}
+
+// All balances are kept in a single currency for now
+const balanceCurrency = "usd"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+func getUserBalances(ctx context.Context, userID string) (*BalanceResponse, error) {
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return nil, err
+    }
+
+    balances := &BalanceResponse{
+        Currency:     balanceCurrency,
+        Available:    user.AccountBalance,
+        Pending:      user.PendingBalance,
+        Held:         user.HeldBalance,
+        Withdrawable: user.WithdrawableBalance,
+    }
+    // Withdrawable funds are a subset of what is available right now
+    if balances.Withdrawable > balances.Available {
+        balances.Withdrawable = balances.Available
+    }
+    if balances.Withdrawable < 0 {
+        balances.Withdrawable = 0
+    }
+    return balances, nil
+}
+
+// getBalance() returns the caller's balances, resolved from their Cognito identity:
+// - available: AccountBalance, credited by the webhook once a deposit settles and by bet payouts.
+// - pending: deposits confirmed by confirmPayment (or processing ACH payments) that the webhook hasn't settled yet.
+// - held: bet stakes reserved by settleBet and amounts under an open dispute.
+// - withdrawable: bet winnings that can be withdrawn, never more than the available balance.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest for GET /balance.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, a BalanceResponse body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+func getBalance(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+
+    balances, err := getUserBalances(ctx, userID)
+    if errors.Is(err, repository.ErrNotFound) {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "User not found"}, nil
+    }
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving user from database",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, err
+    }
+
+    return jsonResponse(http.StatusOK, balances)
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := getBalance(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(getBalance)
+}
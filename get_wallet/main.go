@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// WalletSummary is returned by getWallet. All amounts are in minor units (cents).
+type WalletSummary struct {
+    Currency             string         `json:"currency"`
+    Available            int64          `json:"available"`              // Spendable now
+    Pending              int64          `json:"pending"`                // Deposits confirmed but not yet settled
+    Withdrawable         int64          `json:"withdrawable"`           // Part of the available balance that can be withdrawn
+    DepositLimitHeadroom *int64         `json:"deposit_limit_headroom"` // How much more can be deposited, null if the user has no deposit limits
+    RecentTransactions   []*Transaction `json:"recent_transactions"`
+}
+
+// Transaction is a row of the TransactionHistory table as shown to the user
+type Transaction struct {
+    TransactionID     string `json:"transaction_id"`
+    TransactionType   string `json:"type"`
+    Amount            int64  `json:"amount"`
+    TransactionStatus string `json:"status"`
+    TransactionDate   string `json:"date"`
+}
+
+// All balances are kept in a single currency for now
+const balanceCurrency = "usd"
+
+// Number of transactions included in the wallet summary
+const recentTransactionsLimit = 10
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var transactions repository.TransactionRepository
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// getWalletBalances fills in the balances of a WalletSummary from the user's row.
+func getWalletBalances(ctx context.Context, userID string, summary *WalletSummary) error {
+    user, err := users.GetUser(ctx, userID)
+    if err != nil {
+        return err
+    }
+
+    summary.Currency = balanceCurrency
+    summary.Available = user.AccountBalance
+    summary.Pending = user.PendingBalance
+    summary.Withdrawable = user.WithdrawableBalance
+    // Withdrawable funds are a subset of what is available right now
+    if summary.Withdrawable > summary.Available {
+        summary.Withdrawable = summary.Available
+    }
+    if summary.Withdrawable < 0 {
+        summary.Withdrawable = 0
+    }
+    return nil
+}
+
+// depositLimitHeadroom returns how much more the user may deposit, in minor units, before hitting the tightest
+// of their daily and monthly deposit limits. ok is false when the user has no deposit limits configured. Deposits
+// still in flight count against the limits, as they may yet complete.
+func depositLimitHeadroom(ctx context.Context, userID string, now time.Time) (headroom int64, ok bool, err error) {
+    query := `SELECT DailyLimit, MonthlyLimit FROM DepositLimits WHERE UserID = ?`
+
+    var daily, monthly sql.NullInt64
+    err = db.QueryRow(query, userID).Scan(&daily, &monthly)
+    if err == sql.ErrNoRows {
+        return 0, false, nil
+    }
+    if err != nil {
+        return 0, false, fmt.Errorf("depositLimitHeadroom: %v", err)
+    }
+
+    headroom = math.MaxInt64
+    if daily.Valid {
+        deposited, err := repository.DepositedSince(ctx, transactions, userID, now.Add(-24*time.Hour).Format(mysqlDateTimeLayout))
+        if err != nil {
+            return 0, false, err
+        }
+        headroom = daily.Int64 - deposited
+    }
+    if monthly.Valid {
+        deposited, err := repository.DepositedSince(ctx, transactions, userID, now.AddDate(0, -1, 0).Format(mysqlDateTimeLayout))
+        if err != nil {
+            return 0, false, err
+        }
+        if remaining := monthly.Int64 - deposited; remaining < headroom {
+            headroom = remaining
+        }
+    }
+    if headroom < 0 {
+        headroom = 0
+    }
+    return headroom, daily.Valid || monthly.Valid, nil
+}
+
+func getRecentTransactions(ctx context.Context, userID string) ([]*Transaction, error) {
+    rows, err := transactions.ListTransactions(ctx, userID, recentTransactionsLimit)
+    if err != nil {
+        return nil, err
+    }
+
+    recent := []*Transaction{}
+    for _, row := range rows {
+        recent = append(recent, &Transaction{
+            TransactionID:     row.TransactionID,
+            TransactionType:   row.TransactionType,
+            Amount:            row.Amount,
+            TransactionStatus: row.TransactionStatus,
+            TransactionDate:   row.TransactionDate,
+        })
+    }
+    return recent, nil
+}
+
+// getWallet() returns a summary of the caller's wallet for the frontend, resolving the user from their Cognito identity.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest for GET /wallet.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, a WalletSummary body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+//
+// getWallet():
+// 1. Reads the available, pending and withdrawable balances from Users.
+// 2. Works out how much more the user may deposit under their daily and monthly deposit limits.
+// 3. Reads the most recent TransactionHistory rows for the user.
+func getWallet(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+
+    var summary WalletSummary
+    err := getWalletBalances(ctx, userID, &summary)
+    if errors.Is(err, repository.ErrNotFound) {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Body: "User not found"}, nil
+    }
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving user from database",
+            Headers:    map[string]string{"Content-Type": "application/json"},
+        }, err
+    }
+
+    headroom, limited, err := depositLimitHeadroom(ctx, userID, time.Now().UTC())
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving deposit limits",
+        }, err
+    }
+    if limited {
+        summary.DepositLimitHeadroom = &headroom
+    }
+
+    summary.RecentTransactions, err = getRecentTransactions(ctx, userID)
+    if err != nil {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusInternalServerError,
+            Body:       "Error retrieving transactions",
+        }, err
+    }
+
+    return jsonResponse(http.StatusOK, summary)
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := getWallet(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(getWallet)
+}
@@ -0,0 +1,37 @@
+// Package config tells the Lambdas which stage they run in. The "local" stage runs a function on a developer's
+// machine without AWS: parameters come from the environment and the database is a SQLite file.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Local is the stage of functions run on a developer's machine.
+const Local = "local"
+
+// Stage returns the stage set in the STAGE environment variable, "dev" if it is unset.
+func Stage() string {
+	if stage := os.Getenv("STAGE"); stage != "" {
+		return stage
+	}
+	return "dev"
+}
+
+// IsLocal reports whether the functions run in the local stage.
+func IsLocal() bool {
+	return Stage() == Local
+}
+
+// LocalParameter returns the value of an SSM parameter from the environment, where it is named after the last
+// element of the parameter name: /application/dev/stripe_key is read from STRIPE_KEY.
+func LocalParameter(paramName string) (string, error) {
+	name := strings.ToUpper(path.Base(paramName))
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("parameter %s is not set, export %s to run locally", paramName, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,183 @@
+// Package database opens the user_management database of the stage the Lambdas run in: MySQL or Postgres, with
+// the credentials stored in SSM, or a SQLite file in the local stage. Connections go through wrapped drivers that
+// translate "?" placeholders and map driver errors, so handlers are written once for every dialect.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/migrations"
+)
+
+// SSM parameter holding the database credentials. Its "engine" field selects MySQL (the default) or Postgres.
+const credentialsParameter = "/application/dev/database/credentials"
+
+// Path of the SQLite file used when LOCAL_DB_PATH is unset. Functions are run from their own directory, so
+// they all share the file at the root of the repository.
+const defaultLocalPath = "../local.db"
+
+// Open connects to the database of the current stage and returns it with its dialect. In the local stage the
+// SQLite file is created if needed and brought up to date with the migrations.
+func Open(region string) (*sql.DB, Dialect, error) {
+	db, dialect, err := Connect(region)
+	if err != nil || dialect != SQLite {
+		return db, dialect, err
+	}
+
+	migrator, err := migrations.NewMigrator(db, string(dialect))
+	if err == nil {
+		_, err = migrator.Apply(context.Background())
+	}
+	if err != nil {
+		db.Close()
+		return nil, dialect, err
+	}
+	return db, dialect, nil
+}
+
+// Connect is Open without applying migrations, for the migrate command.
+func Connect(region string) (*sql.DB, Dialect, error) {
+	if config.IsLocal() {
+		path := os.Getenv("LOCAL_DB_PATH")
+		if path == "" {
+			path = defaultLocalPath
+		}
+		db, err := openSQLite(path)
+		return db, SQLite, err
+	}
+
+	creds, err := getCredentials(region)
+	if err != nil {
+		return nil, "", err
+	}
+	switch creds.Engine {
+	case "", "mysql":
+		db, err := openMySQL(creds)
+		return db, MySQL, err
+	case "postgres":
+		db, err := openPostgres(creds)
+		return db, Postgres, err
+	default:
+		return nil, "", fmt.Errorf("unsupported database engine %q", creds.Engine)
+	}
+}
+
+// openSQLite opens the SQLite file at path, creating it if it does not exist.
+func openSQLite(path string) (*sql.DB, error) {
+	// Foreign keys are off by default in SQLite. BEGIN IMMEDIATE takes the write lock when a transaction starts,
+	// standing in for the row locks MySQL takes with SELECT ... FOR UPDATE, and in WAL mode readers don't block it.
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL", path)
+	db, err := sql.Open(SQLite.driverName(), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Credentials is the JSON stored in the credentials parameter, in the format of an RDS secret.
+type Credentials struct {
+	Engine   string `json:"engine"` // "mysql" or "postgres"
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+}
+
+// getCredentials reads the database credentials from SSM.
+func getCredentials(region string) (*Credentials, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:                        aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session: %w", err)
+	}
+
+	withDecryption := true
+	paramName := credentialsParameter
+	param, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+		Name:           &paramName,
+		WithDecryption: &withDecryption,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting parameter '%s': %w", paramName, err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal([]byte(*param.Parameter.Value), &creds); err != nil {
+		return nil, fmt.Errorf("error parsing database credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// openMySQL connects to the user_management database on a MySQL server.
+func openMySQL(creds *Credentials) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/user_management", creds.Username, creds.Password, creds.Host, creds.Port)
+	return openPool(MySQL, dsn)
+}
+
+// openPostgres connects to the user_management database on a Postgres server.
+func openPostgres(creds *Credentials) (*sql.DB, error) {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(creds.Username, creds.Password),
+		Host:     fmt.Sprintf("%s:%d", creds.Host, creds.Port),
+		Path:     "/user_management",
+		RawQuery: "sslmode=require",
+	}
+	return openPool(Postgres, dsn.String())
+}
+
+// openPool opens a server database with the pool settings every function uses and checks the connection.
+func openPool(dialect Dialect, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(dialect.driverName(), dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	// Setting up the connection pool
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(0) // Connections are recycled forever
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, nil
+}
+
+// WithTransaction runs fn as one unit of work: every write fn makes through tx is committed together, or rolled
+// back together if fn returns an error, which WithTransaction then returns as it is.
+func WithTransaction(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("WithTransaction: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("Error rolling back transaction: %v", rollbackErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("WithTransaction: %w", err)
+	}
+	return nil
+}
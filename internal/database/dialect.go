@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL flavour of a database. Its value names the database engine.
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+)
+
+// Rebind rewrites the "?" placeholders of query into the placeholders of the dialect: $1, $2, ... for Postgres.
+// Question marks inside quoted strings, quoted identifiers and comments are left alone. The wrapped drivers
+// rebind every query, so handlers only need this to build SQL for another tool.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			// Copy up to the closing quote; a doubled quote is an escaped one and just reopens the string
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// OnConflictUpdate returns the clause that follows INSERT ... VALUES (...) to update the existing row instead
+// when the insert conflicts on key. Each assignment is a "Column = expression"; use Excluded to refer to the
+// value that was being inserted.
+func (d Dialect) OnConflictUpdate(key string, assignments ...string) string {
+	if d == MySQL {
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", key, strings.Join(assignments, ", "))
+}
+
+// OnConflictDoNothing returns the clause that follows INSERT ... VALUES (...) to skip a row that conflicts on key.
+func (d Dialect) OnConflictDoNothing(key string) string {
+	if d == MySQL {
+		// Unlike INSERT IGNORE this still fails on errors other than the duplicate key
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s = %s", key, key)
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", key)
+}
+
+// Excluded refers to the value of column in the row an OnConflictUpdate clause failed to insert.
+func (d Dialect) Excluded(column string) string {
+	if d == MySQL {
+		return "VALUES(" + column + ")"
+	}
+	return "excluded." + column
+}
+
+// Greatest returns the larger of two expressions.
+func (d Dialect) Greatest(a, b string) string {
+	if d == SQLite {
+		return fmt.Sprintf("MAX(%s, %s)", a, b)
+	}
+	return fmt.Sprintf("GREATEST(%s, %s)", a, b)
+}
+
+// Least returns the smaller of two expressions.
+func (d Dialect) Least(a, b string) string {
+	if d == SQLite {
+		return fmt.Sprintf("MIN(%s, %s)", a, b)
+	}
+	return fmt.Sprintf("LEAST(%s, %s)", a, b)
+}
+
+// ForUpdate returns the suffix that locks the rows a SELECT reads until the transaction ends. SQLite has no row
+// locks; Open starts its transactions with BEGIN IMMEDIATE, which locks the whole database instead.
+func (d Dialect) ForUpdate() string {
+	if d == SQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// Inserter is satisfied by *sql.DB and *sql.Tx.
+type Inserter interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// InsertID runs an INSERT and returns the value its auto-increment column idColumn was given. Postgres has no
+// LastInsertId, so there the value is read back with RETURNING.
+func (d Dialect) InsertID(ctx context.Context, db Inserter, query, idColumn string, args ...interface{}) (int64, error) {
+	if d == Postgres {
+		var id int64
+		err := db.QueryRowContext(ctx, query+" RETURNING "+idColumn, args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The drivers are registered wrapped, so that every query is rebound to the placeholders of its dialect and
+// every error is mapped by MapError. Handlers keep writing "?" placeholders and using *sql.DB.
+func init() {
+	sql.Register(MySQL.driverName(), &wrappedDriver{driver: &mysql.MySQLDriver{}, dialect: MySQL})
+	sql.Register(SQLite.driverName(), &wrappedDriver{driver: &sqlite3.SQLiteDriver{}, dialect: SQLite})
+	sql.Register(Postgres.driverName(), &wrappedDriver{driver: &pq.Driver{}, dialect: Postgres})
+}
+
+// driverName is the name the wrapped driver of the dialect is registered under.
+func (d Dialect) driverName() string {
+	return "lambdas-" + string(d)
+}
+
+type wrappedDriver struct {
+	driver  driver.Driver
+	dialect Dialect
+}
+
+func (d *wrappedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.driver.Open(name)
+	if err != nil {
+		return nil, MapError(err)
+	}
+	return &wrappedConn{conn: c, dialect: d.dialect}, nil
+}
+
+// wrappedConn forwards to the driver's connection, using the optional interfaces it implements and telling
+// database/sql to fall back (driver.ErrSkip) where it implements none.
+type wrappedConn struct {
+	conn    driver.Conn
+	dialect Dialect
+}
+
+func (c *wrappedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrappedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query = c.dialect.Rebind(query)
+	var s driver.Stmt
+	var err error
+	if p, ok := c.conn.(driver.ConnPrepareContext); ok {
+		s, err = p.PrepareContext(ctx, query)
+	} else {
+		s, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, MapError(err)
+	}
+	return &wrappedStmt{stmt: s, conn: c.conn}, nil
+}
+
+func (c *wrappedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wrappedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if b, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.conn.Begin() // Only for drivers without BeginTx
+	}
+	return tx, MapError(err)
+}
+
+func (c *wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	result, err := e.ExecContext(ctx, c.dialect.Rebind(query), args)
+	return result, MapError(err)
+}
+
+func (c *wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := q.QueryContext(ctx, c.dialect.Rebind(query), args)
+	return rows, MapError(err)
+}
+
+func (c *wrappedConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return MapError(p.Ping(ctx))
+	}
+	return nil
+}
+
+func (c *wrappedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *wrappedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// wrappedStmt maps the errors of a prepared statement. Its query was rebound by PrepareContext.
+type wrappedStmt struct {
+	stmt driver.Stmt
+	conn driver.Conn
+}
+
+func (s *wrappedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *wrappedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *wrappedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.stmt.Exec(args)
+	return result, MapError(err)
+}
+
+func (s *wrappedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.stmt.Query(args)
+	return rows, MapError(err)
+}
+
+func (s *wrappedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(values)
+	}
+	result, err := e.ExecContext(ctx, args)
+	return result, MapError(err)
+}
+
+func (s *wrappedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(values)
+	}
+	rows, err := q.QueryContext(ctx, args)
+	return rows, MapError(err)
+}
+
+// CheckNamedValue uses the checker of the statement, or else of its connection, as database/sql would have.
+func (s *wrappedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *wrappedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if c, ok := s.stmt.(driver.ColumnConverter); ok {
+		return c.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+func namedToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, driver.ErrSkip
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrDuplicateKey is matched by errors.Is when an insert or update conflicts with a primary key or unique index.
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrForeignKey is matched by errors.Is when a row references a row that does not exist, or is still referenced.
+	ErrForeignKey = errors.New("foreign key violation")
+)
+
+// MySQL error numbers
+const (
+	mysqlDuplicateEntry     = 1062
+	mysqlRowIsReferenced    = 1451
+	mysqlNoReferencedRow    = 1452
+	mysqlRowIsReferencedOld = 1217
+	mysqlNoReferencedRowOld = 1216
+)
+
+// Postgres SQLSTATE codes
+const (
+	postgresUniqueViolation     = "23505"
+	postgresForeignKeyViolation = "23503"
+)
+
+// MapError wraps a driver error with the common error it stands for, so callers can check for it with errors.Is
+// whichever database they run against. The driver's error stays in the chain for errors.As. Other errors are
+// returned unchanged.
+func MapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if common := commonError(err); common != nil {
+		return fmt.Errorf("%w: %w", common, err)
+	}
+	return err
+}
+
+func commonError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlDuplicateEntry:
+			return ErrDuplicateKey
+		case mysqlRowIsReferenced, mysqlNoReferencedRow, mysqlRowIsReferencedOld, mysqlNoReferencedRowOld:
+			return ErrForeignKey
+		}
+		return nil
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintUnique:
+			return ErrDuplicateKey
+		case sqlite3.ErrConstraintForeignKey:
+			return ErrForeignKey
+		}
+		return nil
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case postgresUniqueViolation:
+			return ErrDuplicateKey
+		case postgresForeignKeyViolation:
+			return ErrForeignKey
+		}
+	}
+	return nil
+}
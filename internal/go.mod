@@ -0,0 +1,16 @@
+module github.com/betchya/lambdas/internal
+
+go 1.21.4
+
+require (
+	github.com/aws/aws-sdk-go v1.52.3
+	github.com/go-sql-driver/mysql v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/stripe/stripe-go v70.15.0+incompatible
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+)
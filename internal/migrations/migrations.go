@@ -0,0 +1,262 @@
+// Package migrations keeps the schema of the user_management database. Migrations are SQL files embedded from
+// sql/<dialect>/, named <version>_<name>.up.sql with a matching .down.sql that reverts them. Every dialect has the
+// same versions, written in its own SQL. Applied versions are recorded in the SchemaMigrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql
+var files embed.FS
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied. AppliedAt is empty if it has not.
+type Status struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS SchemaMigrations (
+    Version   INT NOT NULL,
+    Name      VARCHAR(255) NOT NULL,
+    AppliedAt VARCHAR(32) NOT NULL,
+    PRIMARY KEY (Version)
+)`
+
+// AppliedAt is text so it reads back in the same layout from every driver
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+// Load returns the embedded migrations of a dialect ("mysql", "sqlite3" or "postgres") ordered by version.
+// Every migration must have both an up and a down file.
+func Load(dialect string) ([]*Migration, error) {
+	names, err := fs.Glob(files, "sql/"+dialect+"/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("Load: %w", err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Load: no migrations for dialect %q", dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		base := path.Base(name)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("Load: %s is not an .up.sql or .down.sql file", base)
+		}
+
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		prefix, label, ok := strings.Cut(stem, "_")
+		if !ok {
+			return nil, fmt.Errorf("Load: %s is not named <version>_<name>", base)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Load: %s has an invalid version: %w", base, err)
+		}
+
+		body, err := files.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Load: %w", err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("Load: version %d is used by both %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("Load: migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// statements splits a migration file into the statements it contains. Statements end with a semicolon at the
+// end of a line, and lines starting with "--" are comments.
+func statements(body string) []string {
+	var stmts []string
+	var current strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// Migrator applies and rolls back the embedded migrations against a database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+// NewMigrator loads the embedded migrations of dialect for db.
+func NewMigrator(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// applied returns the applied versions and when each was applied, creating the SchemaMigrations table if needed.
+func (m *Migrator) applied(ctx context.Context) (map[int]string, error) {
+	if _, err := m.db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, fmt.Errorf("error creating SchemaMigrations: %w", err)
+	}
+
+	rows, err := m.db.QueryContext(ctx, `SELECT Version, AppliedAt FROM SchemaMigrations`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SchemaMigrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error reading SchemaMigrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// run executes the statements of one migration and records or removes its version in the same transaction.
+// MySQL commits DDL implicitly, so a migration that fails halfway there has to be cleaned up by hand.
+func (m *Migrator) run(ctx context.Context, body string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements(body) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Apply runs every migration that has not been applied yet, oldest first, and returns the ones it ran.
+func (m *Migrator) Apply(ctx context.Context) ([]*Migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Apply: %w", err)
+	}
+
+	var ran []*Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.run(ctx, migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO SchemaMigrations (Version, Name, AppliedAt) VALUES (?, ?, ?)`,
+				migration.Version, migration.Name, time.Now().UTC().Format(dateTimeLayout))
+			return err
+		})
+		if err != nil {
+			return ran, fmt.Errorf("Apply: migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		ran = append(ran, migration)
+	}
+	return ran, nil
+}
+
+// Rollback reverts the latest steps applied migrations, newest first, and returns the ones it reverted.
+func (m *Migrator) Rollback(ctx context.Context, steps int) ([]*Migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Rollback: %w", err)
+	}
+
+	var reverted []*Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := m.run(ctx, migration.Down, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `DELETE FROM SchemaMigrations WHERE Version = ?`, migration.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("Rollback: migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		reverted = append(reverted, migration)
+	}
+	return reverted, nil
+}
+
+// Status lists every embedded migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]*Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Status: %w", err)
+	}
+
+	statuses := make([]*Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, &Status{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
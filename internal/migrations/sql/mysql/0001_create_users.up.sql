@@ -0,0 +1,18 @@
+-- Balances are stored in dollars. UserID is the user's Cognito identity ID.
+CREATE TABLE Users (
+    UserID                    VARCHAR(128) NOT NULL,
+    Username                  VARCHAR(255) NOT NULL,
+    Email                     VARCHAR(255) NOT NULL,
+    PhoneNumber               VARCHAR(32) NOT NULL DEFAULT '',
+    DateOfBirth               DATE NOT NULL,
+    AccountVerificationStatus VARCHAR(32) NOT NULL DEFAULT 'Unverified',
+    CreatedAt                 DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UpdatedAt                 DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    AccountBalance            DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    PendingBalance            DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    HeldBalance               DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    WithdrawableBalance       DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    stripe_customer_id        VARCHAR(255) NULL,
+    PRIMARY KEY (UserID),
+    UNIQUE KEY UsersStripeCustomerID (stripe_customer_id)
+);
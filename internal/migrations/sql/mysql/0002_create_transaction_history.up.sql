@@ -0,0 +1,13 @@
+-- Amounts are stored in cents. TransactionID is the Stripe object ID for deposits and refunds.
+CREATE TABLE TransactionHistory (
+    TransactionID     VARCHAR(255) NOT NULL,
+    UserID            VARCHAR(128) NOT NULL,
+    TransactionType   VARCHAR(32) NOT NULL,
+    Amount            DECIMAL(14, 2) NOT NULL,
+    TransactionStatus VARCHAR(32) NOT NULL,
+    TransactionDate   DATETIME NOT NULL,
+    PRIMARY KEY (TransactionID),
+    KEY TransactionHistoryUserDate (UserID, TransactionDate),
+    KEY TransactionHistoryTypeDate (TransactionType, TransactionDate),
+    CONSTRAINT TransactionHistoryUser FOREIGN KEY (UserID) REFERENCES Users (UserID)
+);
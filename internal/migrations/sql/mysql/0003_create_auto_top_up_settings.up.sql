@@ -0,0 +1,12 @@
+-- Threshold and ReloadAmount are in cents.
+CREATE TABLE AutoTopUpSettings (
+    UserID          VARCHAR(128) NOT NULL,
+    Enabled         BOOLEAN NOT NULL DEFAULT FALSE,
+    Threshold       BIGINT NOT NULL,
+    ReloadAmount    BIGINT NOT NULL,
+    Currency        VARCHAR(3) NOT NULL,
+    PaymentMethodID VARCHAR(255) NOT NULL,
+    LastTriggeredAt DATETIME NULL,
+    PRIMARY KEY (UserID),
+    CONSTRAINT AutoTopUpSettingsUser FOREIGN KEY (UserID) REFERENCES Users (UserID)
+);
@@ -0,0 +1,8 @@
+-- Limits are in cents. A NULL limit is not enforced.
+CREATE TABLE DepositLimits (
+    UserID       VARCHAR(128) NOT NULL,
+    DailyLimit   BIGINT NULL,
+    MonthlyLimit BIGINT NULL,
+    PRIMARY KEY (UserID),
+    CONSTRAINT DepositLimitsUser FOREIGN KEY (UserID) REFERENCES Users (UserID)
+);
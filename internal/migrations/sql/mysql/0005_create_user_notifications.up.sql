@@ -0,0 +1,9 @@
+CREATE TABLE UserNotifications (
+    NotificationID BIGINT NOT NULL AUTO_INCREMENT,
+    UserID         VARCHAR(128) NOT NULL,
+    Message        VARCHAR(1024) NOT NULL,
+    CreatedAt      DATETIME NOT NULL,
+    PRIMARY KEY (NotificationID),
+    KEY UserNotificationsUserCreated (UserID, CreatedAt),
+    CONSTRAINT UserNotificationsUser FOREIGN KEY (UserID) REFERENCES Users (UserID)
+);
@@ -0,0 +1,18 @@
+-- Amount is in cents. Frequency is "weekly" or "monthly"; Status is "Active", "Paused" or "Suspended".
+CREATE TABLE DepositSchedules (
+    ScheduleID      BIGINT NOT NULL AUTO_INCREMENT,
+    UserID          VARCHAR(128) NOT NULL,
+    Amount          BIGINT NOT NULL,
+    Currency        VARCHAR(3) NOT NULL,
+    PaymentMethodID VARCHAR(255) NOT NULL,
+    Frequency       VARCHAR(16) NOT NULL,
+    NextRunAt       DATETIME NOT NULL,
+    RetryAt         DATETIME NULL,
+    Status          VARCHAR(16) NOT NULL,
+    FailureCount    INT NOT NULL DEFAULT 0,
+    CreatedAt       DATETIME NOT NULL,
+    PRIMARY KEY (ScheduleID),
+    KEY DepositSchedulesUser (UserID),
+    KEY DepositSchedulesDue (Status, NextRunAt),
+    CONSTRAINT DepositSchedulesUser FOREIGN KEY (UserID) REFERENCES Users (UserID)
+);
@@ -0,0 +1,13 @@
+-- Status is "Received", "Processed" or "Failed". Payload is the raw event JSON.
+CREATE TABLE WebhookEvents (
+    EventID     VARCHAR(255) NOT NULL,
+    EventType   VARCHAR(255) NOT NULL,
+    Payload     MEDIUMTEXT NOT NULL,
+    Status      VARCHAR(16) NOT NULL,
+    Attempts    INT NOT NULL DEFAULT 0,
+    LastError   TEXT NULL,
+    ReceivedAt  DATETIME NOT NULL,
+    ProcessedAt DATETIME NULL,
+    PRIMARY KEY (EventID),
+    KEY WebhookEventsStatus (Status, ReceivedAt)
+);
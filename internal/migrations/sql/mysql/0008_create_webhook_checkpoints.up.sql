@@ -0,0 +1,6 @@
+-- LastEventCreated is the Unix time of the newest Stripe event a job has handled.
+CREATE TABLE WebhookCheckpoints (
+    Name             VARCHAR(64) NOT NULL,
+    LastEventCreated BIGINT NOT NULL,
+    PRIMARY KEY (Name)
+);
@@ -0,0 +1,17 @@
+-- Balances are stored in dollars. UserID is the user's Cognito identity ID. Dates are TEXT so they read back
+-- in the same "2006-01-02 15:04:05" layout MySQL returns.
+CREATE TABLE Users (
+    UserID                    VARCHAR(128) NOT NULL PRIMARY KEY,
+    Username                  VARCHAR(255) NOT NULL,
+    Email                     VARCHAR(255) NOT NULL,
+    PhoneNumber               VARCHAR(32) NOT NULL DEFAULT '',
+    DateOfBirth               TEXT NOT NULL,
+    AccountVerificationStatus VARCHAR(32) NOT NULL DEFAULT 'Unverified',
+    CreatedAt                 TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    UpdatedAt                 TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+    AccountBalance            NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    PendingBalance            NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    HeldBalance               NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    WithdrawableBalance       NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    stripe_customer_id        VARCHAR(255) NULL UNIQUE
+);
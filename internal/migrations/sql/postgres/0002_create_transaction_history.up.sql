@@ -0,0 +1,11 @@
+-- Amounts are stored in cents. TransactionID is the Stripe object ID for deposits and refunds.
+CREATE TABLE TransactionHistory (
+    TransactionID     VARCHAR(255) NOT NULL PRIMARY KEY,
+    UserID            VARCHAR(128) NOT NULL REFERENCES Users (UserID),
+    TransactionType   VARCHAR(32) NOT NULL,
+    Amount            NUMERIC(14, 2) NOT NULL,
+    TransactionStatus VARCHAR(32) NOT NULL,
+    TransactionDate   TEXT NOT NULL
+);
+CREATE INDEX TransactionHistoryUserDate ON TransactionHistory (UserID, TransactionDate);
+CREATE INDEX TransactionHistoryTypeDate ON TransactionHistory (TransactionType, TransactionDate);
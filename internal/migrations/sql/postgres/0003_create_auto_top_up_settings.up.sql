@@ -0,0 +1,10 @@
+-- Threshold and ReloadAmount are in cents.
+CREATE TABLE AutoTopUpSettings (
+    UserID          VARCHAR(128) NOT NULL PRIMARY KEY REFERENCES Users (UserID),
+    Enabled         BOOLEAN NOT NULL DEFAULT FALSE,
+    Threshold       BIGINT NOT NULL,
+    ReloadAmount    BIGINT NOT NULL,
+    Currency        VARCHAR(3) NOT NULL,
+    PaymentMethodID VARCHAR(255) NOT NULL,
+    LastTriggeredAt TEXT NULL
+);
@@ -0,0 +1,6 @@
+-- Limits are in cents. A NULL limit is not enforced.
+CREATE TABLE DepositLimits (
+    UserID       VARCHAR(128) NOT NULL PRIMARY KEY REFERENCES Users (UserID),
+    DailyLimit   BIGINT NULL,
+    MonthlyLimit BIGINT NULL
+);
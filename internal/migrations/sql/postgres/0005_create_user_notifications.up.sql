@@ -0,0 +1,7 @@
+CREATE TABLE UserNotifications (
+    NotificationID BIGSERIAL PRIMARY KEY,
+    UserID         VARCHAR(128) NOT NULL REFERENCES Users (UserID),
+    Message        VARCHAR(1024) NOT NULL,
+    CreatedAt      TEXT NOT NULL
+);
+CREATE INDEX UserNotificationsUserCreated ON UserNotifications (UserID, CreatedAt);
@@ -0,0 +1,16 @@
+-- Amount is in cents. Frequency is "weekly" or "monthly"; Status is "Active", "Paused" or "Suspended".
+CREATE TABLE DepositSchedules (
+    ScheduleID      BIGSERIAL PRIMARY KEY,
+    UserID          VARCHAR(128) NOT NULL REFERENCES Users (UserID),
+    Amount          BIGINT NOT NULL,
+    Currency        VARCHAR(3) NOT NULL,
+    PaymentMethodID VARCHAR(255) NOT NULL,
+    Frequency       VARCHAR(16) NOT NULL,
+    NextRunAt       TEXT NOT NULL,
+    RetryAt         TEXT NULL,
+    Status          VARCHAR(16) NOT NULL,
+    FailureCount    INT NOT NULL DEFAULT 0,
+    CreatedAt       TEXT NOT NULL
+);
+CREATE INDEX DepositSchedulesUser ON DepositSchedules (UserID);
+CREATE INDEX DepositSchedulesDue ON DepositSchedules (Status, NextRunAt);
@@ -0,0 +1,12 @@
+-- Status is "Received", "Processed" or "Failed". Payload is the raw event JSON.
+CREATE TABLE WebhookEvents (
+    EventID     VARCHAR(255) NOT NULL PRIMARY KEY,
+    EventType   VARCHAR(255) NOT NULL,
+    Payload     TEXT NOT NULL,
+    Status      VARCHAR(16) NOT NULL,
+    Attempts    INT NOT NULL DEFAULT 0,
+    LastError   TEXT NULL,
+    ReceivedAt  TEXT NOT NULL,
+    ProcessedAt TEXT NULL
+);
+CREATE INDEX WebhookEventsStatus ON WebhookEvents (Status, ReceivedAt);
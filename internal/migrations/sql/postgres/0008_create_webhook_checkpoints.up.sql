@@ -0,0 +1,5 @@
+-- LastEventCreated is the Unix time of the newest Stripe event a job has handled.
+CREATE TABLE WebhookCheckpoints (
+    Name             VARCHAR(64) NOT NULL PRIMARY KEY,
+    LastEventCreated BIGINT NOT NULL
+);
@@ -0,0 +1,5 @@
+-- LastEventCreated is the Unix time of the newest event applied to the Stripe object, so older events can be skipped.
+CREATE TABLE StripeObjectVersions (
+    ObjectID         VARCHAR(255) NOT NULL PRIMARY KEY,
+    LastEventCreated BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE TransactionHistory DROP COLUMN Wallet;
@@ -0,0 +1,3 @@
+-- Currency is the lower case ISO code a deposit was made in, such as "usd", so a manual capture is made in the
+-- currency that was authorised. It is NULL for rows that are not deposits and for deposits recorded before it was.
+ALTER TABLE TransactionHistory ADD COLUMN Currency VARCHAR(3) NULL;
@@ -0,0 +1,17 @@
+-- Balances are stored in dollars. UserID is the user's Cognito identity ID. Dates are TEXT so they read back
+-- in the same "2006-01-02 15:04:05" layout MySQL returns.
+CREATE TABLE Users (
+    UserID                    TEXT NOT NULL PRIMARY KEY,
+    Username                  TEXT NOT NULL,
+    Email                     TEXT NOT NULL,
+    PhoneNumber               TEXT NOT NULL DEFAULT '',
+    DateOfBirth               TEXT NOT NULL,
+    AccountVerificationStatus TEXT NOT NULL DEFAULT 'Unverified',
+    CreatedAt                 TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UpdatedAt                 TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    AccountBalance            REAL NOT NULL DEFAULT 0,
+    PendingBalance            REAL NOT NULL DEFAULT 0,
+    HeldBalance               REAL NOT NULL DEFAULT 0,
+    WithdrawableBalance       REAL NOT NULL DEFAULT 0,
+    stripe_customer_id        TEXT NULL UNIQUE
+);
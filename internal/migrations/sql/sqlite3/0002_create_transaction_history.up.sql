@@ -0,0 +1,11 @@
+-- Amounts are stored in cents. TransactionID is the Stripe object ID for deposits and refunds.
+CREATE TABLE TransactionHistory (
+    TransactionID     TEXT NOT NULL PRIMARY KEY,
+    UserID            TEXT NOT NULL REFERENCES Users (UserID),
+    TransactionType   TEXT NOT NULL,
+    Amount            REAL NOT NULL,
+    TransactionStatus TEXT NOT NULL,
+    TransactionDate   TEXT NOT NULL
+);
+CREATE INDEX TransactionHistoryUserDate ON TransactionHistory (UserID, TransactionDate);
+CREATE INDEX TransactionHistoryTypeDate ON TransactionHistory (TransactionType, TransactionDate);
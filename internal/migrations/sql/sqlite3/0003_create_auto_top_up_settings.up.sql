@@ -0,0 +1,10 @@
+-- Threshold and ReloadAmount are in cents.
+CREATE TABLE AutoTopUpSettings (
+    UserID          TEXT NOT NULL PRIMARY KEY REFERENCES Users (UserID),
+    Enabled         BOOLEAN NOT NULL DEFAULT FALSE,
+    Threshold       INTEGER NOT NULL,
+    ReloadAmount    INTEGER NOT NULL,
+    Currency        TEXT NOT NULL,
+    PaymentMethodID TEXT NOT NULL,
+    LastTriggeredAt TEXT NULL
+);
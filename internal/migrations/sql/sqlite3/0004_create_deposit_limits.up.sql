@@ -0,0 +1,6 @@
+-- Limits are in cents. A NULL limit is not enforced.
+CREATE TABLE DepositLimits (
+    UserID       TEXT NOT NULL PRIMARY KEY REFERENCES Users (UserID),
+    DailyLimit   INTEGER NULL,
+    MonthlyLimit INTEGER NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE UserNotifications (
+    NotificationID INTEGER PRIMARY KEY AUTOINCREMENT,
+    UserID         TEXT NOT NULL REFERENCES Users (UserID),
+    Message        TEXT NOT NULL,
+    CreatedAt      TEXT NOT NULL
+);
+CREATE INDEX UserNotificationsUserCreated ON UserNotifications (UserID, CreatedAt);
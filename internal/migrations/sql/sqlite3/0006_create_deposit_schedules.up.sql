@@ -0,0 +1,16 @@
+-- Amount is in cents. Frequency is "weekly" or "monthly"; Status is "Active", "Paused" or "Suspended".
+CREATE TABLE DepositSchedules (
+    ScheduleID      INTEGER PRIMARY KEY AUTOINCREMENT,
+    UserID          TEXT NOT NULL REFERENCES Users (UserID),
+    Amount          INTEGER NOT NULL,
+    Currency        TEXT NOT NULL,
+    PaymentMethodID TEXT NOT NULL,
+    Frequency       TEXT NOT NULL,
+    NextRunAt       TEXT NOT NULL,
+    RetryAt         TEXT NULL,
+    Status          TEXT NOT NULL,
+    FailureCount    INTEGER NOT NULL DEFAULT 0,
+    CreatedAt       TEXT NOT NULL
+);
+CREATE INDEX DepositSchedulesUser ON DepositSchedules (UserID);
+CREATE INDEX DepositSchedulesDue ON DepositSchedules (Status, NextRunAt);
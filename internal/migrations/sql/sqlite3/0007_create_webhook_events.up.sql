@@ -0,0 +1,12 @@
+-- Status is "Received", "Processed" or "Failed". Payload is the raw event JSON.
+CREATE TABLE WebhookEvents (
+    EventID     TEXT NOT NULL PRIMARY KEY,
+    EventType   TEXT NOT NULL,
+    Payload     TEXT NOT NULL,
+    Status      TEXT NOT NULL,
+    Attempts    INTEGER NOT NULL DEFAULT 0,
+    LastError   TEXT NULL,
+    ReceivedAt  TEXT NOT NULL,
+    ProcessedAt TEXT NULL
+);
+CREATE INDEX WebhookEventsStatus ON WebhookEvents (Status, ReceivedAt);
@@ -0,0 +1,4 @@
+-- Provider is the payment service provider that handled a deposit or dispute, e.g. "stripe" or "adyen", and is
+-- NULL for rows no provider handled, such as bets. Every earlier deposit and dispute went through Stripe.
+ALTER TABLE TransactionHistory ADD COLUMN Provider TEXT NULL;
+UPDATE TransactionHistory SET Provider = 'stripe' WHERE TransactionType IN ('Deposit', 'Dispute');
@@ -0,0 +1,3 @@
+-- Wallet is the digital wallet a card deposit was paid with, such as "apple_pay" or "google_pay", and is NULL for
+-- deposits paid without one and for rows that are not deposits.
+ALTER TABLE TransactionHistory ADD COLUMN Wallet TEXT NULL;
@@ -0,0 +1,601 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdyenAccepted is the body Adyen expects in reply to a notification it should not send again.
+const AdyenAccepted = "[accepted]"
+
+// adyenManualCapture is the CaptureMethod metadata of payments created with ManualCapture. Adyen echoes metadata in
+// notifications, which tells an authorisation that waits for a capture from one that was captured right away.
+const adyenManualCapture = "manual"
+
+// AdyenConfig holds the settings of the Adyen adapter. BaseURL is the versioned Checkout API endpoint, e.g.
+// https://checkout-test.adyen.com/v71. HMACKey is the hex key notifications are signed with and is only needed to
+// parse webhooks.
+type AdyenConfig struct {
+	APIKey          string
+	MerchantAccount string
+	HMACKey         string
+	BaseURL         string
+	ReturnURL       string // Where the shopper lands after a redirect, such as 3D Secure
+}
+
+// AdyenProvider takes payments through the Adyen Checkout API. Adyen has no customer objects: shoppers are
+// identified by their UserID (the shopperReference), and a payment with a payment method is authorised when it
+// is created rather than in a separate confirmation.
+type AdyenProvider struct {
+	cfg    AdyenConfig
+	client *http.Client
+}
+
+// NewAdyen returns an Adyen adapter.
+func NewAdyen(cfg AdyenConfig) *AdyenProvider {
+	return &AdyenProvider{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (p *AdyenProvider) Name() ProviderName {
+	return Adyen
+}
+
+type adyenAmount struct {
+	Value    int64  `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type adyenResponse struct {
+	ID                string            `json:"id"`          // Session ID
+	SessionData       string            `json:"sessionData"` // Handed to the Drop-in to start the session
+	PSPReference      string            `json:"pspReference"`
+	MerchantReference string            `json:"merchantReference"`
+	Reference         string            `json:"reference"`
+	ResultCode        string            `json:"resultCode"`
+	Status            string            `json:"status"`
+	Amount            *adyenAmount      `json:"amount"`
+	Action            json.RawMessage   `json:"action"`
+	AdditionalData    map[string]string `json:"additionalData"`
+}
+
+type adyenError struct {
+	Status    int    `json:"status"`
+	ErrorCode string `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+func (e *adyenError) Error() string {
+	return fmt.Sprintf("adyen error %d (%s): %s", e.Status, e.ErrorCode, e.Message)
+}
+
+// post sends a Checkout API request. Errors carry Adyen's error code. A 404 matches ErrNotFound, and connection
+// failures and rate limiting, after which nothing was done, match ErrProviderUnavailable. Adyen authorises a payment
+// when it is created, so timeouts, unreadable responses and server errors match ErrOutcomeUnknown instead.
+func (p *AdyenProvider) post(ctx context.Context, path, idempotencyKey string, body interface{}) (*adyenResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.cfg.BaseURL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", p.cfg.APIKey)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if requestNotSent(err) {
+			return nil, fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &adyenError{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %w", ErrNotFound, apiErr)
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, fmt.Errorf("%w: %w", ErrProviderUnavailable, apiErr)
+		}
+		if resp.StatusCode >= 500 {
+			return nil, fmt.Errorf("%w: %w", ErrOutcomeUnknown, apiErr)
+		}
+		return nil, apiErr
+	}
+
+	var result adyenResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%w: error decoding %s response: %w", ErrOutcomeUnknown, path, err)
+	}
+	return &result, nil
+}
+
+// CreateCustomer has nothing to create at Adyen; the customer is the shopperReference, which is the UserID.
+func (p *AdyenProvider) CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error) {
+	return &Customer{ID: params.UserID, UserID: params.UserID, Email: params.Email, Name: params.Name}, nil
+}
+
+// GetCustomer returns the shopper with the given shopperReference. Adyen doesn't look shoppers up, so it never
+// returns ErrNotFound.
+func (p *AdyenProvider) GetCustomer(ctx context.Context, customerID string) (*Customer, error) {
+	return &Customer{ID: customerID, UserID: customerID}, nil
+}
+
+// CreateIntent makes a payment with the given payment method, which Adyen authorises right away. Without a payment
+// method it opens a Checkout session instead: the session ID is the intent ID, and its sessionData is returned as
+// the client secret for the Drop-in to collect the payment method. A session offers every payment method enabled
+// for the merchant account, so AutomaticPaymentMethods needs nothing more. For Apple Pay and Google Pay the payment
+// method is the token the wallet returned on the frontend. With ManualCapture an authorised payment is returned as
+// StatusRequiresCapture.
+func (p *AdyenProvider) CreateIntent(ctx context.Context, params *IntentParams) (*Intent, error) {
+	reference := params.IdempotencyKey
+	if reference == "" {
+		reference = newReference()
+	}
+	request := map[string]interface{}{
+		"merchantAccount":  p.cfg.MerchantAccount,
+		"amount":           adyenAmount{Value: params.Amount, Currency: strings.ToUpper(params.Currency)},
+		"reference":        reference,
+		"shopperReference": params.UserID,
+		"returnUrl":        p.cfg.ReturnURL,
+	}
+	metadata := map[string]string{}
+	for key, value := range params.Metadata {
+		metadata[key] = value
+	}
+	metadata["UserID"] = params.UserID
+	if params.ManualCapture {
+		metadata["CaptureMethod"] = adyenManualCapture
+		request["additionalData"] = map[string]string{"manualCapture": "true"}
+	}
+	request["metadata"] = metadata
+	if params.SaveForFutureUse || params.OffSession {
+		request["recurringProcessingModel"] = "UnscheduledCardOnFile"
+	}
+
+	if params.PaymentMethodID == "" {
+		if params.SaveForFutureUse {
+			request["storePaymentMethodMode"] = "enabled"
+		}
+		if params.PaymentMethodType == "us_bank_account" {
+			request["allowedPaymentMethods"] = []string{"ach"}
+		} else if IsWallet(params.PaymentMethodType) && !params.AutomaticPaymentMethods {
+			request["allowedPaymentMethods"] = []string{adyenWalletTypes[params.PaymentMethodType]}
+		}
+		session, err := p.post(ctx, "/sessions", params.IdempotencyKey, request)
+		if err != nil {
+			return nil, fmt.Errorf("CreateIntent: %w", err)
+		}
+		return &Intent{
+			ID:           session.ID,
+			Provider:     Adyen,
+			Amount:       params.Amount,
+			Currency:     strings.ToLower(params.Currency),
+			Status:       StatusRequiresPaymentMethod,
+			ClientSecret: session.SessionData,
+			UserID:       params.UserID,
+		}, nil
+	}
+
+	if IsWallet(params.PaymentMethodType) {
+		walletType := adyenWalletTypes[params.PaymentMethodType]
+		request["paymentMethod"] = map[string]string{"type": walletType, walletType + "Token": params.PaymentMethodID}
+	} else {
+		request["paymentMethod"] = map[string]string{"type": "scheme", "storedPaymentMethodId": params.PaymentMethodID}
+	}
+	request["storePaymentMethod"] = params.SaveForFutureUse
+	if params.OffSession {
+		request["shopperInteraction"] = "ContAuth"
+	} else {
+		request["shopperInteraction"] = "Ecommerce"
+	}
+	payment, err := p.post(ctx, "/payments", params.IdempotencyKey, request)
+	if err != nil {
+		return nil, fmt.Errorf("CreateIntent: %w", err)
+	}
+	intent := p.intent(payment, params.Amount, params.Currency, params.UserID)
+	if IsWallet(params.PaymentMethodType) {
+		intent.Wallet = params.PaymentMethodType
+	}
+	if params.ManualCapture && intent.Status == StatusSucceeded {
+		intent.Status = StatusRequiresCapture
+	}
+	return intent, nil
+}
+
+// adyenWalletTypes maps the wallets to Adyen's payment method types. The wallet's token is sent in the field named
+// after the type, e.g. "applepayToken".
+var adyenWalletTypes = map[string]string{
+	WalletApplePay:  "applepay",
+	WalletGooglePay: "googlepay",
+}
+
+// adyenWallet returns the wallet of a notification's paymentMethod, such as "visa_applepay" or "googlepay", or "" if
+// the payment wasn't made with one. Older Google Pay integrations report "paywithgoogle".
+func adyenWallet(paymentMethod string) string {
+	switch {
+	case strings.Contains(paymentMethod, "applepay"):
+		return WalletApplePay
+	case strings.Contains(paymentMethod, "googlepay"), strings.Contains(paymentMethod, "paywithgoogle"):
+		return WalletGooglePay
+	}
+	return ""
+}
+
+// GetIntent returns ErrUnsupported: the Checkout API has no way to look a payment up, and Adyen reports on payments
+// only through notifications.
+func (p *AdyenProvider) GetIntent(ctx context.Context, intentID string) (*Intent, error) {
+	return nil, fmt.Errorf("GetIntent: %w", ErrUnsupported)
+}
+
+// GetPaymentMethod returns ErrUnsupported: Adyen's stored payment methods are only listed per shopper.
+func (p *AdyenProvider) GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	return nil, fmt.Errorf("GetPaymentMethod: %w", ErrUnsupported)
+}
+
+// ListIntents returns ErrUnsupported, like ListCharges and ListRefunds: Adyen reports payments through notifications
+// and settlement reports, not a listing API.
+func (p *AdyenProvider) ListIntents(ctx context.Context, params *ListParams) ([]*Intent, error) {
+	return nil, fmt.Errorf("ListIntents: %w", ErrUnsupported)
+}
+
+func (p *AdyenProvider) ListCharges(ctx context.Context, params *ListParams) ([]*Charge, error) {
+	return nil, fmt.Errorf("ListCharges: %w", ErrUnsupported)
+}
+
+func (p *AdyenProvider) ListRefunds(ctx context.Context, params *ListParams) ([]*Refund, error) {
+	return nil, fmt.Errorf("ListRefunds: %w", ErrUnsupported)
+}
+
+// ConfirmIntent submits the result of an authentication step, such as a 3D Secure redirect, to /payments/details.
+// Adyen authorises a payment when it is created, so there is nothing to confirm without Details.
+func (p *AdyenProvider) ConfirmIntent(ctx context.Context, params *ConfirmParams) (*Intent, error) {
+	if len(params.Details) == 0 {
+		return nil, fmt.Errorf("ConfirmIntent: Adyen payments are confirmed when they are created: %w", ErrUnsupported)
+	}
+	payment, err := p.post(ctx, "/payments/details", "", map[string]interface{}{"details": params.Details})
+	if err != nil {
+		return nil, fmt.Errorf("ConfirmIntent: %w", err)
+	}
+	// The shopper is echoed in additionalData, as in notifications
+	userID := payment.AdditionalData["metadata.UserID"]
+	if userID == "" {
+		userID = payment.AdditionalData["shopperReference"]
+	}
+	intent := p.intent(payment, 0, "", userID)
+	if intent.ID == "" {
+		intent.ID = params.IntentID
+	}
+	return intent, nil
+}
+
+// CaptureIntent captures an authorised payment by its pspReference. Adyen only acknowledges the request; the CAPTURE
+// notification reports the outcome, so the intent is returned as processing.
+func (p *AdyenProvider) CaptureIntent(ctx context.Context, params *CaptureParams) (*Intent, error) {
+	if params.Amount <= 0 || params.Currency == "" {
+		return nil, fmt.Errorf("CaptureIntent: Adyen captures need an amount and currency: %w", ErrUnsupported)
+	}
+	reference := params.IdempotencyKey
+	if reference == "" {
+		reference = newReference()
+	}
+	request := map[string]interface{}{
+		"merchantAccount": p.cfg.MerchantAccount,
+		"amount":          adyenAmount{Value: params.Amount, Currency: strings.ToUpper(params.Currency)},
+		"reference":       reference,
+	}
+	if _, err := p.post(ctx, "/payments/"+params.IntentID+"/captures", params.IdempotencyKey, request); err != nil {
+		return nil, fmt.Errorf("CaptureIntent: %w", err)
+	}
+	return &Intent{
+		ID:       params.IntentID,
+		Provider: Adyen,
+		Amount:   params.Amount,
+		Currency: strings.ToLower(params.Currency),
+		Status:   StatusProcessing,
+	}, nil
+}
+
+// CancelIntent cancels an authorised payment by its pspReference. Adyen has no cancellation reasons, so Reason is
+// only kept in the reference. Like a capture, the outcome arrives in the CANCELLATION notification.
+func (p *AdyenProvider) CancelIntent(ctx context.Context, params *CancelParams) (*Intent, error) {
+	reference := newReference()
+	if params.Reason != "" {
+		reference = params.Reason + "_" + reference
+	}
+	request := map[string]interface{}{
+		"merchantAccount": p.cfg.MerchantAccount,
+		"reference":       reference,
+	}
+	if _, err := p.post(ctx, "/payments/"+params.IntentID+"/cancels", "", request); err != nil {
+		return nil, fmt.Errorf("CancelIntent: %w", err)
+	}
+	return &Intent{ID: params.IntentID, Provider: Adyen, Status: StatusProcessing}, nil
+}
+
+// Refund refunds a payment by its pspReference. Adyen needs the amount and currency even for a full refund.
+func (p *AdyenProvider) Refund(ctx context.Context, params *RefundParams) (*Refund, error) {
+	if params.Amount <= 0 || params.Currency == "" {
+		return nil, fmt.Errorf("Refund: Adyen refunds need an amount and currency: %w", ErrUnsupported)
+	}
+	reference := params.IdempotencyKey
+	if reference == "" {
+		reference = newReference()
+	}
+	request := map[string]interface{}{
+		"merchantAccount": p.cfg.MerchantAccount,
+		"amount":          adyenAmount{Value: params.Amount, Currency: strings.ToUpper(params.Currency)},
+		"reference":       reference,
+	}
+	if params.Reason != "" {
+		request["merchantRefundReason"] = params.Reason
+	}
+	refund, err := p.post(ctx, "/payments/"+params.IntentID+"/refunds", params.IdempotencyKey, request)
+	if err != nil {
+		return nil, fmt.Errorf("Refund: %w", err)
+	}
+	// Adyen only acknowledges the request here; the REFUND notification reports the outcome
+	return &Refund{
+		ID:       refund.PSPReference,
+		IntentID: params.IntentID,
+		Amount:   params.Amount,
+		Currency: strings.ToLower(params.Currency),
+		Status:   "pending",
+	}, nil
+}
+
+// intent converts a /payments or /payments/details response. The action to perform on the frontend, if any, is
+// returned as the client secret.
+func (p *AdyenProvider) intent(payment *adyenResponse, amount int64, currency, userID string) *Intent {
+	intent := &Intent{
+		ID:       payment.PSPReference,
+		Provider: Adyen,
+		Amount:   amount,
+		Currency: strings.ToLower(currency),
+		Status:   adyenStatus(payment.ResultCode),
+		UserID:   userID,
+	}
+	if payment.Amount != nil {
+		intent.Amount = payment.Amount.Value
+		intent.Currency = strings.ToLower(payment.Amount.Currency)
+	}
+	if intent.ID == "" {
+		// Payments awaiting a redirect may not have a pspReference yet
+		intent.ID = payment.MerchantReference
+	}
+	if len(payment.Action) > 0 {
+		intent.ClientSecret = string(payment.Action)
+	}
+	return intent
+}
+
+// adyenStatus maps a resultCode to the status of the intent.
+func adyenStatus(resultCode string) IntentStatus {
+	switch resultCode {
+	case "Authorised":
+		return StatusSucceeded
+	case "Pending", "Received":
+		return StatusProcessing
+	case "RedirectShopper", "IdentifyShopper", "ChallengeShopper", "PresentToShopper":
+		return StatusRequiresAction
+	case "Cancelled":
+		return StatusCanceled
+	default: // "Refused", "Error"
+		return StatusFailed
+	}
+}
+
+// adyenNotification is the body of an Adyen standard notification.
+type adyenNotification struct {
+	Live              string `json:"live"`
+	NotificationItems []struct {
+		Item adyenNotificationItem `json:"NotificationRequestItem"`
+	} `json:"notificationItems"`
+}
+
+type adyenNotificationItem struct {
+	AdditionalData      map[string]string `json:"additionalData,omitempty"`
+	Amount              adyenAmount       `json:"amount"`
+	EventCode           string            `json:"eventCode"`
+	EventDate           string            `json:"eventDate"`
+	MerchantAccountCode string            `json:"merchantAccountCode"`
+	MerchantReference   string            `json:"merchantReference"`
+	OriginalReference   string            `json:"originalReference,omitempty"`
+	PaymentMethod       string            `json:"paymentMethod,omitempty"`
+	PSPReference        string            `json:"pspReference"`
+	Reason              string            `json:"reason,omitempty"`
+	Success             string            `json:"success"`
+}
+
+// signature computes the HMAC signature of a notification item with the hex encoded key.
+func (item *adyenNotificationItem) signature(hmacKey string) (string, error) {
+	key, err := hex.DecodeString(hmacKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid Adyen HMAC key: %w", err)
+	}
+	signed := strings.Join([]string{
+		item.PSPReference,
+		item.OriginalReference,
+		item.MerchantAccountCode,
+		item.MerchantReference,
+		strconv.FormatInt(item.Amount.Value, 10),
+		item.Amount.Currency,
+		item.EventCode,
+		item.Success,
+	}, ":")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// adyenModifications are the event codes of notifications about a modification of a payment, such as its capture.
+// Their pspReference is the modification's own; the payment's is the originalReference.
+var adyenModifications = map[string]bool{
+	"CAPTURE":          true,
+	"CAPTURE_FAILED":   true,
+	"CANCELLATION":     true,
+	"CANCEL_OR_REFUND": true,
+	"REFUND":           true,
+	"REFUND_FAILED":    true,
+}
+
+// paymentReference returns the pspReference of the payment a notification is about, which is the intent ID.
+func (item *adyenNotificationItem) paymentReference() string {
+	if adyenModifications[item.EventCode] && item.OriginalReference != "" {
+		return item.OriginalReference
+	}
+	return item.PSPReference
+}
+
+// adyenEventType maps a notification to the Stripe event type the worker handles, or "" if it handles none. The
+// authorisation of a payment with manual capture only makes it capturable; its CAPTURE completes it. Modification
+// notifications don't reliably carry the payment's metadata, so a CAPTURE is mapped the same way for every payment:
+// for one captured right away it repeats the outcome of the AUTHORISATION, which the worker ignores. A successful
+// REFUND, or a CANCEL_OR_REFUND that refunded the payment, is a "charge.refunded". REFUND_FAILED is left out: a
+// refund Adyen reported as successful can't be taken back in the ledger, where "Refunded" is final.
+func adyenEventType(item *adyenNotificationItem) string {
+	success := item.Success == "true"
+	manualCapture := item.AdditionalData["metadata.CaptureMethod"] == adyenManualCapture
+	switch item.EventCode {
+	case "AUTHORISATION":
+		if success && manualCapture {
+			return "payment_intent.amount_capturable_updated"
+		}
+		if success {
+			return "payment_intent.succeeded"
+		}
+		return "payment_intent.payment_failed"
+	case "CAPTURE":
+		if success {
+			return "payment_intent.succeeded"
+		}
+		return "payment_intent.payment_failed"
+	case "CAPTURE_FAILED":
+		return "payment_intent.payment_failed"
+	case "CANCELLATION", "OFFER_CLOSED":
+		if success {
+			return "payment_intent.canceled"
+		}
+	case "REFUND":
+		if success {
+			return "charge.refunded"
+		}
+	case "CANCEL_OR_REFUND":
+		if !success {
+			break
+		}
+		if item.AdditionalData["modification.action"] == "refund" {
+			return "charge.refunded"
+		}
+		return "payment_intent.canceled"
+	}
+	return ""
+}
+
+// ParseWebhook verifies the HMAC signature of every item of a notification and returns the events the worker
+// handles. A single bad signature rejects the whole notification, which Adyen then sends again.
+func (p *AdyenProvider) ParseWebhook(payload []byte, headers map[string]string) ([]*WebhookEvent, error) {
+	if p.cfg.HMACKey == "" {
+		return nil, errors.New("ParseWebhook: no Adyen HMAC key is configured")
+	}
+	var notification adyenNotification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return nil, fmt.Errorf("ParseWebhook: error decoding notification: %w", err)
+	}
+
+	var parsed []*WebhookEvent
+	for _, wrapper := range notification.NotificationItems {
+		item := wrapper.Item
+		expected, err := item.signature(p.cfg.HMACKey)
+		if err != nil {
+			return nil, fmt.Errorf("ParseWebhook: %w", err)
+		}
+		if !hmac.Equal([]byte(expected), []byte(item.AdditionalData["hmacSignature"])) {
+			return nil, fmt.Errorf("%w: item %s %s", ErrInvalidSignature, item.PSPReference, item.EventCode)
+		}
+
+		eventType := adyenEventType(&item)
+		if eventType == "" {
+			continue
+		}
+		event := &WebhookEvent{
+			ID:       fmt.Sprintf("adyen_%s_%s_%s", item.PSPReference, item.EventCode, item.Success),
+			Provider: Adyen,
+			Type:     eventType,
+			IntentID: item.paymentReference(),
+			Amount:   item.Amount.Value,
+			Currency: strings.ToLower(item.Amount.Currency),
+			UserID:   item.AdditionalData["metadata.UserID"],
+			Wallet:   adyenWallet(item.PaymentMethod),
+		}
+		if event.UserID == "" {
+			event.UserID = item.AdditionalData["shopperReference"]
+		}
+		if created, err := time.Parse(time.RFC3339, item.EventDate); err == nil {
+			event.Created = created.Unix()
+		}
+		if event.Payload, err = eventPayload(event); err != nil {
+			return nil, fmt.Errorf("ParseWebhook: %w", err)
+		}
+		parsed = append(parsed, event)
+	}
+	return parsed, nil
+}
+
+// SignAdyenNotification sets the hmacSignature of every item of a notification, as Adyen would. It is used for
+// running the webhook locally.
+func SignAdyenNotification(payload []byte, hmacKey string) ([]byte, error) {
+	var notification adyenNotification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return nil, fmt.Errorf("SignAdyenNotification: %w", err)
+	}
+	for i := range notification.NotificationItems {
+		item := &notification.NotificationItems[i].Item
+		signature, err := item.signature(hmacKey)
+		if err != nil {
+			return nil, fmt.Errorf("SignAdyenNotification: %w", err)
+		}
+		if item.AdditionalData == nil {
+			item.AdditionalData = map[string]string{}
+		}
+		item.AdditionalData["hmacSignature"] = signature
+	}
+	return json.Marshal(notification)
+}
+
+// newReference returns a random merchant reference for a payment.
+func newReference() string {
+	return "dep_" + randomHex(12)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,354 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestAdyen starts a fake and returns an adapter pointed at it. The fake is stopped when the test ends.
+func newTestAdyen(t *testing.T) (*AdyenProvider, *adyenFake) {
+	t.Helper()
+	fake := newAdyenFake()
+	t.Cleanup(fake.Close)
+	return NewAdyen(fake.Config), fake
+}
+
+// createPayment creates a payment with a stored payment method and fails the test if it errors.
+func createPayment(t *testing.T, p *AdyenProvider, paymentMethodID string, manualCapture bool) *Intent {
+	t.Helper()
+	intent, err := p.CreateIntent(context.Background(), &IntentParams{
+		UserID:          "user_1",
+		Amount:          5000,
+		Currency:        "eur",
+		PaymentMethodID: paymentMethodID,
+		Confirm:         true,
+		ManualCapture:   manualCapture,
+	})
+	if err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	return intent
+}
+
+// parseNotification has the fake send a notification for a payment and parses it, expecting a single event.
+func parseNotification(t *testing.T, p *AdyenProvider, fake *adyenFake, pspReference, eventCode string, success bool) *WebhookEvent {
+	t.Helper()
+	payload, err := fake.Notification(pspReference, eventCode, success)
+	if err != nil {
+		t.Fatalf("Notification: %v", err)
+	}
+	parsed, err := p.ParseWebhook(payload, nil)
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+	if len(parsed) != 1 {
+		t.Fatalf("ParseWebhook returned %d events, want 1", len(parsed))
+	}
+	return parsed[0]
+}
+
+func TestAdyenCreateIntent(t *testing.T) {
+	p, _ := newTestAdyen(t)
+
+	tests := []struct {
+		name            string
+		paymentMethodID string
+		manualCapture   bool
+		want            IntentStatus
+	}{
+		{"authorised", "pm_card", false, StatusSucceeded},
+		{"manual capture", "pm_card", true, StatusRequiresCapture},
+		{"declined", fakeDeclined, false, StatusFailed},
+		{"3D Secure", fakeRedirect, false, StatusRequiresAction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			intent := createPayment(t, p, tt.paymentMethodID, tt.manualCapture)
+			if intent.Status != tt.want {
+				t.Errorf("Status = %s, want %s", intent.Status, tt.want)
+			}
+			if intent.ID == "" || intent.Provider != Adyen || intent.Amount != 5000 || intent.Currency != "eur" {
+				t.Errorf("intent = %+v, want an Adyen payment of 5000 eur", intent)
+			}
+		})
+	}
+}
+
+func TestAdyenCreateIntentSession(t *testing.T) {
+	p, _ := newTestAdyen(t)
+
+	intent, err := p.CreateIntent(context.Background(), &IntentParams{UserID: "user_1", Amount: 5000, Currency: "eur"})
+	if err != nil {
+		t.Fatalf("CreateIntent: %v", err)
+	}
+	if intent.Status != StatusRequiresPaymentMethod || intent.ClientSecret == "" {
+		t.Errorf("intent = %+v, want a session waiting for a payment method", intent)
+	}
+}
+
+func TestAdyenGetIntent(t *testing.T) {
+	p, _ := newTestAdyen(t)
+	intent := createPayment(t, p, "pm_card", false)
+
+	if _, err := p.GetIntent(context.Background(), intent.ID); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("GetIntent: err = %v, want ErrUnsupported", err)
+	}
+	if _, err := p.GetPaymentMethod(context.Background(), "pm_card"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("GetPaymentMethod: err = %v, want ErrUnsupported", err)
+	}
+	if _, err := p.ListIntents(context.Background(), &ListParams{}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("ListIntents: err = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestAdyenConfirmIntent(t *testing.T) {
+	p, _ := newTestAdyen(t)
+	created := createPayment(t, p, fakeRedirect, false)
+
+	intent, err := p.ConfirmIntent(context.Background(), &ConfirmParams{IntentID: created.ID, Details: map[string]string{"redirectResult": created.ID}})
+	if err != nil {
+		t.Fatalf("ConfirmIntent: %v", err)
+	}
+	if intent.ID != created.ID || intent.Status != StatusSucceeded || intent.UserID != "user_1" {
+		t.Errorf("intent = %+v, want %s authorised for user_1", intent, created.ID)
+	}
+
+	if _, err := p.ConfirmIntent(context.Background(), &ConfirmParams{IntentID: created.ID}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("ConfirmIntent without details: err = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestAdyenCaptureIntent(t *testing.T) {
+	p, fake := newTestAdyen(t)
+	ctx := context.Background()
+	intent := createPayment(t, p, "pm_card", true)
+
+	captured, err := p.CaptureIntent(ctx, &CaptureParams{IntentID: intent.ID, Amount: 5000, Currency: "eur"})
+	if err != nil {
+		t.Fatalf("CaptureIntent: %v", err)
+	}
+	if captured.ID != intent.ID || captured.Status != StatusProcessing {
+		t.Errorf("captured = %+v, want %s processing", captured, intent.ID)
+	}
+
+	if _, err := p.CaptureIntent(ctx, &CaptureParams{IntentID: intent.ID}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("CaptureIntent without an amount: err = %v, want ErrUnsupported", err)
+	}
+	if _, err := p.CaptureIntent(ctx, &CaptureParams{IntentID: "MISSING", Amount: 5000, Currency: "eur"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("CaptureIntent of an unknown payment: err = %v, want ErrNotFound", err)
+	}
+
+	event := parseNotification(t, p, fake, intent.ID, "CAPTURE", true)
+	if event.IntentID != intent.ID || event.Type != "payment_intent.succeeded" {
+		t.Errorf("CAPTURE event = %s for %s, want payment_intent.succeeded for %s", event.Type, event.IntentID, intent.ID)
+	}
+}
+
+func TestAdyenCancelIntent(t *testing.T) {
+	p, fake := newTestAdyen(t)
+	ctx := context.Background()
+	intent := createPayment(t, p, "pm_card", true)
+
+	canceled, err := p.CancelIntent(ctx, &CancelParams{IntentID: intent.ID, Reason: "fraudulent"})
+	if err != nil {
+		t.Fatalf("CancelIntent: %v", err)
+	}
+	if canceled.ID != intent.ID || canceled.Status != StatusProcessing {
+		t.Errorf("canceled = %+v, want %s processing", canceled, intent.ID)
+	}
+
+	declined := createPayment(t, p, fakeDeclined, true)
+	if _, err := p.CancelIntent(ctx, &CancelParams{IntentID: declined.ID}); err == nil {
+		t.Error("CancelIntent of a refused payment succeeded")
+	}
+
+	event := parseNotification(t, p, fake, intent.ID, "CANCELLATION", true)
+	if event.IntentID != intent.ID || event.Type != "payment_intent.canceled" {
+		t.Errorf("CANCELLATION event = %s for %s, want payment_intent.canceled for %s", event.Type, event.IntentID, intent.ID)
+	}
+}
+
+func TestAdyenParseWebhook(t *testing.T) {
+	p, fake := newTestAdyen(t)
+	automatic := createPayment(t, p, "pm_card", false)
+	manual := createPayment(t, p, "pm_card", true)
+	if _, err := p.CaptureIntent(context.Background(), &CaptureParams{IntentID: manual.ID, Amount: 5000, Currency: "eur"}); err != nil {
+		t.Fatalf("CaptureIntent: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		intent    *Intent
+		eventCode string
+		success   bool
+		want      string
+	}{
+		{"authorisation", automatic, "AUTHORISATION", true, "payment_intent.succeeded"},
+		{"refused authorisation", automatic, "AUTHORISATION", false, "payment_intent.payment_failed"},
+		{"manual authorisation", manual, "AUTHORISATION", true, "payment_intent.amount_capturable_updated"},
+		{"capture", manual, "CAPTURE", true, "payment_intent.succeeded"},
+		{"failed capture", manual, "CAPTURE_FAILED", true, "payment_intent.payment_failed"},
+		{"cancellation", manual, "CANCELLATION", true, "payment_intent.canceled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := parseNotification(t, p, fake, tt.intent.ID, tt.eventCode, tt.success)
+			if event.Type != tt.want {
+				t.Errorf("Type = %s, want %s", event.Type, tt.want)
+			}
+			// Modifications have their own pspReference, but the event is about the payment
+			if event.IntentID != tt.intent.ID {
+				t.Errorf("IntentID = %s, want %s", event.IntentID, tt.intent.ID)
+			}
+			if event.UserID != "user_1" || event.Amount != 5000 || event.Currency != "eur" {
+				t.Errorf("event = %+v, want 5000 eur for user_1", event)
+			}
+		})
+	}
+
+	// Every notification of a payment is a separate event
+	authorisation := parseNotification(t, p, fake, manual.ID, "AUTHORISATION", true)
+	capture := parseNotification(t, p, fake, manual.ID, "CAPTURE", true)
+	if authorisation.ID == capture.ID {
+		t.Errorf("AUTHORISATION and CAPTURE share the event ID %s", capture.ID)
+	}
+}
+
+func TestAdyenRefundNotification(t *testing.T) {
+	p, fake := newTestAdyen(t)
+	refunded := createPayment(t, p, "pm_card", false)
+	if _, err := p.Refund(context.Background(), &RefundParams{IntentID: refunded.ID, Amount: 2000, Currency: "eur"}); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	canceled := createPayment(t, p, "pm_card", true)
+
+	tests := []struct {
+		name      string
+		intent    *Intent
+		eventCode string
+		success   bool
+		want      string // Event type, or "" if the notification is left out
+	}{
+		{"refund", refunded, "REFUND", true, "charge.refunded"},
+		{"refused refund", refunded, "REFUND", false, ""},
+		{"failed refund", refunded, "REFUND_FAILED", true, ""},
+		{"cancel or refund, refunded", refunded, "CANCEL_OR_REFUND", true, "charge.refunded"},
+		{"cancel or refund, canceled", canceled, "CANCEL_OR_REFUND", true, "payment_intent.canceled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := fake.Notification(tt.intent.ID, tt.eventCode, tt.success)
+			if err != nil {
+				t.Fatalf("Notification: %v", err)
+			}
+			parsed, err := p.ParseWebhook(payload, nil)
+			if err != nil {
+				t.Fatalf("ParseWebhook: %v", err)
+			}
+			if tt.want == "" {
+				if len(parsed) != 0 {
+					t.Errorf("ParseWebhook returned %s, want nothing", parsed[0].Type)
+				}
+				return
+			}
+			if len(parsed) != 1 || parsed[0].Type != tt.want {
+				t.Fatalf("ParseWebhook returned %d events, want one %s", len(parsed), tt.want)
+			}
+			if tt.want != "charge.refunded" {
+				return
+			}
+
+			// The worker reads the refund as a charge of the payment
+			var event struct {
+				Data struct {
+					Object struct {
+						AmountRefunded int64             `json:"amount_refunded"`
+						PaymentIntent  string            `json:"payment_intent"`
+						Metadata       map[string]string `json:"metadata"`
+					} `json:"object"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(parsed[0].Payload, &event); err != nil {
+				t.Fatalf("error decoding payload: %v", err)
+			}
+			charge := event.Data.Object
+			if charge.PaymentIntent != refunded.ID || charge.AmountRefunded != 2000 || charge.Metadata["UserID"] != "user_1" {
+				t.Errorf("charge = %+v, want 2000 refunded of %s for user_1", charge, refunded.ID)
+			}
+		})
+	}
+}
+
+func TestAdyenParseWebhookSignature(t *testing.T) {
+	p, fake := newTestAdyen(t)
+	intent := createPayment(t, p, "pm_card", false)
+
+	payload, err := fake.Notification(intent.ID, "AUTHORISATION", true)
+	if err != nil {
+		t.Fatalf("Notification: %v", err)
+	}
+	var notification adyenNotification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		t.Fatalf("error decoding notification: %v", err)
+	}
+	notification.NotificationItems[0].Item.Amount.Value = 1
+	tampered, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatalf("error encoding notification: %v", err)
+	}
+
+	if _, err := p.ParseWebhook(tampered, nil); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("ParseWebhook of a tampered notification: err = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestAdyenPostErrors(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status == 0 {
+			// Never answer in time
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"status":` + strconv.Itoa(status) + `,"errorCode":"test","message":"test"}`))
+	}))
+	defer server.Close()
+	p := NewAdyen(AdyenConfig{BaseURL: server.URL})
+	p.client.Timeout = 50 * time.Millisecond
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	unreachable := NewAdyen(AdyenConfig{BaseURL: closed.URL})
+
+	tests := []struct {
+		name     string
+		provider *AdyenProvider
+		status   int
+		want     error
+	}{
+		{"connection refused", unreachable, http.StatusOK, ErrProviderUnavailable},
+		{"rate limited", p, http.StatusTooManyRequests, ErrProviderUnavailable},
+		{"server error", p, http.StatusInternalServerError, ErrOutcomeUnknown},
+		{"timeout", p, 0, ErrOutcomeUnknown},
+		{"not found", p, http.StatusNotFound, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			_, err := tt.provider.post(context.Background(), "/payments", "", map[string]string{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want != ErrProviderUnavailable && errors.Is(err, ErrProviderUnavailable) {
+				t.Errorf("err = %v, which would fail the payment over", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stored payment method IDs the fake treats specially. Any other ID is authorised.
+const (
+	fakeDeclined = "fake_declined" // Refused
+	fakeRedirect = "fake_3ds"      // Asks for a 3D Secure redirect; /payments/details then authorises it
+)
+
+// adyenFake is a stand-in for the Adyen Checkout API that the tests run the Adyen adapter against. It keeps payments
+// in memory and can sign notifications for them. For a redirect, the fake's redirectResult is the payment's
+// pspReference.
+type adyenFake struct {
+	Config AdyenConfig // Points an AdyenProvider at the fake
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+}
+
+type fakePayment struct {
+	PSPReference  string
+	Reference     string
+	Amount        adyenAmount
+	UserID        string
+	PaymentMethod string // Reported in notifications, e.g. "visa" or "applepay"
+	CaptureMethod string // "manual" for payments captured later, passed back in notifications like Adyen does
+	ResultCode    string
+
+	// pspReferences of the modifications requested for the payment, by the event code of their notification
+	Modifications map[string]string
+	Refunded      adyenAmount // Amount of the last refund, which its REFUND notification reports
+}
+
+// newAdyenFake starts a fake with a random API key and HMAC key.
+func newAdyenFake() *adyenFake {
+	f := &adyenFake{payments: map[string]*fakePayment{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.Config = AdyenConfig{
+		APIKey:          "fake_" + randomHex(8),
+		MerchantAccount: "BetchyaLocal",
+		HMACKey:         randomHex(32),
+		BaseURL:         f.server.URL,
+		ReturnURL:       "http://localhost/return",
+	}
+	return f
+}
+
+// Close stops the fake's server.
+func (f *adyenFake) Close() {
+	f.server.Close()
+}
+
+func (f *adyenFake) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fakeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.Header.Get("X-API-Key") != f.Config.APIKey {
+		fakeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	var request struct {
+		Amount        adyenAmount       `json:"amount"`
+		Reference     string            `json:"reference"`
+		Metadata      map[string]string `json:"metadata"`
+		PaymentMethod map[string]string `json:"paymentMethod"`
+		Details       map[string]string `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		fakeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case path == "/sessions":
+		writeFake(w, map[string]interface{}{
+			"id":          "CS" + strings.ToUpper(randomHex(8)),
+			"sessionData": "fake-session-" + randomHex(16),
+			"amount":      request.Amount,
+			"reference":   request.Reference,
+			"expiresAt":   time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+
+	case path == "/payments":
+		payment := &fakePayment{
+			PSPReference:  fakePSPReference(),
+			Reference:     request.Reference,
+			Amount:        request.Amount,
+			UserID:        request.Metadata["UserID"],
+			PaymentMethod: "visa",
+			CaptureMethod: request.Metadata["CaptureMethod"],
+			ResultCode:    "Authorised",
+			Modifications: map[string]string{},
+		}
+		if paymentMethodType := request.PaymentMethod["type"]; paymentMethodType != "scheme" {
+			// Wallets are authorised whatever their token
+			payment.PaymentMethod = paymentMethodType
+		}
+		response := map[string]interface{}{}
+		switch request.PaymentMethod["storedPaymentMethodId"] {
+		case fakeDeclined:
+			payment.ResultCode = "Refused"
+			response["refusalReason"] = "Refused"
+		case fakeRedirect:
+			payment.ResultCode = "RedirectShopper"
+			response["action"] = map[string]string{
+				"type":              "redirect",
+				"paymentMethodType": "scheme",
+				"method":            "GET",
+				"url":               f.server.URL + "/3ds?redirectResult=" + payment.PSPReference,
+			}
+		}
+		f.payments[payment.PSPReference] = payment
+		response["pspReference"] = payment.PSPReference
+		response["merchantReference"] = payment.Reference
+		response["resultCode"] = payment.ResultCode
+		response["amount"] = payment.Amount
+		writeFake(w, response)
+
+	case path == "/payments/details":
+		payment, ok := f.payments[request.Details["redirectResult"]]
+		if !ok {
+			fakeError(w, http.StatusUnprocessableEntity, "unknown redirectResult")
+			return
+		}
+		if payment.ResultCode == "RedirectShopper" {
+			payment.ResultCode = "Authorised"
+		}
+		writeFake(w, map[string]interface{}{
+			"pspReference":      payment.PSPReference,
+			"merchantReference": payment.Reference,
+			"resultCode":        payment.ResultCode,
+			"amount":            payment.Amount,
+			"additionalData":    map[string]string{"shopperReference": payment.UserID},
+		})
+
+	case strings.HasPrefix(path, "/payments/") && (strings.HasSuffix(path, "/captures") || strings.HasSuffix(path, "/cancels")):
+		parts := strings.Split(strings.TrimPrefix(path, "/payments/"), "/")
+		payment, ok := f.payments[parts[0]]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "payment "+parts[0]+" not found")
+			return
+		}
+		if payment.ResultCode != "Authorised" {
+			fakeError(w, http.StatusUnprocessableEntity, "payment "+parts[0]+" is "+payment.ResultCode)
+			return
+		}
+		if parts[1] == "captures" && request.Amount.Value > payment.Amount.Value {
+			fakeError(w, http.StatusUnprocessableEntity, "capture exceeds the authorisation")
+			return
+		}
+		eventCode := "CAPTURE"
+		if parts[1] == "cancels" {
+			eventCode = "CANCELLATION"
+		}
+		modification := fakePSPReference()
+		payment.Modifications[eventCode] = modification
+		writeFake(w, map[string]interface{}{
+			"pspReference":        modification,
+			"paymentPspReference": payment.PSPReference,
+			"reference":           request.Reference,
+			"status":              "received",
+		})
+
+	case strings.HasPrefix(path, "/payments/") && strings.HasSuffix(path, "/refunds"):
+		pspReference := strings.TrimSuffix(strings.TrimPrefix(path, "/payments/"), "/refunds")
+		payment, ok := f.payments[pspReference]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "payment "+pspReference+" not found")
+			return
+		}
+		if request.Amount.Value > payment.Amount.Value {
+			fakeError(w, http.StatusUnprocessableEntity, "refund exceeds the payment")
+			return
+		}
+		modification := fakePSPReference()
+		payment.Modifications["REFUND"] = modification
+		payment.Refunded = request.Amount
+		writeFake(w, map[string]interface{}{
+			"pspReference":        modification,
+			"paymentPspReference": payment.PSPReference,
+			"reference":           request.Reference,
+			"amount":              request.Amount,
+			"status":              "received",
+		})
+
+	default:
+		fakeError(w, http.StatusNotFound, "unknown endpoint "+path)
+	}
+}
+
+// Notification returns a signed notification of eventCode ("AUTHORISATION", "CANCELLATION", ...) for a payment the
+// fake took, as Adyen would post it to the webhook. Like Adyen's, a notification of a modification carries the
+// modification's own pspReference, and the payment's as the originalReference.
+func (f *adyenFake) Notification(pspReference, eventCode string, success bool) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	payment, ok := f.payments[pspReference]
+	if !ok {
+		return nil, fmt.Errorf("Notification: payment %s: %w", pspReference, ErrNotFound)
+	}
+
+	item := adyenNotificationItem{
+		AdditionalData:      map[string]string{"metadata.UserID": payment.UserID, "shopperReference": payment.UserID},
+		Amount:              payment.Amount,
+		EventCode:           eventCode,
+		EventDate:           time.Now().UTC().Format(time.RFC3339),
+		MerchantAccountCode: f.Config.MerchantAccount,
+		MerchantReference:   payment.Reference,
+		PSPReference:        payment.PSPReference,
+		PaymentMethod:       payment.PaymentMethod,
+		Success:             fmt.Sprint(success),
+	}
+	if adyenModifications[eventCode] {
+		item.OriginalReference = payment.PSPReference
+		item.PSPReference = payment.Modifications[strings.TrimSuffix(eventCode, "_FAILED")]
+		if item.PSPReference == "" {
+			item.PSPReference = fakePSPReference()
+		}
+	}
+	if payment.CaptureMethod != "" {
+		item.AdditionalData["metadata.CaptureMethod"] = payment.CaptureMethod
+	}
+	refunded := payment.Modifications["REFUND"] != ""
+	if eventCode == "REFUND" || eventCode == "REFUND_FAILED" || eventCode == "CANCEL_OR_REFUND" && refunded {
+		item.Amount = payment.Refunded
+	}
+	if eventCode == "CANCEL_OR_REFUND" {
+		// Adyen refunds a captured payment and cancels any other, and says which it did
+		item.AdditionalData["modification.action"] = "cancel"
+		if refunded {
+			item.AdditionalData["modification.action"] = "refund"
+			item.PSPReference = payment.Modifications["REFUND"]
+		}
+	}
+	notification := map[string]interface{}{
+		"live":              "false",
+		"notificationItems": []interface{}{map[string]interface{}{"NotificationRequestItem": item}},
+	}
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	return SignAdyenNotification(payload, f.Config.HMACKey)
+}
+
+func writeFake(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func fakeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(adyenError{Status: status, ErrorCode: "fake", Message: message})
+}
+
+// fakePSPReference returns a 16 character reference like Adyen's.
+func fakePSPReference() string {
+	return strings.ToUpper(randomHex(8))
+}
@@ -0,0 +1,316 @@
+// Package payments hides the payment service provider (PSP) behind the PaymentProvider interface, so a deposit can
+// be taken by Stripe or Adyen depending on configuration. Amounts are in minor units (cents) and currencies are
+// lower case ISO codes, whichever provider is used.
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ProviderName identifies a payment service provider.
+type ProviderName string
+
+const (
+	Stripe ProviderName = "stripe"
+	Adyen  ProviderName = "adyen"
+)
+
+var (
+	// ErrNotFound is returned when the provider has no customer or payment with the given ID.
+	ErrNotFound = errors.New("not found")
+	// ErrUnsupported is returned for operations the provider has no equivalent of.
+	ErrUnsupported = errors.New("not supported by this provider")
+	// ErrInvalidSignature is returned by ParseWebhook when a notification is not signed with the expected secret.
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrProviderUnavailable is matched by errors.Is when the provider could not be connected to, rate limited the
+	// request or reports a processor error. The payment definitely wasn't made, so the Router retries it with another
+	// provider.
+	ErrProviderUnavailable = errors.New("payment provider unavailable")
+	// ErrOutcomeUnknown is matched by errors.Is when the request may have reached the provider but no answer came
+	// back: a timeout, a dropped connection or a server error. The payment may have been made, so it must not be
+	// retried with another provider; its webhook event reports the outcome if it was.
+	ErrOutcomeUnknown = errors.New("payment outcome unknown")
+	// ErrUnexpectedState is matched by errors.Is when a payment can't be captured or canceled in its current state,
+	// for example because it has succeeded already.
+	ErrUnexpectedState = errors.New("payment is not in a state that allows this")
+	// ErrAuthenticationRequired is matched by errors.Is when the bank declined an off-session payment until the user
+	// authenticates it. The error is an *IntentError naming the payment, which is left for an on-session confirmation.
+	ErrAuthenticationRequired = errors.New("payment requires authentication")
+)
+
+// IntentError is an error about a payment the provider created, such as one declined with ErrAuthenticationRequired.
+type IntentError struct {
+	IntentID string
+	Err      error
+}
+
+func (e *IntentError) Error() string {
+	return "payment " + e.IntentID + ": " + e.Err.Error()
+}
+
+func (e *IntentError) Unwrap() error {
+	return e.Err
+}
+
+// requestNotSent reports whether a transport error happened before the request was sent, because no connection to
+// the provider could be made. Any other transport error leaves the outcome unknown.
+func requestNotSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Digital wallets a card payment can be made with. A wallet payment is a card payment whose payment method the
+// frontend got from Apple Pay or Google Pay instead of a card form.
+const (
+	WalletApplePay  = "apple_pay"
+	WalletGooglePay = "google_pay"
+)
+
+// IsWallet reports whether a payment method type is one of the wallets.
+func IsWallet(paymentMethodType string) bool {
+	return paymentMethodType == WalletApplePay || paymentMethodType == WalletGooglePay
+}
+
+// IntentStatus is the state of a payment, named after Stripe's payment intent statuses.
+type IntentStatus string
+
+const (
+	StatusRequiresPaymentMethod IntentStatus = "requires_payment_method"
+	StatusRequiresConfirmation  IntentStatus = "requires_confirmation"
+	StatusRequiresAction        IntentStatus = "requires_action"
+	StatusRequiresCapture       IntentStatus = "requires_capture" // Authorised, waiting for CaptureIntent
+	StatusProcessing            IntentStatus = "processing"
+	StatusSucceeded             IntentStatus = "succeeded"
+	StatusCanceled              IntentStatus = "canceled"
+	StatusFailed                IntentStatus = "failed"
+)
+
+// Customer is the provider's record of a user.
+type Customer struct {
+	ID     string
+	UserID string
+	Email  string
+	Name   string
+}
+
+// CustomerParams describes a customer to create.
+type CustomerParams struct {
+	UserID string
+	Email  string
+	Name   string
+}
+
+// IntentParams describes a payment to create.
+type IntentParams struct {
+	UserID            string // Stored with the payment, so the webhook can credit the right user
+	CustomerID        string // Customer at the provider, if it keeps customer records
+	Amount            int64
+	Currency          string
+	PaymentMethodID   string // Saved or tokenized payment method, or a wallet token; empty to collect it on the frontend
+	PaymentMethodType string // "card" (the default), "us_bank_account", or a wallet: "apple_pay" or "google_pay"
+	SaveForFutureUse  bool   // Keep the payment method for off-session charges
+	OffSession        bool   // The user is not present, e.g. a scheduled deposit
+	Confirm           bool   // Confirm the payment right away
+	ManualCapture     bool   // Only authorise the payment; it is captured or canceled later
+	IdempotencyKey    string
+
+	// Metadata is kept with the payment next to the UserID, e.g. the job that made it.
+	Metadata map[string]string
+	// ManualConfirmation leaves a payment that needs authentication to be confirmed again with ConfirmIntent,
+	// instead of by the frontend. Stripe only.
+	ManualConfirmation bool
+
+	// AutomaticPaymentMethods lets the provider offer every payment method enabled for the account, wallets
+	// included, instead of PaymentMethodType. Only for payment methods collected on the frontend.
+	AutomaticPaymentMethods bool
+}
+
+// Intent is a payment at the provider. ClientSecret is handed to the frontend to collect or authenticate the
+// payment method there.
+type Intent struct {
+	ID           string
+	Provider     ProviderName
+	Amount       int64
+	Currency     string
+	Status       IntentStatus
+	ClientSecret string
+	UserID       string
+	CustomerID   string // Customer at the provider the payment was made for, if it keeps customer records
+	Wallet       string // Wallet the payment was made with, such as WalletApplePay, once it is known
+}
+
+// ConfirmParams confirms a payment. Details carries what the frontend got back from an authentication step, such
+// as a 3D Secure redirect result; it is empty for a plain confirmation.
+type ConfirmParams struct {
+	IntentID        string
+	Details         map[string]string
+	PaymentMethodID string // Payment method to confirm with instead of the payment's own. Stripe only.
+}
+
+// CaptureParams captures an authorised payment. Amount and Currency are the amount to capture; Stripe can leave
+// them empty to capture the whole authorisation, but Adyen always needs them.
+type CaptureParams struct {
+	IntentID       string
+	Amount         int64
+	Currency       string
+	IdempotencyKey string
+}
+
+// CancelParams cancels a payment that has not been captured. Reason is one of Stripe's cancellation reasons:
+// "abandoned", "duplicate", "fraudulent" or "requested_by_customer".
+type CancelParams struct {
+	IntentID string
+	Reason   string
+}
+
+// RefundParams refunds a payment. A zero Amount refunds it in full.
+type RefundParams struct {
+	IntentID       string
+	Amount         int64
+	Currency       string
+	Reason         string
+	IdempotencyKey string
+}
+
+// Refund is a refund at the provider. Status is "pending", "succeeded" or "failed". Charge is the charge it refunded
+// when the refund was listed with ListRefunds.
+type Refund struct {
+	ID       string
+	IntentID string
+	Amount   int64
+	Currency string
+	Status   string
+	Charge   *Charge
+}
+
+// Charge is an attempt to collect a payment. IntentID is empty for a charge made without a payment intent. Status is
+// "pending", "succeeded" or "failed", and Refunded is set once the charge is refunded in full.
+type Charge struct {
+	ID             string
+	IntentID       string
+	Amount         int64
+	AmountRefunded int64
+	Refunded       bool
+	Status         string
+}
+
+// PaymentMethod is a payment method saved at the provider. CustomerID is empty when it is not saved on a customer.
+type PaymentMethod struct {
+	ID         string
+	CustomerID string
+	Type       string
+}
+
+// ListParams selects the objects created within [CreatedFrom, CreatedTo).
+type ListParams struct {
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+}
+
+// WebhookEvent is a verified notification from the provider. Type uses the Stripe event names the webhook worker
+// dispatches on, such as "payment_intent.succeeded", so it handles every provider's events alike. Payload is the
+// event as the worker reads it: Stripe's own body, or an equivalent event built from another provider's notification.
+type WebhookEvent struct {
+	ID       string
+	Provider ProviderName
+	Type     string
+	Created  int64
+	IntentID string
+	Amount   int64
+	Currency string
+	UserID   string
+	Wallet   string
+	Payload  []byte
+}
+
+// PaymentProvider takes payments through one payment service provider.
+type PaymentProvider interface {
+	// Name returns the provider's name.
+	Name() ProviderName
+	// CreateCustomer registers a user with the provider.
+	CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error)
+	// GetCustomer returns the customer with the given ID, or ErrNotFound.
+	GetCustomer(ctx context.Context, customerID string) (*Customer, error)
+	// CreateIntent starts a payment, and confirms it if params.Confirm is set.
+	CreateIntent(ctx context.Context, params *IntentParams) (*Intent, error)
+	// GetIntent returns the payment with the given ID, or ErrNotFound. Providers that can't look payments up
+	// return ErrUnsupported.
+	GetIntent(ctx context.Context, intentID string) (*Intent, error)
+	// ConfirmIntent confirms a payment, or completes its authentication.
+	ConfirmIntent(ctx context.Context, params *ConfirmParams) (*Intent, error)
+	// CaptureIntent captures a payment created with ManualCapture.
+	CaptureIntent(ctx context.Context, params *CaptureParams) (*Intent, error)
+	// CancelIntent cancels a payment that has not been captured, releasing its authorisation.
+	CancelIntent(ctx context.Context, params *CancelParams) (*Intent, error)
+	// Refund refunds all or part of a payment.
+	Refund(ctx context.Context, params *RefundParams) (*Refund, error)
+	// GetPaymentMethod returns the saved payment method with the given ID, or ErrNotFound. Providers that don't
+	// expose saved payment methods return ErrUnsupported.
+	GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error)
+	// ListIntents, ListCharges and ListRefunds return the payments, charges and refunds created in a time range, for
+	// reconciliation. Providers that can't list them return ErrUnsupported.
+	ListIntents(ctx context.Context, params *ListParams) ([]*Intent, error)
+	ListCharges(ctx context.Context, params *ListParams) ([]*Charge, error)
+	ListRefunds(ctx context.Context, params *ListParams) ([]*Refund, error)
+	// ParseWebhook verifies a notification and returns the events it carries. A provider may leave out events
+	// the worker has no use for.
+	ParseWebhook(payload []byte, headers map[string]string) ([]*WebhookEvent, error)
+}
+
+// eventPayload builds the Stripe-shaped event the worker reads from a normalized event. The provider and the wallet
+// are passed in the metadata, next to the UserID, so the worker records them on the transaction. A "charge.refunded"
+// object is shaped like a charge of the payment, whose amount_refunded is the event's Amount. Its amount, the amount
+// charged, is left at 0 because Adyen doesn't report it, so the worker compares the refund with the deposit instead.
+func eventPayload(event *WebhookEvent) ([]byte, error) {
+	type object struct {
+		ID             string            `json:"id"`
+		Amount         int64             `json:"amount"`
+		AmountRefunded int64             `json:"amount_refunded,omitempty"`
+		PaymentIntent  string            `json:"payment_intent,omitempty"`
+		Currency       string            `json:"currency"`
+		Metadata       map[string]string `json:"metadata"`
+	}
+	envelope := struct {
+		ID      string `json:"id"`
+		Type    string `json:"type"`
+		Created int64  `json:"created"`
+		Data    struct {
+			Object object `json:"object"`
+		} `json:"data"`
+	}{ID: event.ID, Type: event.Type, Created: event.Created}
+	envelope.Data.Object = object{
+		ID:       event.IntentID,
+		Amount:   event.Amount,
+		Currency: event.Currency,
+		Metadata: map[string]string{"UserID": event.UserID, "Provider": string(event.Provider)},
+	}
+	if event.Wallet != "" {
+		envelope.Data.Object.Metadata["Wallet"] = event.Wallet
+	}
+	if event.Type == "charge.refunded" {
+		envelope.Data.Object.ID = event.ID
+		envelope.Data.Object.Amount = 0
+		envelope.Data.Object.AmountRefunded = event.Amount
+		envelope.Data.Object.PaymentIntent = event.IntentID
+	}
+	return json.Marshal(envelope)
+}
+
+// header returns a request header, whichever case API Gateway passed its name in.
+func header(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(name) {
+			return value
+		}
+	}
+	return ""
+}
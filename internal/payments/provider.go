@@ -0,0 +1,48 @@
+package payments
+
+import "fmt"
+
+// SSM parameters of the providers
+const (
+	ProviderParam             = "/application/dev/payment_provider"
+	stripeKeyParam            = "/application/dev/stripe_key"
+	adyenAPIKeyParam          = "/application/dev/adyen_api_key"
+	adyenMerchantAccountParam = "/application/dev/adyen_merchant_account"
+	adyenBaseURLParam         = "/application/dev/adyen_base_url"
+	adyenReturnURLParam       = "/application/dev/adyen_return_url"
+)
+
+// GetParameter reads an SSM parameter, such as the getParameter of every Lambda bound to its region.
+type GetParameter func(paramName string) (string, error)
+
+// New returns the named provider, configured from its SSM parameters.
+func New(name ProviderName, getParameter GetParameter) (PaymentProvider, error) {
+	switch name {
+	case Stripe:
+		key, err := getParameter(stripeKeyParam)
+		if err != nil {
+			return nil, fmt.Errorf("New: %w", err)
+		}
+		return NewStripe(StripeConfig{APIKey: key}), nil
+
+	case Adyen:
+		var cfg AdyenConfig
+		for _, param := range []struct {
+			name  string
+			value *string
+		}{
+			{adyenAPIKeyParam, &cfg.APIKey},
+			{adyenMerchantAccountParam, &cfg.MerchantAccount},
+			{adyenBaseURLParam, &cfg.BaseURL},
+			{adyenReturnURLParam, &cfg.ReturnURL},
+		} {
+			value, err := getParameter(param.name)
+			if err != nil {
+				return nil, fmt.Errorf("New: %w", err)
+			}
+			*param.value = value
+		}
+		return NewAdyen(cfg), nil
+	}
+	return nil, fmt.Errorf("New: unknown payment provider %q", name)
+}
@@ -0,0 +1,199 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// RoutingParam is the SSM parameter holding the RoutingConfig as JSON.
+const RoutingParam = "/application/dev/payment_routing"
+
+// Rule routes the deposits it matches to Provider. Empty fields match every deposit. Amounts are in cents, and a
+// zero MaxAmount has no upper bound.
+type Rule struct {
+	Provider   ProviderName   `json:"provider"`
+	Currencies []string       `json:"currencies,omitempty"` // Lower case ISO codes, e.g. "usd"
+	MinAmount  int64          `json:"min_amount,omitempty"`
+	MaxAmount  int64          `json:"max_amount,omitempty"`
+	Regions    []string       `json:"regions,omitempty"`   // ISO country codes of the user, e.g. "US"
+	CardBINs   []string       `json:"card_bins,omitempty"` // Prefixes of the card number
+	Fallbacks  []ProviderName `json:"fallbacks,omitempty"` // Replace the default fallbacks for deposits of this rule
+}
+
+// RoutingConfig picks the provider of a deposit: the first matching rule wins, and Default takes the deposits no
+// rule matches. When the chosen provider is unavailable, the deposit fails over to the Fallbacks in order.
+type RoutingConfig struct {
+	Default   ProviderName   `json:"default"`
+	Fallbacks []ProviderName `json:"fallbacks,omitempty"`
+	Rules     []Rule         `json:"rules,omitempty"`
+}
+
+// Deposit is what the rules route on. Provider pins the deposit to one provider, for a payment method that was
+// collected by it: a payment method can't be charged by another provider, so such deposits are not failed over.
+type Deposit struct {
+	Currency string
+	Amount   int64
+	Region   string
+	CardBIN  string
+	Provider ProviderName
+}
+
+func (r *Rule) matches(d Deposit) bool {
+	if len(r.Currencies) > 0 && !containsFold(r.Currencies, d.Currency) {
+		return false
+	}
+	if d.Amount < r.MinAmount || (r.MaxAmount > 0 && d.Amount > r.MaxAmount) {
+		return false
+	}
+	if len(r.Regions) > 0 && !containsFold(r.Regions, d.Region) {
+		return false
+	}
+	if len(r.CardBINs) > 0 {
+		matched := false
+		for _, bin := range r.CardBINs {
+			if d.CardBIN != "" && strings.HasPrefix(d.CardBIN, bin) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router routes deposits to providers by a RoutingConfig and fails them over when a provider is unavailable.
+// Providers are opened the first time a deposit is routed to them.
+type Router struct {
+	config RoutingConfig
+	open   func(name ProviderName) (PaymentProvider, error)
+
+	mu        sync.Mutex
+	providers map[ProviderName]PaymentProvider
+}
+
+// NewRouter returns a Router that opens providers with open, such as New bound to a getParameter.
+func NewRouter(config RoutingConfig, open func(name ProviderName) (PaymentProvider, error)) *Router {
+	return &Router{config: config, open: open, providers: map[ProviderName]PaymentProvider{}}
+}
+
+// OpenRouter returns a Router configured by the payment_routing parameter. Without it every deposit goes to the
+// provider named by payment_provider, with no failover.
+func OpenRouter(getParameter GetParameter) (*Router, error) {
+	open := func(name ProviderName) (PaymentProvider, error) {
+		return New(name, getParameter)
+	}
+
+	var config RoutingConfig
+	raw, err := getParameter(RoutingParam)
+	if err == nil {
+		if err := json.Unmarshal([]byte(raw), &config); err != nil {
+			return nil, fmt.Errorf("OpenRouter: invalid %s: %w", RoutingParam, err)
+		}
+	} else {
+		name, err := getParameter(ProviderParam)
+		if err != nil {
+			return nil, fmt.Errorf("OpenRouter: %w", err)
+		}
+		config.Default = ProviderName(name)
+	}
+	if config.Default == "" {
+		return nil, fmt.Errorf("OpenRouter: %s has no default provider", RoutingParam)
+	}
+	return NewRouter(config, open), nil
+}
+
+// Default returns the provider of deposits no rule matches.
+func (r *Router) Default() ProviderName {
+	return r.config.Default
+}
+
+// Route returns the providers a deposit is tried with, in order.
+func (r *Router) Route(d Deposit) []ProviderName {
+	if d.Provider != "" {
+		return []ProviderName{d.Provider}
+	}
+
+	primary, fallbacks := r.config.Default, r.config.Fallbacks
+	for i := range r.config.Rules {
+		rule := &r.config.Rules[i]
+		if rule.matches(d) {
+			primary = rule.Provider
+			if rule.Fallbacks != nil {
+				fallbacks = rule.Fallbacks
+			}
+			break
+		}
+	}
+
+	route := []ProviderName{primary}
+	for _, name := range fallbacks {
+		seen := false
+		for _, routed := range route {
+			seen = seen || routed == name
+		}
+		if !seen {
+			route = append(route, name)
+		}
+	}
+	return route
+}
+
+// Provider returns the named provider, opening it if needed.
+func (r *Router) Provider(name ProviderName) (PaymentProvider, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.providers[name]; ok {
+		return p, nil
+	}
+	p, err := r.open(name)
+	if err != nil {
+		return nil, err
+	}
+	r.providers[name] = p
+	return p, nil
+}
+
+// CreateIntent creates the deposit's payment with the first provider of its route, moving on to the next when one
+// is unavailable (ErrProviderUnavailable) or can't be opened. Declines, unknown outcomes (ErrOutcomeUnknown) and
+// other errors are returned as they are, so a card is never charged twice. The returned Intent names the provider that took the payment.
+func (r *Router) CreateIntent(ctx context.Context, d Deposit, params *IntentParams) (*Intent, error) {
+	var errs []error
+	for _, name := range r.Route(d) {
+		provider, err := r.Provider(name)
+		if err != nil {
+			log.Printf("Skipping payment provider %s: %v", name, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		routed := *params
+		if name != Stripe {
+			// Only Stripe keeps customer records
+			routed.CustomerID = ""
+		}
+		intent, err := provider.CreateIntent(ctx, &routed)
+		if errors.Is(err, ErrProviderUnavailable) {
+			log.Printf("Payment provider %s is unavailable, failing over: %v", name, err)
+			errs = append(errs, err)
+			continue
+		}
+		return intent, err
+	}
+	return nil, fmt.Errorf("CreateIntent: no payment provider took the deposit: %w", errors.Join(errs...))
+}
@@ -0,0 +1,71 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newFailingAdyen returns an Adyen adapter whose API answers every request with status.
+func newFailingAdyen(t *testing.T, status int) *AdyenProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return NewAdyen(AdyenConfig{BaseURL: server.URL})
+}
+
+func TestRouterCreateIntentFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		failOver bool
+		want     error
+	}{
+		{"rate limited", http.StatusTooManyRequests, true, nil},
+		{"server error", http.StatusInternalServerError, false, ErrOutcomeUnknown},
+		{"bad request", http.StatusUnprocessableEntity, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newFailingAdyen(t, tt.status)
+			fallback, fake := newTestAdyen(t)
+			router := NewRouter(RoutingConfig{Default: Adyen, Fallbacks: []ProviderName{Stripe}}, func(name ProviderName) (PaymentProvider, error) {
+				if name == Adyen {
+					return primary, nil
+				}
+				return fallback, nil
+			})
+
+			intent, err := router.CreateIntent(context.Background(), Deposit{Currency: "eur", Amount: 5000}, &IntentParams{
+				UserID:          "user_1",
+				Amount:          5000,
+				Currency:        "eur",
+				PaymentMethodID: "pm_card",
+				Confirm:         true,
+			})
+			fake.mu.Lock()
+			charged := len(fake.payments) > 0
+			fake.mu.Unlock()
+
+			if charged != tt.failOver {
+				t.Errorf("fallback charged = %v, want %v", charged, tt.failOver)
+			}
+			if tt.failOver {
+				if err != nil || intent == nil || intent.Status != StatusSucceeded {
+					t.Errorf("CreateIntent = %+v, %v, want the fallback's payment", intent, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("CreateIntent succeeded, want the primary's error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/client"
+	"github.com/stripe/stripe-go/webhook"
+)
+
+// StripeConfig holds the secrets of the Stripe adapter. WebhookSecret is only needed to parse webhooks.
+type StripeConfig struct {
+	APIKey        string
+	WebhookSecret string
+}
+
+// StripeProvider takes payments through Stripe payment intents.
+type StripeProvider struct {
+	api           *client.API
+	webhookSecret string
+}
+
+// NewStripe returns a Stripe adapter using its own client, so it doesn't depend on the global stripe.Key.
+func NewStripe(cfg StripeConfig) *StripeProvider {
+	return &StripeProvider{api: client.New(cfg.APIKey, nil), webhookSecret: cfg.WebhookSecret}
+}
+
+func (p *StripeProvider) Name() ProviderName {
+	return Stripe
+}
+
+// stripeError maps Stripe's "resource_missing" error to ErrNotFound, keeping the original error in the chain. An
+// off-session payment declined with "authentication_required" becomes an *IntentError matching
+// ErrAuthenticationRequired. Connection failures, rate limiting and processing errors, after which nothing was charged, match
+// ErrProviderUnavailable. Timeouts, unreadable responses and API errors match ErrOutcomeUnknown.
+func stripeError(err error) error {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		if requestNotSent(err) {
+			return fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+		}
+		// The request may have reached Stripe, but its response never arrived or could not be read
+		return fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+	}
+	switch {
+	case stripeErr.Code == stripe.ErrorCodeAuthenticationRequired && stripeErr.PaymentIntent != nil:
+		return &IntentError{IntentID: stripeErr.PaymentIntent.ID, Err: fmt.Errorf("%w: %w", ErrAuthenticationRequired, err)}
+	case stripeErr.Code == stripe.ErrorCodeResourceMissing:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState:
+		return fmt.Errorf("%w: %w", ErrUnexpectedState, err)
+	case stripeErr.Type == stripe.ErrorTypeRateLimit,
+		stripeErr.HTTPStatusCode == http.StatusTooManyRequests,
+		stripeErr.Code == stripe.ErrorCodeProcessingError:
+		return fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+	case stripeErr.Type == stripe.ErrorTypeAPI,
+		stripeErr.HTTPStatusCode >= 500:
+		return fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+	}
+	return err
+}
+
+func (p *StripeProvider) CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error) {
+	customerParams := &stripe.CustomerParams{
+		Email: stripe.String(params.Email),
+		Name:  stripe.String(params.Name),
+	}
+	customerParams.Context = ctx
+	// Keep a record of the user ID from the database on the customer
+	customerParams.AddMetadata("UserID", params.UserID)
+
+	c, err := p.api.Customers.New(customerParams)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCustomer: %w", stripeError(err))
+	}
+	return &Customer{ID: c.ID, UserID: params.UserID, Email: c.Email, Name: c.Name}, nil
+}
+
+func (p *StripeProvider) GetCustomer(ctx context.Context, customerID string) (*Customer, error) {
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	c, err := p.api.Customers.Get(customerID, params)
+	if err != nil {
+		return nil, fmt.Errorf("GetCustomer: %w", stripeError(err))
+	}
+	if c.Deleted {
+		return nil, fmt.Errorf("GetCustomer: customer %s was deleted: %w", customerID, ErrNotFound)
+	}
+	return &Customer{ID: c.ID, UserID: c.Metadata["UserID"], Email: c.Email, Name: c.Name}, nil
+}
+
+// CreateIntent creates a payment intent. A payment method to be saved is attached to the customer first. For
+// "us_bank_account" no payment method is given: the bank account is collected and verified on the frontend
+// through Financial Connections. Apple Pay and Google Pay payment methods are card payment methods at Stripe, so
+// wallets only differ from cards in the Wallet recorded on the intent.
+func (p *StripeProvider) CreateIntent(ctx context.Context, params *IntentParams) (*Intent, error) {
+	intentParams := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(params.Amount),
+		Currency: stripe.String(params.Currency),
+	}
+	intentParams.Context = ctx
+	if params.CustomerID != "" {
+		intentParams.Customer = stripe.String(params.CustomerID)
+	}
+	if params.SaveForFutureUse {
+		intentParams.SetupFutureUsage = stripe.String("off_session")
+	}
+	if params.IdempotencyKey != "" {
+		intentParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	for key, value := range params.Metadata {
+		intentParams.AddMetadata(key, value)
+	}
+	intentParams.AddMetadata("UserID", params.UserID)
+
+	if params.AutomaticPaymentMethods && params.PaymentMethodID == "" {
+		// Not modelled by this version of stripe-go
+		intentParams.AddExtra("automatic_payment_methods[enabled]", "true")
+	} else if params.PaymentMethodType == "us_bank_account" {
+		intentParams.PaymentMethodTypes = stripe.StringSlice([]string{"us_bank_account"})
+		// Not modelled by this version of stripe-go
+		intentParams.AddExtra("payment_method_options[us_bank_account][financial_connections][permissions][]", "payment_method")
+		intentParams.AddExtra("payment_method_options[us_bank_account][verification_method]", "automatic")
+	} else if params.PaymentMethodID != "" {
+		if params.SaveForFutureUse && params.CustomerID != "" {
+			// Attach the PaymentMethod to the Customer if not already attached
+			attachParams := &stripe.PaymentMethodAttachParams{Customer: stripe.String(params.CustomerID)}
+			attachParams.Context = ctx
+			if _, err := p.api.PaymentMethods.Attach(params.PaymentMethodID, attachParams); err != nil {
+				return nil, fmt.Errorf("CreateIntent: error attaching payment method: %w", stripeError(err))
+			}
+		}
+		if IsWallet(params.PaymentMethodType) {
+			intentParams.PaymentMethodTypes = stripe.StringSlice([]string{"card"})
+		}
+		intentParams.PaymentMethod = stripe.String(params.PaymentMethodID)
+	}
+	if params.Confirm {
+		intentParams.Confirm = stripe.Bool(true)
+	}
+	if params.OffSession {
+		intentParams.OffSession = stripe.Bool(true)
+	}
+	if params.ManualConfirmation {
+		intentParams.ConfirmationMethod = stripe.String(string(stripe.PaymentIntentConfirmationMethodManual))
+	}
+	if params.ManualCapture {
+		intentParams.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+	}
+
+	pi, err := p.api.PaymentIntents.New(intentParams)
+	if err != nil {
+		return nil, fmt.Errorf("CreateIntent: %w", stripeError(err))
+	}
+	intent := stripeIntent(pi)
+	if intent.Wallet == "" && IsWallet(params.PaymentMethodType) {
+		// Stripe only reports the wallet once the payment is charged
+		intent.Wallet = params.PaymentMethodType
+	}
+	return intent, nil
+}
+
+// GetIntent retrieves a payment intent, with the customer it was created for.
+func (p *StripeProvider) GetIntent(ctx context.Context, intentID string) (*Intent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	pi, err := p.api.PaymentIntents.Get(intentID, params)
+	if err != nil {
+		return nil, fmt.Errorf("GetIntent: %w", stripeError(err))
+	}
+	return stripeIntent(pi), nil
+}
+
+// ConfirmIntent confirms a payment intent. Stripe completes 3D Secure on the frontend, so Details is not used.
+func (p *StripeProvider) ConfirmIntent(ctx context.Context, params *ConfirmParams) (*Intent, error) {
+	confirmParams := &stripe.PaymentIntentConfirmParams{}
+	confirmParams.Context = ctx
+	if params.PaymentMethodID != "" {
+		confirmParams.PaymentMethod = stripe.String(params.PaymentMethodID)
+	}
+	pi, err := p.api.PaymentIntents.Confirm(params.IntentID, confirmParams)
+	if err != nil {
+		return nil, fmt.Errorf("ConfirmIntent: %w", stripeError(err))
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) CaptureIntent(ctx context.Context, params *CaptureParams) (*Intent, error) {
+	captureParams := &stripe.PaymentIntentCaptureParams{}
+	captureParams.Context = ctx
+	if params.Amount > 0 {
+		captureParams.AmountToCapture = stripe.Int64(params.Amount)
+	}
+	if params.IdempotencyKey != "" {
+		captureParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	pi, err := p.api.PaymentIntents.Capture(params.IntentID, captureParams)
+	if err != nil {
+		return nil, fmt.Errorf("CaptureIntent: %w", stripeError(err))
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) CancelIntent(ctx context.Context, params *CancelParams) (*Intent, error) {
+	cancelParams := &stripe.PaymentIntentCancelParams{}
+	cancelParams.Context = ctx
+	if params.Reason != "" {
+		cancelParams.CancellationReason = stripe.String(params.Reason)
+	}
+	pi, err := p.api.PaymentIntents.Cancel(params.IntentID, cancelParams)
+	if err != nil {
+		return nil, fmt.Errorf("CancelIntent: %w", stripeError(err))
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) Refund(ctx context.Context, params *RefundParams) (*Refund, error) {
+	refundParams := &stripe.RefundParams{PaymentIntent: stripe.String(params.IntentID)}
+	refundParams.Context = ctx
+	if params.Amount > 0 {
+		refundParams.Amount = stripe.Int64(params.Amount)
+	}
+	if params.Reason != "" {
+		refundParams.Reason = stripe.String(params.Reason)
+	}
+	if params.IdempotencyKey != "" {
+		refundParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+
+	r, err := p.api.Refunds.New(refundParams)
+	if err != nil {
+		return nil, fmt.Errorf("Refund: %w", stripeError(err))
+	}
+	return &Refund{ID: r.ID, IntentID: params.IntentID, Amount: r.Amount, Currency: string(r.Currency), Status: stripeRefundStatus(r)}, nil
+}
+
+// stripeRefundStatus returns the status of a refund, counting a canceled refund as failed.
+func stripeRefundStatus(r *stripe.Refund) string {
+	if r.Status == stripe.RefundStatusCanceled {
+		return "failed"
+	}
+	return string(r.Status)
+}
+
+func (p *StripeProvider) GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	params := &stripe.PaymentMethodParams{}
+	params.Context = ctx
+	pm, err := p.api.PaymentMethods.Get(paymentMethodID, params)
+	if err != nil {
+		return nil, fmt.Errorf("GetPaymentMethod: %w", stripeError(err))
+	}
+	method := &PaymentMethod{ID: pm.ID, Type: string(pm.Type)}
+	if pm.Customer != nil {
+		method.CustomerID = pm.Customer.ID
+	}
+	return method, nil
+}
+
+// stripeCreated returns the created filter of a listing.
+func stripeCreated(params *ListParams) *stripe.RangeQueryParams {
+	return &stripe.RangeQueryParams{GreaterThanOrEqual: params.CreatedFrom.Unix(), LesserThan: params.CreatedTo.Unix()}
+}
+
+func (p *StripeProvider) ListIntents(ctx context.Context, params *ListParams) ([]*Intent, error) {
+	listParams := &stripe.PaymentIntentListParams{CreatedRange: stripeCreated(params)}
+	listParams.Context = ctx
+	var intents []*Intent
+	iter := p.api.PaymentIntents.List(listParams)
+	for iter.Next() {
+		intents = append(intents, stripeIntent(iter.PaymentIntent()))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("ListIntents: %w", stripeError(err))
+	}
+	return intents, nil
+}
+
+func (p *StripeProvider) ListCharges(ctx context.Context, params *ListParams) ([]*Charge, error) {
+	listParams := &stripe.ChargeListParams{CreatedRange: stripeCreated(params)}
+	listParams.Context = ctx
+	var charges []*Charge
+	iter := p.api.Charges.List(listParams)
+	for iter.Next() {
+		charges = append(charges, stripeCharge(iter.Charge()))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("ListCharges: %w", stripeError(err))
+	}
+	return charges, nil
+}
+
+// ListRefunds lists refunds with the charge they refunded, so each can be matched to its payment.
+func (p *StripeProvider) ListRefunds(ctx context.Context, params *ListParams) ([]*Refund, error) {
+	listParams := &stripe.RefundListParams{CreatedRange: stripeCreated(params)}
+	listParams.Context = ctx
+	listParams.AddExpand("data.charge")
+	var refunds []*Refund
+	iter := p.api.Refunds.List(listParams)
+	for iter.Next() {
+		r := iter.Refund()
+		refund := &Refund{ID: r.ID, Amount: r.Amount, Currency: string(r.Currency), Status: stripeRefundStatus(r)}
+		if r.Charge != nil {
+			refund.Charge = stripeCharge(r.Charge)
+			refund.IntentID = r.Charge.PaymentIntent
+		}
+		refunds = append(refunds, refund)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("ListRefunds: %w", stripeError(err))
+	}
+	return refunds, nil
+}
+
+func stripeCharge(ch *stripe.Charge) *Charge {
+	return &Charge{
+		ID:             ch.ID,
+		IntentID:       ch.PaymentIntent,
+		Amount:         ch.Amount,
+		AmountRefunded: ch.AmountRefunded,
+		Refunded:       ch.Refunded,
+		Status:         ch.Status,
+	}
+}
+
+// ParseWebhook verifies the Stripe-Signature header and returns the event. Its Payload is the body as Stripe sent it.
+func (p *StripeProvider) ParseWebhook(payload []byte, headers map[string]string) ([]*WebhookEvent, error) {
+	if p.webhookSecret == "" {
+		return nil, errors.New("ParseWebhook: no Stripe webhook secret is configured")
+	}
+	event, err := webhook.ConstructEvent(payload, header(headers, "Stripe-Signature"), p.webhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	parsed := &WebhookEvent{ID: event.ID, Provider: Stripe, Type: event.Type, Created: event.Created, Payload: payload}
+	if event.Data != nil {
+		object := event.Data.Object
+		parsed.IntentID, _ = object["id"].(string)
+		parsed.Currency, _ = object["currency"].(string)
+		if amount, ok := object["amount"].(float64); ok {
+			parsed.Amount = int64(amount)
+		}
+		if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+			parsed.UserID, _ = metadata["UserID"].(string)
+		}
+	}
+	return []*WebhookEvent{parsed}, nil
+}
+
+// stripeIntent converts a payment intent. IntentStatus is named after Stripe's statuses, so they carry over as is.
+func stripeIntent(pi *stripe.PaymentIntent) *Intent {
+	var customerID string
+	if pi.Customer != nil {
+		customerID = pi.Customer.ID
+	}
+	return &Intent{
+		ID:           pi.ID,
+		Provider:     Stripe,
+		Amount:       pi.Amount,
+		Currency:     string(pi.Currency),
+		Status:       IntentStatus(pi.Status),
+		ClientSecret: pi.ClientSecret,
+		UserID:       pi.Metadata["UserID"],
+		CustomerID:   customerID,
+		Wallet:       stripeWallet(pi),
+	}
+}
+
+// stripeWallet returns the wallet of the latest charge of a payment intent, or "" if it wasn't paid with one.
+func stripeWallet(pi *stripe.PaymentIntent) string {
+	if pi.Charges == nil || len(pi.Charges.Data) == 0 {
+		return ""
+	}
+	details := pi.Charges.Data[0].PaymentMethodDetails
+	if details == nil || details.Card == nil || details.Card.Wallet == nil {
+		return ""
+	}
+	return string(details.Card.Wallet.Type)
+}
@@ -0,0 +1,50 @@
+package payments
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stripe/stripe-go"
+)
+
+func TestStripeError(t *testing.T) {
+	dial := &url.Error{Op: "Post", URL: "https://api.stripe.com/v1/payment_intents", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	read := &url.Error{Op: "Post", URL: "https://api.stripe.com/v1/payment_intents", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"connection refused", dial, ErrProviderUnavailable},
+		{"dropped connection", read, ErrOutcomeUnknown},
+		{"rate limited", &stripe.Error{Type: stripe.ErrorTypeRateLimit, HTTPStatusCode: http.StatusTooManyRequests}, ErrProviderUnavailable},
+		{"processing error", &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeProcessingError, HTTPStatusCode: http.StatusPaymentRequired}, ErrProviderUnavailable},
+		{"API error", &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusInternalServerError}, ErrOutcomeUnknown},
+		{"missing", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeResourceMissing, HTTPStatusCode: http.StatusNotFound}, ErrNotFound},
+		{"unexpected state", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodePaymentIntentUnexpectedState, HTTPStatusCode: http.StatusBadRequest}, ErrUnexpectedState},
+		{"authentication required", &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeAuthenticationRequired, HTTPStatusCode: http.StatusPaymentRequired, PaymentIntent: &stripe.PaymentIntent{ID: "pi_1"}}, ErrAuthenticationRequired},
+		{"declined", &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, HTTPStatusCode: http.StatusPaymentRequired}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := stripeError(tt.err)
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("stripeError = %v, want %v", err, tt.want)
+			}
+			if tt.want != ErrProviderUnavailable && errors.Is(err, ErrProviderUnavailable) {
+				t.Errorf("stripeError = %v, which would fail the payment over", err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("stripeError = %v, lost the original error", err)
+			}
+			var intentErr *IntentError
+			if tt.want == ErrAuthenticationRequired && (!errors.As(err, &intentErr) || intentErr.IntentID != "pi_1") {
+				t.Errorf("stripeError = %v, want an IntentError for pi_1", err)
+			}
+		})
+	}
+}
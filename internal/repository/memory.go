@@ -0,0 +1,258 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/betchya/lambdas/internal/database"
+)
+
+var (
+	_ UserRepository        = (*MemoryUserRepository)(nil)
+	_ TransactionRepository = (*MemoryTransactionRepository)(nil)
+)
+
+// MemoryUserRepository is a UserRepository kept in memory, for running handlers without a database. Every call is
+// applied on its own under a mutex; there are no transactions to roll back, and LockUser only checks that the user
+// exists.
+type MemoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[string]User{}}
+}
+
+// PutUser adds or replaces a user.
+func (r *MemoryUserRepository) PutUser(u User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[u.UserID] = u
+}
+
+func (r *MemoryUserRepository) GetUser(ctx context.Context, userID string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+func (r *MemoryUserRepository) SetStripeCustomerID(ctx context.Context, userID, customerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[userID]
+	if !ok {
+		return fmt.Errorf("SetStripeCustomerID: %w", ErrNotFound)
+	}
+	u.StripeCustomerID = &customerID
+	r.users[userID] = u
+	return nil
+}
+
+func (r *MemoryUserRepository) LockUser(ctx context.Context, userID string) error {
+	return r.update("LockUser", userID, func(u *User) {})
+}
+
+func (r *MemoryUserRepository) AddPendingBalance(ctx context.Context, userID string, amount int64) error {
+	return r.update("AddPendingBalance", userID, func(u *User) {
+		u.PendingBalance += amount
+	})
+}
+
+func (r *MemoryUserRepository) AddAccountBalance(ctx context.Context, userID string, amount int64) error {
+	return r.update("AddAccountBalance", userID, func(u *User) {
+		u.AccountBalance += amount
+	})
+}
+
+func (r *MemoryUserRepository) AddWinnings(ctx context.Context, userID string, amount int64) error {
+	return r.update("AddWinnings", userID, func(u *User) {
+		u.AccountBalance += amount
+		u.WithdrawableBalance += amount
+	})
+}
+
+func (r *MemoryUserRepository) RemoveAccountBalance(ctx context.Context, userID string, amount int64) error {
+	return r.update("RemoveAccountBalance", userID, func(u *User) {
+		u.WithdrawableBalance = cappedWithdrawable(u, amount)
+		u.AccountBalance -= amount
+	})
+}
+
+func (r *MemoryUserRepository) HoldBalance(ctx context.Context, userID string, amount int64) error {
+	return r.update("HoldBalance", userID, func(u *User) {
+		u.WithdrawableBalance = cappedWithdrawable(u, amount)
+		u.AccountBalance -= amount
+		u.HeldBalance += amount
+	})
+}
+
+func (r *MemoryUserRepository) ReleaseHeldBalance(ctx context.Context, userID string, amount int64) error {
+	return r.update("ReleaseHeldBalance", userID, func(u *User) {
+		u.HeldBalance -= amount
+	})
+}
+
+// update applies fn to the user with the given ID, or fails with ErrNotFound wrapped in op.
+func (r *MemoryUserRepository) update(op, userID string, fn func(u *User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[userID]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, ErrNotFound)
+	}
+	fn(&u)
+	r.users[userID] = u
+	return nil
+}
+
+// cappedWithdrawable returns the user's withdrawable balance capped at what is left available once amount is taken
+// out, as the SQL repository computes it.
+func cappedWithdrawable(u *User, amount int64) int64 {
+	left := u.AccountBalance - amount
+	if left < 0 {
+		left = 0
+	}
+	if u.WithdrawableBalance < left {
+		return u.WithdrawableBalance
+	}
+	return left
+}
+
+// MemoryTransactionRepository is a TransactionRepository kept in memory, for running handlers without a database.
+// Like MemoryUserRepository, it applies every call on its own.
+type MemoryTransactionRepository struct {
+	mu           sync.Mutex
+	transactions map[string]Transaction
+}
+
+func NewMemoryTransactionRepository() *MemoryTransactionRepository {
+	return &MemoryTransactionRepository{transactions: map[string]Transaction{}}
+}
+
+func (r *MemoryTransactionRepository) GetTransaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transactions[transactionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (r *MemoryTransactionRepository) InsertTransaction(ctx context.Context, t *Transaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.transactions[t.TransactionID]; ok {
+		return fmt.Errorf("InsertTransaction: %w: TransactionID %s", database.ErrDuplicateKey, t.TransactionID)
+	}
+	r.transactions[t.TransactionID] = *t
+	return nil
+}
+
+func (r *MemoryTransactionRepository) ListTransactions(ctx context.Context, userID string, limit int) ([]*Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	transactions := []*Transaction{}
+	for _, t := range r.transactions {
+		if t.UserID == userID {
+			t := t
+			transactions = append(transactions, &t)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].TransactionDate != transactions[j].TransactionDate {
+			return transactions[i].TransactionDate > transactions[j].TransactionDate
+		}
+		return transactions[i].TransactionID > transactions[j].TransactionID
+	})
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+func (r *MemoryTransactionRepository) FindTransactions(ctx context.Context, q *TransactionQuery) ([]*Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// less orders rows in the order of q
+	less := func(a, b *Transaction) bool {
+		if a.TransactionDate != b.TransactionDate {
+			return (a.TransactionDate < b.TransactionDate) != q.NewestFirst
+		}
+		return a.TransactionID != b.TransactionID && (a.TransactionID < b.TransactionID) != q.NewestFirst
+	}
+	transactions := []*Transaction{}
+	for _, t := range r.transactions {
+		t := t
+		if q.matches(&t) && (q.After == nil || less(q.After, &t)) {
+			transactions = append(transactions, &t)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool { return less(transactions[i], transactions[j]) })
+	if q.Limit > 0 && len(transactions) > q.Limit {
+		transactions = transactions[:q.Limit]
+	}
+	return transactions, nil
+}
+
+func (r *MemoryTransactionRepository) SumTransactions(ctx context.Context, q *TransactionQuery) ([]*TransactionTotal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byKey := map[[2]string]*TransactionTotal{}
+	totals := []*TransactionTotal{}
+	for _, t := range r.transactions {
+		if !q.matches(&t) {
+			continue
+		}
+		key := [2]string{t.TransactionType, t.TransactionStatus}
+		total, ok := byKey[key]
+		if !ok {
+			total = &TransactionTotal{TransactionType: t.TransactionType, TransactionStatus: t.TransactionStatus}
+			byKey[key] = total
+			totals = append(totals, total)
+		}
+		total.Amount += t.Amount
+	}
+	return totals, nil
+}
+
+func (r *MemoryTransactionRepository) TransitionTransaction(ctx context.Context, transactionID, from, to, transactionDate string) (bool, error) {
+	if from == to {
+		return false, nil
+	}
+	if err := checkTransition(transactionID, from, to); err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transactions[transactionID]
+	if !ok || t.TransactionStatus != from {
+		return false, nil
+	}
+	t.TransactionStatus = to
+	t.TransactionDate = transactionDate
+	r.transactions[transactionID] = t
+	return true, nil
+}
+
+func (r *MemoryTransactionRepository) SetWallet(ctx context.Context, transactionID, wallet string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transactions[transactionID]
+	if ok && t.Wallet == "" {
+		t.Wallet = wallet
+		r.transactions[transactionID] = t
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMemoryTransitionTransaction(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryTransactionRepository()
+	if err := r.InsertTransaction(ctx, &Transaction{TransactionID: "pi_1", TransactionStatus: "Pending"}); err != nil {
+		t.Fatalf("InsertTransaction: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		from, to  string
+		wantMoved bool
+		wantErr   error
+	}{
+		{"allowed", "Pending", "Completed", true, nil},
+		{"no longer in from", "Pending", "Failed", false, nil},
+		{"same status", "Completed", "Completed", false, nil},
+		{"illegal", "Completed", "Failed", false, ErrIllegalTransition},
+		{"refund", "Completed", "Refunded", true, nil},
+		{"final", "Refunded", "Completed", false, ErrIllegalTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moved, err := r.TransitionTransaction(ctx, "pi_1", tt.from, tt.to, "2024-01-01 00:00:00")
+			if moved != tt.wantMoved || !errors.Is(err, tt.wantErr) {
+				t.Errorf("TransitionTransaction(%s, %s) = %t, %v; want %t, %v", tt.from, tt.to, moved, err, tt.wantMoved, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryBalances(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryUserRepository()
+	r.PutUser(User{UserID: "user_1", AccountBalance: 5000, WithdrawableBalance: 4000})
+
+	// Holding 2000 leaves 3000 available, so only 3000 of the 4000 stays withdrawable
+	if err := r.HoldBalance(ctx, "user_1", 2000); err != nil {
+		t.Fatalf("HoldBalance: %v", err)
+	}
+	// Releasing the hold makes it spendable again, not withdrawable
+	if err := r.HoldBalance(ctx, "user_1", -2000); err != nil {
+		t.Fatalf("HoldBalance: %v", err)
+	}
+	// Winnings are both spendable and withdrawable: 6000 available, 4000 of it withdrawable
+	if err := r.AddWinnings(ctx, "user_1", 1000); err != nil {
+		t.Fatalf("AddWinnings: %v", err)
+	}
+	// A refund of more than is left takes the balance below zero and nothing stays withdrawable
+	if err := r.RemoveAccountBalance(ctx, "user_1", 7000); err != nil {
+		t.Fatalf("RemoveAccountBalance: %v", err)
+	}
+
+	u, err := r.GetUser(ctx, "user_1")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.AccountBalance != -1000 || u.HeldBalance != 0 || u.WithdrawableBalance != 0 {
+		t.Errorf("user = %+v, want account -1000, held 0, withdrawable 0", u)
+	}
+
+	if err := r.LockUser(ctx, "user_2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LockUser of an unknown user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRecordPendingDeposit(t *testing.T) {
+	ctx := context.Background()
+	users := NewMemoryUserRepository()
+	users.PutUser(User{UserID: "user_1", AccountBalance: 1000})
+	transactions := NewMemoryTransactionRepository()
+
+	deposit := &Transaction{TransactionID: "pi_1", UserID: "user_1", TransactionType: "Deposit", Amount: 5000, TransactionStatus: "Pending"}
+	// The second call finds the deposit recorded and must not add it to the pending balance again
+	for i, want := range []bool{true, false} {
+		recorded, err := RecordPendingDeposit(ctx, users, transactions, deposit)
+		if err != nil || recorded != want {
+			t.Fatalf("call %d: RecordPendingDeposit = %t, %v; want %t, nil", i+1, recorded, err, want)
+		}
+	}
+
+	u, err := users.GetUser(ctx, "user_1")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.AccountBalance != 1000 || u.PendingBalance != 5000 {
+		t.Errorf("user = %+v, want account 1000, pending 5000", u)
+	}
+	if _, err := RecordPendingDeposit(ctx, users, transactions, &Transaction{TransactionID: "pi_2", UserID: "user_2"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deposit of an unknown user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryFindTransactions(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryTransactionRepository()
+	for _, row := range []*Transaction{
+		{TransactionID: "pi_1", UserID: "user_1", TransactionType: "Deposit", Amount: 1000, TransactionStatus: "Completed", TransactionDate: "2024-01-01 00:00:00"},
+		{TransactionID: "pi_2", UserID: "user_1", TransactionType: "Deposit", Amount: 2000, TransactionStatus: "Pending", TransactionDate: "2024-01-02 00:00:00", Provider: "stripe"},
+		{TransactionID: "pi_3", UserID: "user_1", TransactionType: "Deposit", Amount: 4000, TransactionStatus: "Failed", TransactionDate: "2024-01-02 00:00:00", Provider: "adyen"},
+		{TransactionID: "bet_1-stake", UserID: "user_1", TransactionType: "BetStake", Amount: 500, TransactionStatus: "Held", TransactionDate: "2024-01-03 00:00:00"},
+		{TransactionID: "pi_4", UserID: "user_2", TransactionType: "Deposit", Amount: 8000, TransactionStatus: "Completed", TransactionDate: "2024-01-01 00:00:00"},
+	} {
+		if err := r.InsertTransaction(ctx, row); err != nil {
+			t.Fatalf("InsertTransaction: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query TransactionQuery
+		want  []string
+	}{
+		{"user", TransactionQuery{UserID: "user_1"}, []string{"pi_1", "pi_2", "pi_3", "bet_1-stake"}},
+		{"newest first", TransactionQuery{UserID: "user_1", NewestFirst: true}, []string{"bet_1-stake", "pi_3", "pi_2", "pi_1"}},
+		{"type and statuses", TransactionQuery{TransactionType: "Deposit", Statuses: []string{"Pending", "Failed"}}, []string{"pi_2", "pi_3"}},
+		{"stripe", TransactionQuery{UserID: "user_1", TransactionType: "Deposit", Provider: "stripe"}, []string{"pi_1", "pi_2"}},
+		{"dates", TransactionQuery{From: "2024-01-02 00:00:00", To: "2024-01-03 00:00:00"}, []string{"pi_2", "pi_3"}},
+		{"after", TransactionQuery{UserID: "user_1", After: &Transaction{TransactionID: "pi_2", TransactionDate: "2024-01-02 00:00:00"}}, []string{"pi_3", "bet_1-stake"}},
+		{"after newest first", TransactionQuery{UserID: "user_1", NewestFirst: true, Limit: 1, After: &Transaction{TransactionID: "pi_3", TransactionDate: "2024-01-02 00:00:00"}}, []string{"pi_2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := r.FindTransactions(ctx, &tt.query)
+			if err != nil {
+				t.Fatalf("FindTransactions: %v", err)
+			}
+			ids := []string{}
+			for _, row := range rows {
+				ids = append(ids, row.TransactionID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("FindTransactions = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	// Only completed and in-flight deposits count against limits
+	deposited, err := DepositedSince(ctx, r, "user_1", "2024-01-01 00:00:00")
+	if err != nil || deposited != 3000 {
+		t.Errorf("DepositedSince = %d, %v; want 3000", deposited, err)
+	}
+}
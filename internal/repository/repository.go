@@ -0,0 +1,220 @@
+// Package repository gives the Lambdas typed access to the user_management tables. Queries name their columns
+// explicitly, so adding a column to a table doesn't break the handlers that read it.
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrIllegalTransition is returned when a TransactionHistory row would move to a status it can't reach from its
+	// current one, such as "Completed" to "Failed".
+	ErrIllegalTransition = errors.New("illegal transaction status transition")
+)
+
+// transactionTransitions lists the statuses each TransactionHistory status may move to. A failed payment intent
+// can still be retried and succeed, and a completed deposit can still be refunded, but "Refunded", "Canceled" and
+// the statuses a hold is closed with are final. "Authorized" deposits were created with manual capture and wait to
+// be captured (then "Completed") or canceled. A refund may be reported before the payment's success, so a deposit
+// can also become "Refunded" without having been "Completed".
+var transactionTransitions = map[string][]string{
+	"Pending":    {"Processing", "Authorized", "Completed", "Failed", "Canceled", "Refunded"},
+	"Processing": {"Completed", "Failed", "Canceled", "Refunded"},
+	"Authorized": {"Completed", "Failed", "Canceled", "Refunded"},
+	"Failed":     {"Processing", "Authorized", "Completed", "Canceled", "Refunded"},
+	"Completed":  {"Refunded"},
+	"Held":       {"Settled", "Refunded", "Released", "Lost"},
+}
+
+// CanTransition reports whether a TransactionHistory row may move from one status to another.
+func CanTransition(from, to string) bool {
+	for _, allowed := range transactionTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTransition returns the error TransitionTransaction fails with when a row may not move from one status to
+// another, or nil if it may.
+func checkTransition(transactionID, from, to string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s from %s to %s", ErrIllegalTransition, transactionID, from, to)
+	}
+	return nil
+}
+
+// User is a row of the Users table. Balances are in minor units (cents); the table stores them in dollars.
+type User struct {
+	UserID                    string
+	Username                  string
+	Email                     string
+	PhoneNumber               string
+	DateOfBirth               string
+	AccountVerificationStatus string
+	CreatedAt                 string
+	UpdatedAt                 string
+	AccountBalance            int64
+	PendingBalance            int64
+	HeldBalance               int64
+	WithdrawableBalance       int64
+	StripeCustomerID          *string // Is nil if the user is not a Stripe customer
+}
+
+// Transaction is a row of the TransactionHistory table. Amount is in minor units (cents).
+type Transaction struct {
+	TransactionID     string
+	UserID            string
+	TransactionType   string
+	Amount            int64
+	TransactionStatus string
+	TransactionDate   string
+	Provider          string // Payment provider that handled the row, e.g. "stripe"; empty for bets
+	Wallet            string // Digital wallet a deposit was paid with, e.g. "apple_pay"; empty otherwise
+	Currency          string // Currency a deposit was made in, e.g. "usd"; empty for bets and older deposits
+}
+
+// ProviderName returns the payment provider that handled the row. Rows written before providers were recorded went
+// through Stripe.
+func (t *Transaction) ProviderName() string {
+	if t.Provider == "" {
+		return "stripe"
+	}
+	return t.Provider
+}
+
+// TransactionQuery selects rows of the TransactionHistory table. Empty fields match every row. Dates are UTC times in
+// the DATETIME layout, "2006-01-02 15:04:05".
+type TransactionQuery struct {
+	UserID          string
+	TransactionType string
+	Statuses        []string
+	Provider        string       // Rows recorded without a provider are Stripe's, as ProviderName says
+	From            string       // Inclusive
+	To              string       // Exclusive
+	After           *Transaction // Resumes a listing after this row, by its TransactionDate and TransactionID
+	NewestFirst     bool         // Rows are listed oldest first otherwise
+	Limit           int          // No limit if 0
+}
+
+// matches reports whether q selects t, leaving out After.
+func (q *TransactionQuery) matches(t *Transaction) bool {
+	if q.UserID != "" && t.UserID != q.UserID || q.TransactionType != "" && t.TransactionType != q.TransactionType {
+		return false
+	}
+	if q.Provider != "" && t.ProviderName() != q.Provider {
+		return false
+	}
+	if q.From != "" && t.TransactionDate < q.From || q.To != "" && t.TransactionDate >= q.To {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	for _, status := range q.Statuses {
+		if t.TransactionStatus == status {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionTotal is the total Amount, in cents, of the rows of one type in one status.
+type TransactionTotal struct {
+	TransactionType   string
+	TransactionStatus string
+	Amount            int64
+}
+
+// UserRepository reads and updates rows of the Users table. Amounts are in cents.
+type UserRepository interface {
+	// GetUser returns the user with the given ID, or ErrNotFound.
+	GetUser(ctx context.Context, userID string) (*User, error)
+	// SetStripeCustomerID links the user to their Stripe customer.
+	SetStripeCustomerID(ctx context.Context, userID, customerID string) error
+	// LockUser takes a row lock on the user until the database transaction the repository works in ends. Every unit
+	// of work that reads and then changes a user's balances or transactions locks the user first, so concurrent ones
+	// for the same user are applied one at a time and can't overwrite each other's updates.
+	LockUser(ctx context.Context, userID string) error
+	// AddPendingBalance adds amount (in cents, may be negative) to the user's pending balance.
+	AddPendingBalance(ctx context.Context, userID string, amount int64) error
+	// AddAccountBalance adds amount (may be negative) to the user's available balance.
+	AddAccountBalance(ctx context.Context, userID string, amount int64) error
+	// AddWinnings adds amount to the user's available balance and makes it withdrawable, as the payout of a bet is.
+	AddWinnings(ctx context.Context, userID string, amount int64) error
+	// RemoveAccountBalance takes amount out of the user's available balance, such as a deposit that was refunded
+	// after it was credited. The withdrawable balance is capped at what is left.
+	RemoveAccountBalance(ctx context.Context, userID string, amount int64) error
+	// HoldBalance moves amount (may be negative) from the user's available balance into held funds, which are
+	// neither spendable nor withdrawable. The withdrawable balance is capped at what is left available.
+	HoldBalance(ctx context.Context, userID string, amount int64) error
+	// ReleaseHeldBalance removes amount from the user's held funds without returning it to them.
+	ReleaseHeldBalance(ctx context.Context, userID string, amount int64) error
+}
+
+// TransactionRepository reads and writes rows of the TransactionHistory table.
+type TransactionRepository interface {
+	// GetTransaction returns the transaction with the given ID, or ErrNotFound.
+	GetTransaction(ctx context.Context, transactionID string) (*Transaction, error)
+	// InsertTransaction adds a new row. The error matches database.ErrDuplicateKey if the TransactionID is taken.
+	InsertTransaction(ctx context.Context, t *Transaction) error
+	// ListTransactions returns up to limit of the user's transactions, newest first.
+	ListTransactions(ctx context.Context, userID string, limit int) ([]*Transaction, error)
+	// TransitionTransaction moves a row from one status to another and reports whether it did. Only a row still in
+	// status from is moved, so when the same payment is processed twice at once only one of them moves it. Moving a
+	// row to the status it already has does nothing, and a move CanTransition doesn't allow fails with
+	// ErrIllegalTransition. transactionDate is a UTC time in the DATETIME layout, "2006-01-02 15:04:05".
+	TransitionTransaction(ctx context.Context, transactionID, from, to, transactionDate string) (bool, error)
+	// SetWallet records the wallet of a row written before the wallet was known. A row that has one keeps it.
+	SetWallet(ctx context.Context, transactionID, wallet string) error
+	// FindTransactions returns the rows q selects, ordered by TransactionDate and then TransactionID.
+	FindTransactions(ctx context.Context, q *TransactionQuery) ([]*Transaction, error)
+	// SumTransactions returns the total Amount of the rows q selects for each type and status they have. The order,
+	// After and Limit of q are ignored.
+	SumTransactions(ctx context.Context, q *TransactionQuery) ([]*TransactionTotal, error)
+}
+
+// limitStatuses are the statuses of the deposits that count against a user's deposit limits: completed ones, and
+// those still in flight, which may yet complete.
+var limitStatuses = []string{"Pending", "Processing", "Authorized", "Completed"}
+
+// DepositedSince returns the total, in cents, of the user's deposits dated at or after since that count against their
+// deposit limits. since is a UTC time in the DATETIME layout.
+func DepositedSince(ctx context.Context, transactions TransactionRepository, userID, since string) (int64, error) {
+	totals, err := transactions.SumTransactions(ctx, &TransactionQuery{UserID: userID, TransactionType: "Deposit", Statuses: limitStatuses, From: since})
+	if err != nil {
+		return 0, err
+	}
+	var deposited int64
+	for _, total := range totals {
+		deposited += total.Amount
+	}
+	return deposited, nil
+}
+
+// RecordPendingDeposit records a deposit the payment provider hasn't settled yet and adds it to the user's pending
+// balance, and reports whether it did. It locks the user first and leaves a deposit that is already recorded alone,
+// as it is when the webhook got to it first, so the deposit is never counted twice. users and transactions must work
+// in the same database transaction.
+func RecordPendingDeposit(ctx context.Context, users UserRepository, transactions TransactionRepository, deposit *Transaction) (bool, error) {
+	if err := users.LockUser(ctx, deposit.UserID); err != nil {
+		return false, err
+	}
+	if _, err := transactions.GetTransaction(ctx, deposit.TransactionID); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if err := transactions.InsertTransaction(ctx, deposit); err != nil {
+		return false, err
+	}
+	if err := users.AddPendingBalance(ctx, deposit.UserID, deposit.Amount); err != nil {
+		return false, err
+	}
+	return true, nil
+}
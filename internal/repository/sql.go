@@ -0,0 +1,359 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/betchya/lambdas/internal/database"
+)
+
+// Columns of Users, in the order scanUser reads them
+const userColumns = `UserID, Username, Email, PhoneNumber, DateOfBirth, AccountVerificationStatus, CreatedAt, UpdatedAt,
+	AccountBalance, PendingBalance, HeldBalance, WithdrawableBalance, stripe_customer_id`
+
+// Columns of TransactionHistory, in the order scanTransaction reads them
+const transactionColumns = `TransactionID, UserID, TransactionType, Amount, TransactionStatus, TransactionDate, Provider, Wallet, Currency`
+
+var (
+	_ UserRepository        = (*SQLUserRepository)(nil)
+	_ TransactionRepository = (*SQLTransactionRepository)(nil)
+)
+
+// Querier is satisfied by *sql.DB and *sql.Tx. The SQL repositories are given a *sql.Tx to work inside a database
+// transaction, as LockUser and read-then-write units of work need.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SQLUserRepository is the UserRepository backed by the user_management database.
+type SQLUserRepository struct {
+	db      Querier
+	dialect database.Dialect
+}
+
+func NewSQLUserRepository(db Querier, dialect database.Dialect) *SQLUserRepository {
+	return &SQLUserRepository{db: db, dialect: dialect}
+}
+
+// SQLTransactionRepository is the TransactionRepository backed by the user_management database.
+type SQLTransactionRepository struct {
+	db Querier
+}
+
+func NewSQLTransactionRepository(db Querier) *SQLTransactionRepository {
+	return &SQLTransactionRepository{db: db}
+}
+
+// dollarsToCents converts a balance as stored in Users to minor units.
+func dollarsToCents(dollars float64) int64 {
+	return int64(math.Round(dollars * 100))
+}
+
+func scanUser(row *sql.Row) (*User, error) {
+	var u User
+	var available, pending, held, withdrawable float64
+	err := row.Scan(&u.UserID, &u.Username, &u.Email, &u.PhoneNumber, &u.DateOfBirth, &u.AccountVerificationStatus,
+		&u.CreatedAt, &u.UpdatedAt, &available, &pending, &held, &withdrawable, &u.StripeCustomerID)
+	if err != nil {
+		return nil, err
+	}
+	u.AccountBalance = dollarsToCents(available)
+	u.PendingBalance = dollarsToCents(pending)
+	u.HeldBalance = dollarsToCents(held)
+	u.WithdrawableBalance = dollarsToCents(withdrawable)
+	return &u, nil
+}
+
+func (r *SQLUserRepository) GetUser(ctx context.Context, userID string) (*User, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM Users WHERE UserID = ?`, userID)
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetUser: %v", err)
+	}
+	return u, nil
+}
+
+func (r *SQLUserRepository) SetStripeCustomerID(ctx context.Context, userID, customerID string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE Users SET stripe_customer_id = ? WHERE UserID = ?`, customerID, userID)
+	if err != nil {
+		return fmt.Errorf("SetStripeCustomerID: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) LockUser(ctx context.Context, userID string) error {
+	var lockedID string
+	query := `SELECT UserID FROM Users WHERE UserID = ?` + r.dialect.ForUpdate()
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&lockedID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("LockUser: %w", ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("LockUser: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) AddPendingBalance(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	_, err := r.db.ExecContext(ctx, `UPDATE Users SET PendingBalance = PendingBalance + ? WHERE UserID = ?`, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("AddPendingBalance: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) AddAccountBalance(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	_, err := r.db.ExecContext(ctx, `UPDATE Users SET AccountBalance = AccountBalance + ? WHERE UserID = ?`, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("AddAccountBalance: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) AddWinnings(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	query := `UPDATE Users SET AccountBalance = AccountBalance + ?, WithdrawableBalance = WithdrawableBalance + ? WHERE UserID = ?`
+	_, err := r.db.ExecContext(ctx, query, amountInDollars, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("AddWinnings: %v", err)
+	}
+	return nil
+}
+
+// cappedWithdrawable is the expression that caps WithdrawableBalance at what is left available once the amount bound
+// to its placeholder is taken out. It must be assigned before AccountBalance: MySQL reads columns already updated by
+// the same statement, SQLite does not.
+func (r *SQLUserRepository) cappedWithdrawable() string {
+	return r.dialect.Least("WithdrawableBalance", r.dialect.Greatest("AccountBalance - ?", "0"))
+}
+
+func (r *SQLUserRepository) RemoveAccountBalance(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	query := `UPDATE Users SET WithdrawableBalance = ` + r.cappedWithdrawable() + `,
+		AccountBalance = AccountBalance - ? WHERE UserID = ?`
+	_, err := r.db.ExecContext(ctx, query, amountInDollars, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("RemoveAccountBalance: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) HoldBalance(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	query := `UPDATE Users SET WithdrawableBalance = ` + r.cappedWithdrawable() + `,
+		AccountBalance = AccountBalance - ?, HeldBalance = HeldBalance + ? WHERE UserID = ?`
+	_, err := r.db.ExecContext(ctx, query, amountInDollars, amountInDollars, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("HoldBalance: %v", err)
+	}
+	return nil
+}
+
+func (r *SQLUserRepository) ReleaseHeldBalance(ctx context.Context, userID string, amount int64) error {
+	amountInDollars := float64(amount) / 100.0
+	_, err := r.db.ExecContext(ctx, `UPDATE Users SET HeldBalance = HeldBalance - ? WHERE UserID = ?`, amountInDollars, userID)
+	if err != nil {
+		return fmt.Errorf("ReleaseHeldBalance: %v", err)
+	}
+	return nil
+}
+
+// scanTransaction reads a row selected with transactionColumns. TransactionHistory amounts are already in cents.
+func scanTransaction(scan func(dest ...interface{}) error) (*Transaction, error) {
+	var t Transaction
+	var amount float64
+	var provider, wallet, currency sql.NullString
+	if err := scan(&t.TransactionID, &t.UserID, &t.TransactionType, &amount, &t.TransactionStatus, &t.TransactionDate, &provider, &wallet, &currency); err != nil {
+		return nil, err
+	}
+	t.Amount = int64(amount)
+	t.Provider = provider.String
+	t.Wallet = wallet.String
+	t.Currency = currency.String
+	return &t, nil
+}
+
+func (r *SQLTransactionRepository) GetTransaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM TransactionHistory WHERE TransactionID = ?`, transactionID)
+	t, err := scanTransaction(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetTransaction: %v", err)
+	}
+	return t, nil
+}
+
+func (r *SQLTransactionRepository) InsertTransaction(ctx context.Context, t *Transaction) error {
+	query := `INSERT INTO TransactionHistory (` + transactionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	provider := sql.NullString{String: t.Provider, Valid: t.Provider != ""}
+	wallet := sql.NullString{String: t.Wallet, Valid: t.Wallet != ""}
+	currency := sql.NullString{String: t.Currency, Valid: t.Currency != ""}
+	_, err := r.db.ExecContext(ctx, query, t.TransactionID, t.UserID, t.TransactionType, float64(t.Amount), t.TransactionStatus, t.TransactionDate, provider, wallet, currency)
+	if err != nil {
+		return fmt.Errorf("InsertTransaction: %w", err)
+	}
+	return nil
+}
+
+func (r *SQLTransactionRepository) ListTransactions(ctx context.Context, userID string, limit int) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM TransactionHistory WHERE UserID = ?
+		ORDER BY TransactionDate DESC, TransactionID DESC LIMIT ?`
+	rows, err := r.db.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ListTransactions: %v", err)
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("ListTransactions: %v", err)
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListTransactions: %v", err)
+	}
+	return transactions, nil
+}
+
+func (r *SQLTransactionRepository) TransitionTransaction(ctx context.Context, transactionID, from, to, transactionDate string) (bool, error) {
+	if from == to {
+		return false, nil
+	}
+	if err := checkTransition(transactionID, from, to); err != nil {
+		return false, err
+	}
+
+	query := `UPDATE TransactionHistory SET TransactionStatus = ?, TransactionDate = ? WHERE TransactionID = ? AND TransactionStatus = ?`
+	result, err := r.db.ExecContext(ctx, query, to, transactionDate, transactionID, from)
+	if err != nil {
+		return false, fmt.Errorf("TransitionTransaction: %v", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("TransitionTransaction: %v", err)
+	}
+	return rows == 1, nil
+}
+
+func (r *SQLTransactionRepository) SetWallet(ctx context.Context, transactionID, wallet string) error {
+	if wallet == "" {
+		return nil
+	}
+	query := `UPDATE TransactionHistory SET Wallet = ? WHERE TransactionID = ? AND Wallet IS NULL`
+	if _, err := r.db.ExecContext(ctx, query, wallet, transactionID); err != nil {
+		return fmt.Errorf("SetWallet: %v", err)
+	}
+	return nil
+}
+
+// where builds the WHERE clause selecting the rows of q, leaving out After, and its arguments.
+func (q *TransactionQuery) where() (string, []interface{}) {
+	clause, args := ` WHERE 1 = 1`, []interface{}{}
+	if q.UserID != "" {
+		clause += ` AND UserID = ?`
+		args = append(args, q.UserID)
+	}
+	if q.TransactionType != "" {
+		clause += ` AND TransactionType = ?`
+		args = append(args, q.TransactionType)
+	}
+	if len(q.Statuses) > 0 {
+		clause += ` AND TransactionStatus IN (?` + strings.Repeat(`, ?`, len(q.Statuses)-1) + `)`
+		for _, status := range q.Statuses {
+			args = append(args, status)
+		}
+	}
+	if q.Provider == "stripe" {
+		clause += ` AND (Provider = ? OR Provider IS NULL)`
+		args = append(args, q.Provider)
+	} else if q.Provider != "" {
+		clause += ` AND Provider = ?`
+		args = append(args, q.Provider)
+	}
+	if q.From != "" {
+		clause += ` AND TransactionDate >= ?`
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		clause += ` AND TransactionDate < ?`
+		args = append(args, q.To)
+	}
+	return clause, args
+}
+
+func (r *SQLTransactionRepository) FindTransactions(ctx context.Context, q *TransactionQuery) ([]*Transaction, error) {
+	where, args := q.where()
+	order, after := ` ORDER BY TransactionDate, TransactionID`, `>`
+	if q.NewestFirst {
+		order, after = ` ORDER BY TransactionDate DESC, TransactionID DESC`, `<`
+	}
+	if q.After != nil {
+		where += ` AND (TransactionDate ` + after + ` ? OR (TransactionDate = ? AND TransactionID ` + after + ` ?))`
+		args = append(args, q.After.TransactionDate, q.After.TransactionDate, q.After.TransactionID)
+	}
+	query := `SELECT ` + transactionColumns + ` FROM TransactionHistory` + where + order
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("FindTransactions: %v", err)
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("FindTransactions: %v", err)
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("FindTransactions: %v", err)
+	}
+	return transactions, nil
+}
+
+func (r *SQLTransactionRepository) SumTransactions(ctx context.Context, q *TransactionQuery) ([]*TransactionTotal, error) {
+	where, args := q.where()
+	query := `SELECT TransactionType, TransactionStatus, COALESCE(SUM(Amount), 0) FROM TransactionHistory` + where + `
+		GROUP BY TransactionType, TransactionStatus`
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("SumTransactions: %v", err)
+	}
+	defer rows.Close()
+
+	totals := []*TransactionTotal{}
+	for rows.Next() {
+		var total TransactionTotal
+		var amount float64
+		if err := rows.Scan(&total.TransactionType, &total.TransactionStatus, &amount); err != nil {
+			return nil, fmt.Errorf("SumTransactions: %v", err)
+		}
+		total.Amount = int64(amount)
+		totals = append(totals, &total)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SumTransactions: %v", err)
+	}
+	return totals, nil
+}
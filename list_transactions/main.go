@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// TransactionPage is returned by listTransactions. NextCursor is null on the last page.
+type TransactionPage struct {
+    Transactions []*Transaction `json:"transactions"`
+    NextCursor   *string        `json:"next_cursor"`
+}
+
+// Transaction is a row of the TransactionHistory table as shown to the user
+type Transaction struct {
+    TransactionID     string `json:"transaction_id"`
+    TransactionType   string `json:"type"`
+    Amount            int64  `json:"amount"`
+    TransactionStatus string `json:"status"`
+    TransactionDate   string `json:"date"`
+}
+
+const (
+    defaultPageSize = 25
+    maxPageSize     = 100
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// jsonResponse marshals body and wraps it in an APIGatewayProxyResponse with the given status code.
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+    response, err := json.Marshal(body)
+    if err != nil {
+        log.Printf("Error marshaling response: %v", err)
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, errors.New("internal server error")
+    }
+
+    return events.APIGatewayProxyResponse{
+        StatusCode: statusCode,
+        Body:       string(response),
+        Headers:    map[string]string{"Content-Type": "application/json"},
+    }, nil
+}
+
+// transactionCursor is the position after the last row of a page. It is handed to clients as an opaque string.
+type transactionCursor struct {
+    Date string `json:"d"`
+    ID   string `json:"i"`
+}
+
+func encodeCursor(t *Transaction) string {
+    raw, _ := json.Marshal(transactionCursor{Date: t.TransactionDate, ID: t.TransactionID})
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(cursor string) (*transactionCursor, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return nil, errors.New("invalid cursor")
+    }
+    var c transactionCursor
+    if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" {
+        return nil, errors.New("invalid cursor")
+    }
+    return &c, nil
+}
+
+// parseDateParam accepts either an RFC 3339 timestamp or a plain YYYY-MM-DD date.
+func parseDateParam(value string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t.UTC(), nil
+    }
+    return time.Parse("2006-01-02", value)
+}
+
+// buildTransactionsQuery turns the query string filters into a TransactionQuery. Rows are always restricted to
+// userID, and ordered newest first with TransactionID as a tie-breaker so that cursors stay stable as new rows arrive.
+func buildTransactionsQuery(userID string, params map[string]string, limit int) (*repository.TransactionQuery, error) {
+    // Fetch one extra row to know whether there is another page
+    q := &repository.TransactionQuery{UserID: userID, TransactionType: params["type"], NewestFirst: true, Limit: limit + 1}
+
+    if status := params["status"]; status != "" {
+        q.Statuses = []string{status}
+    }
+    if from := params["from"]; from != "" {
+        t, err := parseDateParam(from)
+        if err != nil {
+            return nil, errors.New("from must be a date or RFC 3339 timestamp")
+        }
+        q.From = t.Format(mysqlDateTimeLayout)
+    }
+    if to := params["to"]; to != "" {
+        t, err := parseDateParam(to)
+        if err != nil {
+            return nil, errors.New("to must be a date or RFC 3339 timestamp")
+        }
+        q.To = t.Format(mysqlDateTimeLayout)
+    }
+    if cursor := params["cursor"]; cursor != "" {
+        c, err := decodeCursor(cursor)
+        if err != nil {
+            return nil, err
+        }
+        q.After = &repository.Transaction{TransactionID: c.ID, TransactionDate: c.Date}
+    }
+    return q, nil
+}
+
+// listTransactions() returns one page of the caller's TransactionHistory, newest first. Only the caller's own rows,
+// resolved from their Cognito identity, are ever returned.
+//
+// Query string parameters (all optional):
+// - type, status: exact TransactionType / TransactionStatus to filter on.
+// - from, to: date range, from inclusive and to exclusive, as YYYY-MM-DD or RFC 3339.
+// - limit: page size, default 25 and at most 100.
+// - cursor: the next_cursor of the previous page.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest for GET /transactions.
+//
+// Returns:
+// - APIGatewayProxyResponse: Contains the HTTP status code, a TransactionPage body, and headers.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+func listTransactions(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+    params := request.QueryStringParameters
+
+    limit := defaultPageSize
+    if value := params["limit"]; value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed < 1 {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "limit must be a positive integer"}, nil
+        }
+        if parsed < maxPageSize {
+            limit = parsed
+        } else {
+            limit = maxPageSize
+        }
+    }
+
+    q, err := buildTransactionsQuery(userID, params, limit)
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+    }
+
+    rows, err := transactions.FindTransactions(ctx, q)
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error retrieving transactions"}, err
+    }
+
+    page := TransactionPage{Transactions: []*Transaction{}}
+    for _, row := range rows {
+        page.Transactions = append(page.Transactions, &Transaction{
+            TransactionID:     row.TransactionID,
+            TransactionType:   row.TransactionType,
+            Amount:            row.Amount,
+            TransactionStatus: row.TransactionStatus,
+            TransactionDate:   row.TransactionDate,
+        })
+    }
+
+    if len(page.Transactions) > limit {
+        page.Transactions = page.Transactions[:limit]
+        next := encodeCursor(page.Transactions[limit-1])
+        page.NextCursor = &next
+    }
+
+    return jsonResponse(http.StatusOK, page)
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := listTransactions(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(listTransactions)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/migrations"
+)
+
+// MigrateRequest selects what to do with the user_management schema
+type MigrateRequest struct {
+    Command string `json:"command"` // "apply", "rollback" or "status"
+    Steps   int    `json:"steps"`   // Number of migrations "rollback" reverts, defaults to 1
+}
+
+// MigrateResult lists the migrations a run applied or reverted, and the status of every migration
+type MigrateResult struct {
+    Applied    []string             `json:"applied,omitempty"`
+    RolledBack []string             `json:"rolled_back,omitempty"`
+    Status     []*migrations.Status `json:"status"`
+}
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local". Unlike the other functions it doesn't apply migrations on connect,
+// so a local rollback is not undone by the next run.
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Connect("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+
+func migrationNames(ms []*migrations.Migration) []string {
+    names := make([]string, 0, len(ms))
+    for _, m := range ms {
+        names = append(names, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+    }
+    return names
+}
+
+// migrate applies, rolls back or reports the schema migrations of the user_management database.
+// Every command returns the status of all migrations afterwards.
+//
+// Parameters:
+// - ctx: Provides context for the function, allowing handling of timeouts and cancellation signals.
+// - request: The command to run and, for "rollback", how many migrations to revert.
+//
+// Returns:
+// - *MigrateResult: The migrations that were applied or reverted and the resulting status.
+// - error: Returns an error for an unknown command or if a migration fails. Migrations that ran before the
+//          failing one stay applied.
+func migrate(ctx context.Context, request MigrateRequest) (*MigrateResult, error) {
+    migrator, err := migrations.NewMigrator(db, string(dialect))
+    if err != nil {
+        return nil, err
+    }
+
+    result := &MigrateResult{}
+    switch request.Command {
+        case "apply":
+            applied, err := migrator.Apply(ctx)
+            result.Applied = migrationNames(applied)
+            if err != nil {
+                return result, err
+            }
+
+        case "rollback":
+            steps := request.Steps
+            if steps <= 0 {
+                steps = 1
+            }
+            reverted, err := migrator.Rollback(ctx, steps)
+            result.RolledBack = migrationNames(reverted)
+            if err != nil {
+                return result, err
+            }
+
+        case "status":
+
+        default:
+            return nil, fmt.Errorf("unknown command %q, expected apply, rollback or status", request.Command)
+    }
+
+    result.Status, err = migrator.Status(ctx)
+    if err != nil {
+        return result, err
+    }
+    return result, nil
+}
+
+func main() {
+    // Run from the command line as "migrate [-steps n] apply|rollback|status"
+    steps := flag.Int("steps", 1, "number of migrations to roll back")
+    flag.Parse()
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+
+    // Without a command the request is read from event.json, like the other functions
+    request := MigrateRequest{Command: flag.Arg(0), Steps: *steps}
+    if request.Command == "" {
+        file, err := os.ReadFile("event.json")
+        if err != nil {
+            fmt.Printf("Failed to read file: %s\n", err)
+            return
+        }
+        if err := json.Unmarshal(file, &request); err != nil {
+            fmt.Printf("Failed to unmarshal request: %s\n", err)
+            return
+        }
+    }
+
+    ctx := context.Background()
+    result, err := migrate(ctx, request)
+    if result != nil {
+        for _, name := range result.Applied {
+            fmt.Printf("Applied %s\n", name)
+        }
+        for _, name := range result.RolledBack {
+            fmt.Printf("Rolled back %s\n", name)
+        }
+        for _, s := range result.Status {
+            state := "pending"
+            if s.Applied {
+                state = "applied " + s.AppliedAt
+            }
+            fmt.Printf("%04d_%s: %s\n", s.Version, s.Name, state)
+        }
+    }
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    //lambda.Start(migrate)
+}
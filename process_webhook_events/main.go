@@ -0,0 +1,869 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awslambda "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+type StripeWebhookEvent struct {
+    ID      string     `json:"id"`      // Event ID, used to skip events that were already processed
+    Type    string     `json:"type"`    // Type of event
+    Created int64      `json:"created"` // Unix time the event was created, used to skip events that arrive out of order
+    Data    StripeData `json:"data"`    // Nested data object
+}
+
+// StripeData contains the data object from Stripe webhook JSON. The object is left undecoded until the event's
+// handler decodes it into the type it expects, since its shape depends on the event type.
+type StripeData struct {
+    Object json.RawMessage `json:"object"`
+}
+
+// EventHandler applies one Stripe event. Every read and write it makes goes through tx, which applyEvent commits
+// together with the new version of the event's object.
+type EventHandler func(ctx context.Context, tx *eventTx, event StripeWebhookEvent) error
+
+// eventTx is the unit of work an event is applied in: repositories that work in the event's database transaction,
+// or in memory when the handlers are tested. Work that must wait until the event's writes are committed, such as
+// invoking a Lambda that reads them, is queued with afterCommit.
+type eventTx struct {
+    users        repository.UserRepository
+    transactions repository.TransactionRepository
+    committed    []func()
+}
+
+// Dispatcher routes events to the handler registered for their type.
+type Dispatcher struct {
+    handlers map[string]EventHandler
+}
+
+// PaymentIntent holds the specific details about the payment intent
+type PaymentIntent struct {
+    ID          string `json:"id"`          // Transaction ID
+    Amount      int64  `json:"amount"`      // Amount in cents
+    Currency    string `json:"currency"`    // Currency code, e.g., "usd"
+    Description string `json:"description"` // Description of the payment
+    Customer    string `json:"customer"`    // Customer ID
+    Metadata    map[string]string `json:"metadata"` // Set by our handlers, holds the UserID and, for providers other than Stripe, the Provider and Wallet
+    Charges     ChargeList        `json:"charges"`  // Charges of the payment intent, newest first
+}
+
+// ChargeList holds the charges embedded in a payment intent. Only the wallet of a card charge is read from them.
+type ChargeList struct {
+    Data []struct {
+        PaymentMethodDetails struct {
+            Card *struct {
+                Wallet *struct {
+                    Type string `json:"type"` // e.g. "apple_pay" or "google_pay"
+                } `json:"wallet"`
+            } `json:"card"`
+        } `json:"payment_method_details"`
+    } `json:"data"`
+}
+
+// Charge holds the details of a charge.* event object
+type Charge struct {
+    ID             string            `json:"id"`              // Charge ID
+    Amount         int64             `json:"amount"`          // Charged amount in cents
+    AmountRefunded int64             `json:"amount_refunded"` // Refunded amount in cents, which may be less than the charge
+    Currency       string            `json:"currency"`        // Currency code, e.g., "usd"
+    Refunded       bool              `json:"refunded"`        // True once the charge has been refunded in full
+    PaymentIntent  string            `json:"payment_intent"`  // Payment intent the charge was made for
+    Metadata       map[string]string `json:"metadata"`        // Copied from the payment intent, holds the UserID
+}
+
+// Dispute holds the details of a charge.dispute.* event object
+type Dispute struct {
+    ID            string `json:"id"`             // Dispute ID
+    Amount        int64  `json:"amount"`         // Disputed amount in cents
+    Currency      string `json:"currency"`       // Currency code, e.g., "usd"
+    PaymentIntent string `json:"payment_intent"` // Payment intent of the disputed charge
+    Status        string `json:"status"`         // e.g. "needs_response", "won", "lost", "warning_closed"
+}
+
+// CheckoutSession holds the details of a checkout.session.* event object. Deposits made through Checkout are
+// recorded under their payment intent, so the session's events and the intent's own events update the same row.
+type CheckoutSession struct {
+    ID                string            `json:"id"`                  // Checkout Session ID
+    PaymentIntent     string            `json:"payment_intent"`      // Payment intent created by the session
+    AmountTotal       int64             `json:"amount_total"`        // Amount in cents
+    Currency          string            `json:"currency"`            // Currency code, e.g., "usd"
+    PaymentStatus     string            `json:"payment_status"`      // "paid", or "unpaid" until a delayed payment settles
+    ClientReferenceID string            `json:"client_reference_id"` // UserID, set by createCheckoutSession
+    Metadata          map[string]string `json:"metadata"`            // Set by createCheckoutSession, holds the UserID
+}
+
+// Lambda that reloads a user's wallet when their balance drops below their auto top-up threshold
+const autoTopUpFunctionName = "auto_top_up"
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var dispatcher = newWebhookDispatcher()
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// afterCommit queues fn to run once tx is committed. It never runs if tx is rolled back.
+func (tx *eventTx) afterCommit(fn func()) {
+    tx.committed = append(tx.committed, fn)
+}
+
+// insertTransaction records a transaction handled by provider, such as "stripe" or "adyen", and paid with wallet,
+// such as "apple_pay", or "" for none, in currency, such as "usd".
+func insertTransaction(ctx context.Context, tx *eventTx, transactionID, userID, transactionType, transactionStatus, transactionDate, provider, wallet, currency string, amount int64) error {
+    err := tx.transactions.InsertTransaction(ctx, &repository.Transaction{
+        TransactionID:     transactionID,
+        UserID:            userID,
+        TransactionType:   transactionType,
+        Amount:            amount,
+        TransactionStatus: transactionStatus,
+        TransactionDate:   transactionDate,
+        Provider:          provider,
+        Wallet:            wallet,
+        Currency:          currency,
+    })
+    if err != nil {
+        return fmt.Errorf("error inserting new transaction: %w", err)
+    }
+
+    log.Printf("Inserted new transaction record successfully for user ID %s", userID)
+    return nil
+}
+
+// getTransactionStatus returns the TransactionStatus of a TransactionHistory row. found is false if there is no row.
+// Read it after locking the row's user, so that it can't change before tx commits.
+func getTransactionStatus(ctx context.Context, tx *eventTx, transactionID string) (status string, found bool, err error) {
+    t, err := tx.transactions.GetTransaction(ctx, transactionID)
+    if errors.Is(err, repository.ErrNotFound) {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, fmt.Errorf("getTransactionStatus: %w", err)
+    }
+    return t.TransactionStatus, true, nil
+}
+
+// resolveUserID finds the user a payment intent belongs to, from its UserID metadata or, for intents created
+// before that metadata was set, from the TransactionHistory row recorded for it.
+func resolveUserID(ctx context.Context, tx *eventTx, pi PaymentIntent) (string, error) {
+    if userID := pi.Metadata["UserID"]; userID != "" {
+        return userID, nil
+    }
+    return transactionUserID(ctx, tx, pi.ID)
+}
+
+// intentProvider returns the provider that took a payment intent. Events built from another provider's
+// notifications name it in the metadata; Stripe's own events don't.
+func intentProvider(pi PaymentIntent) string {
+    if provider := pi.Metadata["Provider"]; provider != "" {
+        return provider
+    }
+    return "stripe"
+}
+
+// intentWallet returns the wallet a payment intent was paid with, or "" if none or not known yet. Events built from
+// another provider's notifications name it in the metadata; Stripe's own events carry it on the charge.
+func intentWallet(pi PaymentIntent) string {
+    if wallet := pi.Metadata["Wallet"]; wallet != "" {
+        return wallet
+    }
+    for _, charge := range pi.Charges.Data {
+        if card := charge.PaymentMethodDetails.Card; card != nil && card.Wallet != nil {
+            return card.Wallet.Type
+        }
+    }
+    return ""
+}
+
+// transactionUserID returns the UserID of the TransactionHistory row with the given TransactionID. The error matches
+// repository.ErrNotFound if there is no row.
+func transactionUserID(ctx context.Context, tx *eventTx, transactionID string) (string, error) {
+    t, err := tx.transactions.GetTransaction(ctx, transactionID)
+    if err != nil {
+        return "", fmt.Errorf("transactionUserID: %w", err)
+    }
+    return t.UserID, nil
+}
+
+// triggerAutoTopUp asynchronously invokes the auto top-up Lambda after a balance change so it can check the
+// user's threshold. Failures are only logged; a missed check must never fail the webhook.
+func triggerAutoTopUp(userID string) {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return
+    }
+
+    payload, err := json.Marshal(map[string]string{"UserID": userID})
+    if err != nil {
+        log.Printf("Error marshaling auto top-up event: %v", err)
+        return
+    }
+
+    _, err = awslambda.New(sess).Invoke(&awslambda.InvokeInput{
+        FunctionName:   aws.String(autoTopUpFunctionName),
+        InvocationType: aws.String(awslambda.InvocationTypeEvent),
+        Payload:        payload,
+    })
+    if err != nil {
+        log.Printf("Error invoking auto top-up for user %s: %v", userID, err)
+    }
+}
+
+// eventProcessed reports whether the event with the given ID was already processed successfully.
+func eventProcessed(eventID string) (bool, error) {
+    var count int
+    query := `SELECT COUNT(*) FROM WebhookEvents WHERE EventID = ? AND Status = 'Processed'`
+    if err := db.QueryRow(query, eventID).Scan(&count); err != nil {
+        return false, fmt.Errorf("eventProcessed: %v", err)
+    }
+    return count > 0, nil
+}
+
+// markEventProcessed records that an event was processed, so a redelivery or a backfill of it is skipped.
+func markEventProcessed(eventID, eventType, payload string) error {
+    now := time.Now().UTC().Format(mysqlDateTimeLayout)
+    query := `INSERT INTO WebhookEvents (EventID, EventType, Payload, Status, Attempts, ReceivedAt, ProcessedAt)
+              VALUES (?, ?, ?, 'Processed', 1, ?, ?)
+              ` + dialect.OnConflictUpdate("EventID", "Status = 'Processed'", "Attempts = Attempts + 1", "LastError = NULL",
+                  "ProcessedAt = "+dialect.Excluded("ProcessedAt"))
+    _, err := db.Exec(query, eventID, eventType, payload, now, now)
+    if err != nil {
+        return fmt.Errorf("markEventProcessed: %v", err)
+    }
+    return nil
+}
+
+// markEventFailed records a failed attempt at processing an event.
+func markEventFailed(eventID string, reason error) error {
+    query := `UPDATE WebhookEvents SET Status = 'Failed', Attempts = Attempts + 1, LastError = ? WHERE EventID = ?`
+    _, err := db.Exec(query, reason.Error(), eventID)
+    if err != nil {
+        return fmt.Errorf("markEventFailed: %v", err)
+    }
+    return nil
+}
+
+// handlePaymentIntentProcessing records a delayed-settlement payment (ACH) as in flight. The row is created if
+// confirmPayment has not written it yet, in which case its amount is added to the pending balance here; a
+// "Pending" row written by confirmPayment is already counted in the pending balance, while a "Failed" one being
+// retried is counted again.
+func handlePaymentIntentProcessing(ctx context.Context, tx *eventTx, pi PaymentIntent) error {
+    userID, err := resolveUserID(ctx, tx, pi)
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    status, found, err := getTransactionStatus(ctx, tx, pi.ID)
+    if err != nil {
+        return err
+    }
+
+    if !found {
+        if err := insertTransaction(ctx, tx, pi.ID, userID, "Deposit", "Processing", time.Now().UTC().Format(mysqlDateTimeLayout), intentProvider(pi), intentWallet(pi), pi.Currency, pi.Amount); err != nil {
+            return err
+        }
+        return tx.users.AddPendingBalance(ctx, userID, pi.Amount)
+    }
+    if err := tx.transactions.SetWallet(ctx, pi.ID, intentWallet(pi)); err != nil {
+        return err
+    }
+
+    moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Processing", time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil || !moved || status != "Failed" {
+        return err
+    }
+    return tx.users.AddPendingBalance(ctx, userID, pi.Amount)
+}
+
+// handlePaymentIntentSucceeded completes the deposit and makes its amount available. Amounts held as pending by
+// confirmPayment, handlePaymentIntentProcessing or handlePaymentIntentAmountCapturableUpdated are released first. A row that is already "Completed"
+// means Stripe redelivered the event, and the balance is not credited again.
+func handlePaymentIntentSucceeded(ctx context.Context, tx *eventTx, pi PaymentIntent) error {
+    userID, err := resolveUserID(ctx, tx, pi)
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    status, found, err := getTransactionStatus(ctx, tx, pi.ID)
+    if err != nil {
+        return err
+    }
+
+    if found {
+        if err := tx.transactions.SetWallet(ctx, pi.ID, intentWallet(pi)); err != nil {
+            return err
+        }
+    }
+
+    switch {
+    case !found:
+        if err := insertTransaction(ctx, tx, pi.ID, userID, "Deposit", "Completed", time.Now().UTC().Format(mysqlDateTimeLayout), intentProvider(pi), intentWallet(pi), pi.Currency, pi.Amount); err != nil {
+            return err
+        }
+    case status == "Completed":
+        log.Printf("Payment %s was already credited", pi.ID)
+        return nil
+    default:
+        // Update transaction history
+        moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Completed", time.Now().UTC().Format(mysqlDateTimeLayout))
+        if err != nil {
+            return err
+        }
+        if !moved {
+            log.Printf("Payment %s was already credited", pi.ID)
+            return nil
+        }
+        if status == "Pending" || status == "Processing" || status == "Authorized" {
+            if err := tx.users.AddPendingBalance(ctx, userID, -pi.Amount); err != nil {
+                return err
+            }
+        }
+    }
+
+    // Update user balance
+    if err := tx.users.AddAccountBalance(ctx, userID, pi.Amount); err != nil {
+        return err
+    }
+    // The new balance may still be under the user's auto top-up threshold
+    tx.afterCommit(func() { triggerAutoTopUp(userID) })
+    return nil
+}
+
+// handlePaymentIntentAmountCapturableUpdated records a deposit created with manual capture as "Authorized" once its
+// payment is authorised. The amount is held as pending until the deposit is captured, which Stripe reports as
+// "payment_intent.succeeded", or canceled. A "Pending" row written by confirmPayment is already counted in the
+// pending balance, while a "Failed" one being retried is counted again.
+func handlePaymentIntentAmountCapturableUpdated(ctx context.Context, tx *eventTx, pi PaymentIntent) error {
+    userID, err := resolveUserID(ctx, tx, pi)
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    status, found, err := getTransactionStatus(ctx, tx, pi.ID)
+    if err != nil {
+        return err
+    }
+
+    if !found {
+        if err := insertTransaction(ctx, tx, pi.ID, userID, "Deposit", "Authorized", time.Now().UTC().Format(mysqlDateTimeLayout), intentProvider(pi), intentWallet(pi), pi.Currency, pi.Amount); err != nil {
+            return err
+        }
+        return tx.users.AddPendingBalance(ctx, userID, pi.Amount)
+    }
+    if err := tx.transactions.SetWallet(ctx, pi.ID, intentWallet(pi)); err != nil {
+        return err
+    }
+
+    moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Authorized", time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil || !moved || status != "Failed" {
+        return err
+    }
+    return tx.users.AddPendingBalance(ctx, userID, pi.Amount)
+}
+
+// handlePaymentIntentFailed marks an in-flight deposit "Failed" and drops it from the pending balance.
+func handlePaymentIntentFailed(ctx context.Context, tx *eventTx, pi PaymentIntent) error {
+    userID, err := resolveUserID(ctx, tx, pi)
+    if errors.Is(err, repository.ErrNotFound) {
+        // Nothing was recorded for a payment that never got as far as confirmPayment
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    status, found, err := getTransactionStatus(ctx, tx, pi.ID)
+    if err != nil || !found {
+        return err
+    }
+
+    moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Failed", time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil || !moved {
+        return err
+    }
+    return tx.users.AddPendingBalance(ctx, userID, -pi.Amount)
+}
+
+// handlePaymentIntentCanceled marks a deposit "Canceled", since a canceled intent can't be retried, and drops it
+// from the pending balance unless it had already failed. cancelPaymentIntent usually got there first, in which case
+// the row is already "Canceled" and this is a no-op.
+func handlePaymentIntentCanceled(ctx context.Context, tx *eventTx, pi PaymentIntent) error {
+    userID, err := resolveUserID(ctx, tx, pi)
+    if errors.Is(err, repository.ErrNotFound) {
+        // Nothing was recorded for a payment that never got as far as confirmPayment
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    status, found, err := getTransactionStatus(ctx, tx, pi.ID)
+    if err != nil || !found {
+        return err
+    }
+
+    moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Canceled", time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil || !moved || status == "Failed" {
+        return err
+    }
+    return tx.users.AddPendingBalance(ctx, userID, -pi.Amount)
+}
+
+// handleChargeRefunded marks a deposit whose charge was refunded in full "Refunded" and takes its amount back out of
+// the user's available balance. Stripe says whether the charge was refunded in full; Adyen only reports the amount
+// refunded, so a refund of at least the deposit's amount is taken as a full one. Stripe doesn't deliver events in
+// order, so the refund may be reported before the payment's success: a deposit still in flight is dropped from the
+// pending balance instead, and one with no row yet is recorded as "Refunded" straight away. Either way the late
+// "payment_intent.succeeded" is then an illegal transition and never credits the deposit. Partial refunds are only
+// logged.
+func handleChargeRefunded(ctx context.Context, tx *eventTx, charge Charge) error {
+    if charge.PaymentIntent == "" {
+        log.Printf("Charge %s has no payment intent, ignoring its refund", charge.ID)
+        return nil
+    }
+
+    pi := PaymentIntent{ID: charge.PaymentIntent, Amount: charge.Amount, Currency: charge.Currency, Metadata: charge.Metadata}
+    userID, err := resolveUserID(ctx, tx, pi)
+    if errors.Is(err, repository.ErrNotFound) {
+        log.Printf("No user recorded for refunded payment %s, ignoring it", pi.ID)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    deposit, err := tx.transactions.GetTransaction(ctx, pi.ID)
+    found := err == nil
+    if err != nil && !errors.Is(err, repository.ErrNotFound) {
+        return err
+    }
+    if !charge.Refunded && !(found && charge.AmountRefunded >= deposit.Amount) {
+        log.Printf("Charge %s of payment %s was partially refunded (%d cents), leaving the deposit as it is",
+            charge.ID, charge.PaymentIntent, charge.AmountRefunded)
+        return nil
+    }
+    if !found {
+        return insertTransaction(ctx, tx, pi.ID, userID, "Deposit", "Refunded", time.Now().UTC().Format(mysqlDateTimeLayout), intentProvider(pi), "", pi.Currency, pi.Amount)
+    }
+
+    status := deposit.TransactionStatus
+    moved, err := tx.transactions.TransitionTransaction(ctx, pi.ID, status, "Refunded", time.Now().UTC().Format(mysqlDateTimeLayout))
+    if err != nil || !moved {
+        return err
+    }
+    switch status {
+    case "Completed":
+        if err := tx.users.RemoveAccountBalance(ctx, userID, deposit.Amount); err != nil {
+            return err
+        }
+        // The refund may have taken the balance under the user's auto top-up threshold
+        tx.afterCommit(func() { triggerAutoTopUp(userID) })
+        return nil
+    case "Pending", "Processing", "Authorized":
+        return tx.users.AddPendingBalance(ctx, userID, -deposit.Amount)
+    }
+    return nil
+}
+
+// handleDisputeCreated holds the disputed amount so it can't be spent or withdrawn while the dispute is open.
+// The hold is recorded as a "Dispute" row keyed by the dispute ID, which also makes redelivered events a no-op.
+func handleDisputeCreated(ctx context.Context, tx *eventTx, dispute Dispute) error {
+    userID, err := transactionUserID(ctx, tx, dispute.PaymentIntent)
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+    _, found, err := getTransactionStatus(ctx, tx, dispute.ID)
+    if err != nil {
+        return err
+    }
+    if found {
+        log.Printf("Dispute %s already recorded", dispute.ID)
+        return nil
+    }
+
+    if err := insertTransaction(ctx, tx, dispute.ID, userID, "Dispute", "Held", time.Now().UTC().Format(mysqlDateTimeLayout), "stripe", "", dispute.Currency, dispute.Amount); err != nil {
+        return err
+    }
+    if err := tx.users.HoldBalance(ctx, userID, dispute.Amount); err != nil {
+        return err
+    }
+    // The held amount is no longer available, which may take the balance under the auto top-up threshold. Closing
+    // the dispute never lowers it further: a lost dispute only drops the hold.
+    tx.afterCommit(func() { triggerAutoTopUp(userID) })
+    return nil
+}
+
+// handleDisputeClosed releases a dispute hold. A won dispute, or an inquiry closed without becoming a chargeback
+// ("warning_closed"), returns the funds to the available balance; a lost one removes them, since Stripe has already
+// taken the money back. A dispute closed with any other status is logged and its hold left in place.
+func handleDisputeClosed(ctx context.Context, tx *eventTx, dispute Dispute) error {
+    userID, err := transactionUserID(ctx, tx, dispute.ID)
+    if errors.Is(err, repository.ErrNotFound) {
+        log.Printf("No open hold for dispute %s", dispute.ID)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := tx.users.LockUser(ctx, userID); err != nil {
+        return err
+    }
+
+    switch dispute.Status {
+    case "won", "warning_closed":
+        moved, err := tx.transactions.TransitionTransaction(ctx, dispute.ID, "Held", "Released", time.Now().UTC().Format(mysqlDateTimeLayout))
+        if err != nil || !moved {
+            return err
+        }
+        return tx.users.HoldBalance(ctx, userID, -dispute.Amount)
+    case "lost":
+        moved, err := tx.transactions.TransitionTransaction(ctx, dispute.ID, "Held", "Lost", time.Now().UTC().Format(mysqlDateTimeLayout))
+        if err != nil || !moved {
+            return err
+        }
+        return tx.users.ReleaseHeldBalance(ctx, userID, dispute.Amount)
+    }
+    log.Printf("Dispute %s closed with status %q, leaving its hold in place", dispute.ID, dispute.Status)
+    return nil
+}
+
+// sessionIntent returns the payment intent of a Checkout Session, as the payment intent handlers take it.
+func sessionIntent(checkoutSession CheckoutSession) PaymentIntent {
+    userID := checkoutSession.Metadata["UserID"]
+    if userID == "" {
+        userID = checkoutSession.ClientReferenceID
+    }
+    return PaymentIntent{
+        ID:       checkoutSession.PaymentIntent,
+        Amount:   checkoutSession.AmountTotal,
+        Currency: checkoutSession.Currency,
+        Metadata: map[string]string{"UserID": userID},
+    }
+}
+
+// handleCheckoutSessionCompleted records a deposit made through Checkout like any other payment intent: a paid
+// session completes the deposit, and an unpaid one is a delayed-settlement payment (ACH) whose outcome arrives later
+// as a payment_intent event. Whichever of the session and intent events comes first writes the row, and the other
+// finds it already there.
+func handleCheckoutSessionCompleted(ctx context.Context, tx *eventTx, checkoutSession CheckoutSession) error {
+    if checkoutSession.PaymentIntent == "" {
+        log.Printf("Checkout Session %s has no payment intent, ignoring it", checkoutSession.ID)
+        return nil
+    }
+
+    switch checkoutSession.PaymentStatus {
+    case "paid":
+        return handlePaymentIntentSucceeded(ctx, tx, sessionIntent(checkoutSession))
+    case "unpaid":
+        return handlePaymentIntentProcessing(ctx, tx, sessionIntent(checkoutSession))
+    }
+    log.Printf("Checkout Session %s completed with payment status %q, ignoring it", checkoutSession.ID, checkoutSession.PaymentStatus)
+    return nil
+}
+
+// handleCheckoutSessionExpired handles a Checkout Session the user abandoned. Nothing was paid, so usually no row
+// exists; one recorded for the session's payment intent is marked "Failed" like a declined payment.
+func handleCheckoutSessionExpired(ctx context.Context, tx *eventTx, checkoutSession CheckoutSession) error {
+    if checkoutSession.PaymentIntent == "" {
+        log.Printf("Checkout Session %s expired", checkoutSession.ID)
+        return nil
+    }
+    return handlePaymentIntentFailed(ctx, tx, sessionIntent(checkoutSession))
+}
+
+// objectHandler adapts a handler of a decoded data object, such as handlePaymentIntentSucceeded, to an EventHandler.
+// The object is only decoded once the event has been routed to it.
+func objectHandler[T any](handle func(ctx context.Context, tx *eventTx, object T) error) EventHandler {
+    return func(ctx context.Context, tx *eventTx, event StripeWebhookEvent) error {
+        var object T
+        if err := json.Unmarshal(event.Data.Object, &object); err != nil {
+            return fmt.Errorf("error decoding %s object: %v", event.Type, err)
+        }
+        return handle(ctx, tx, object)
+    }
+}
+
+func newDispatcher() *Dispatcher {
+    return &Dispatcher{handlers: map[string]EventHandler{}}
+}
+
+// Register routes events of eventType to handler, replacing any handler registered for it before.
+func (d *Dispatcher) Register(eventType string, handler EventHandler) {
+    d.handlers[eventType] = handler
+}
+
+// Dispatch passes event to the handler registered for its type. Events of other types are logged and
+// acknowledged, since Stripe sends every type the endpoint is subscribed to.
+func (d *Dispatcher) Dispatch(ctx context.Context, tx *eventTx, event StripeWebhookEvent) error {
+    handler, ok := d.handlers[event.Type]
+    if !ok {
+        log.Printf("No handler for %s event %s, ignoring it", event.Type, event.ID)
+        return nil
+    }
+    return handler(ctx, tx, event)
+}
+
+// newWebhookDispatcher registers the handler of every event type the webhook acts on.
+func newWebhookDispatcher() *Dispatcher {
+    d := newDispatcher()
+    d.Register("payment_intent.processing", objectHandler(handlePaymentIntentProcessing))
+    d.Register("payment_intent.amount_capturable_updated", objectHandler(handlePaymentIntentAmountCapturableUpdated))
+    d.Register("payment_intent.succeeded", objectHandler(handlePaymentIntentSucceeded))
+    d.Register("payment_intent.payment_failed", objectHandler(handlePaymentIntentFailed))
+    d.Register("payment_intent.canceled", objectHandler(handlePaymentIntentCanceled))
+    d.Register("charge.refunded", objectHandler(handleChargeRefunded))
+    d.Register("charge.dispute.created", objectHandler(handleDisputeCreated))
+    d.Register("charge.dispute.closed", objectHandler(handleDisputeClosed))
+    d.Register("checkout.session.completed", objectHandler(handleCheckoutSessionCompleted))
+    d.Register("checkout.session.expired", objectHandler(handleCheckoutSessionExpired))
+    return d
+}
+
+// eventObjectID returns the ID of an event's data object, or "" if it has none.
+func eventObjectID(event StripeWebhookEvent) string {
+    var object struct {
+        ID string `json:"id"`
+    }
+    if err := json.Unmarshal(event.Data.Object, &object); err != nil {
+        return ""
+    }
+    return object.ID
+}
+
+// claimObjectVersion advances the version of a Stripe object to the created time of an event about to be applied to
+// it, and reports false instead if the event is stale: older than the newest event already applied to the object.
+// The object's row stays locked until tx ends, so events for the same object are checked and applied one at a time,
+// and the version only advances if the event's own writes are committed with it. Events created in the same second
+// are not considered stale; the status transitions decide between them.
+func claimObjectVersion(ctx context.Context, tx *sql.Tx, objectID string, created int64) (bool, error) {
+    // Make sure the row exists, so that there is something to lock
+    insert := `INSERT INTO StripeObjectVersions (ObjectID, LastEventCreated) VALUES (?, ?) ` + dialect.OnConflictDoNothing("ObjectID")
+    if _, err := tx.ExecContext(ctx, insert, objectID, created); err != nil {
+        return false, fmt.Errorf("claimObjectVersion: %v", err)
+    }
+
+    var lastCreated int64
+    query := `SELECT LastEventCreated FROM StripeObjectVersions WHERE ObjectID = ?` + dialect.ForUpdate()
+    if err := tx.QueryRowContext(ctx, query, objectID).Scan(&lastCreated); err != nil {
+        return false, fmt.Errorf("claimObjectVersion: %v", err)
+    }
+    if created < lastCreated {
+        return false, nil
+    }
+    if created == lastCreated {
+        return true, nil
+    }
+
+    update := `UPDATE StripeObjectVersions SET LastEventCreated = ? WHERE ObjectID = ?`
+    if _, err := tx.ExecContext(ctx, update, created, objectID); err != nil {
+        return false, fmt.Errorf("claimObjectVersion: %v", err)
+    }
+    return true, nil
+}
+
+// applyEvent applies an event in a single database transaction: the version of its object is claimed first, so an
+// event older than one already applied to the same object is skipped, then the event is dispatched. Work the handler
+// queued with afterCommit runs once everything is committed. Illegal status transitions are logged and dropped,
+// leaving the version as it was: the row already reflects a later state, so retrying can't help.
+func applyEvent(ctx context.Context, event StripeWebhookEvent) error {
+    objectID := eventObjectID(event)
+
+    var committed []func()
+    err := database.WithTransaction(ctx, db, func(sqlTx *sql.Tx) error {
+        if objectID != "" && event.Created > 0 {
+            current, err := claimObjectVersion(ctx, sqlTx, objectID, event.Created)
+            if err != nil {
+                return err
+            }
+            if !current {
+                log.Printf("Ignoring stale %s event %s for %s", event.Type, event.ID, objectID)
+                return nil
+            }
+        }
+
+        tx := &eventTx{
+            users:        repository.NewSQLUserRepository(sqlTx, dialect),
+            transactions: repository.NewSQLTransactionRepository(sqlTx),
+        }
+        if err := dispatcher.Dispatch(ctx, tx, event); err != nil {
+            return err
+        }
+        committed = tx.committed
+        return nil
+    })
+    if errors.Is(err, repository.ErrIllegalTransition) {
+        log.Printf("Ignoring %s event %s: %v", event.Type, event.ID, err)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    for _, fn := range committed {
+        fn()
+    }
+    return nil
+}
+
+// processMessage applies one queued Stripe event. Events with an ID are skipped if they were already processed,
+// and their outcome is recorded in WebhookEvents. Events without an ID are built by the pending sweeper; they are
+// safe to apply twice because every handler checks the row's current status.
+func processMessage(ctx context.Context, body string) error {
+    var webhookEvent StripeWebhookEvent
+    if err := json.Unmarshal([]byte(body), &webhookEvent); err != nil {
+        // A message that can't be decoded will never succeed; let it go to the dead-letter queue
+        return fmt.Errorf("error unmarshaling event: %v", err)
+    }
+
+    fmt.Printf("Event ID: %s\n", webhookEvent.ID)
+    fmt.Printf("Event Type: %s\n", webhookEvent.Type)
+
+    if webhookEvent.ID == "" {
+        return applyEvent(ctx, webhookEvent)
+    }
+
+    processed, err := eventProcessed(webhookEvent.ID)
+    if err != nil {
+        return err
+    }
+    if processed {
+        log.Printf("Event %s was already processed", webhookEvent.ID)
+        return nil
+    }
+
+    if err := applyEvent(ctx, webhookEvent); err != nil {
+        if markErr := markEventFailed(webhookEvent.ID, err); markErr != nil {
+            log.Printf("Error recording failure of event %s: %v", webhookEvent.ID, markErr)
+        }
+        return err
+    }
+    if err := markEventProcessed(webhookEvent.ID, webhookEvent.Type, body); err != nil {
+        // The event itself was applied, and every handler is safe to run again, so don't retry the message
+        log.Printf("Error recording event %s as processed: %v", webhookEvent.ID, err)
+    }
+    return nil
+}
+
+// processWebhookEvents() consumes the Stripe events queued by the webhook endpoint and routes each to the handler
+// registered for its type in newWebhookDispatcher. Each event is applied in one database transaction. Stripe doesn't
+// deliver events in order, so an event older than one already applied to the same object is skipped, and
+// repository.CanTransition rejects status moves such as "Completed" to "Failed". The handlers move funds between the
+// user's balances:
+// - PendingBalance: deposits that are confirmed but not yet settled. confirmPayment adds to it, and
+//   "payment_intent.processing" does for ACH payments confirmed on the frontend. Deposits created with manual
+//   capture are held here as "Authorized" once "payment_intent.amount_capturable_updated" reports the authorisation.
+// - AccountBalance: the available, spendable balance. "payment_intent.succeeded" moves the deposit here from
+//   pending and marks the transaction "Completed"; "payment_intent.payment_failed" drops it from pending as "Failed", and
+//   "payment_intent.canceled" as "Canceled". "charge.refunded" takes a deposit refunded in full back out as
+//   "Refunded", or drops it from pending if the refund is reported before the payment's success.
+//   Deposits made through Stripe Checkout are handled the same way: "checkout.session.completed" completes a paid
+//   session's payment intent or holds an unpaid one as pending, and "checkout.session.expired" drops it.
+// - HeldBalance: funds under an open dispute. "charge.dispute.created" moves the disputed amount here from
+//   the available balance, and "charge.dispute.closed" returns it (won, or an inquiry
+//   closed as "warning_closed") or removes it (lost).
+// Bet stakes are held and settled by settleBet, not here.
+//
+// Messages that fail are reported back as batch item failures, so SQS makes them visible again and retries them.
+// After the queue's maxReceiveCount attempts SQS moves a message to the dead-letter queue, from where it can be
+// sent back with redriveWebhookEvents. The event source mapping must have ReportBatchItemFailures enabled.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - sqsEvent: A batch of messages from the webhook queue. Each body is a Stripe event.
+//
+// Returns:
+// - SQSEventResponse: The IDs of the messages that failed and should be retried.
+// - error: Always nil; failures are reported per message.
+func processWebhookEvents(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+    var response events.SQSEventResponse
+    for _, message := range sqsEvent.Records {
+        if err := processMessage(ctx, message.Body); err != nil {
+            log.Printf("Error processing message %s: %v", message.MessageId, err)
+            response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+        }
+    }
+    return response, nil
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var sqsEvent events.SQSEvent
+    err = json.Unmarshal(file, &sqsEvent)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    ctx := context.Background()
+    response, err := processWebhookEvents(ctx, sqsEvent)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(processWebhookEvents)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// testLedger holds the memory repositories the handlers of a test write to.
+type testLedger struct {
+	users        *repository.MemoryUserRepository
+	transactions *repository.MemoryTransactionRepository
+}
+
+// newTestLedger returns memory repositories holding user_1 with the given balances, in cents.
+func newTestLedger(account, pending, held, withdrawable int64) *testLedger {
+	l := &testLedger{
+		users:        repository.NewMemoryUserRepository(),
+		transactions: repository.NewMemoryTransactionRepository(),
+	}
+	l.users.PutUser(repository.User{
+		UserID:              "user_1",
+		AccountBalance:      account,
+		PendingBalance:      pending,
+		HeldBalance:         held,
+		WithdrawableBalance: withdrawable,
+	})
+	return l
+}
+
+// putTransaction adds a row for user_1 in the given status.
+func (l *testLedger) putTransaction(t *testing.T, transactionID, transactionType, status string, amount int64) {
+	t.Helper()
+	err := l.transactions.InsertTransaction(context.Background(), &repository.Transaction{
+		TransactionID:     transactionID,
+		UserID:            "user_1",
+		TransactionType:   transactionType,
+		Amount:            amount,
+		TransactionStatus: status,
+		TransactionDate:   "2024-01-01 00:00:00",
+		Provider:          "stripe",
+	})
+	if err != nil {
+		t.Fatalf("InsertTransaction: %v", err)
+	}
+}
+
+// dispatch routes an event with the given data object through the webhook's dispatcher, as applyEvent does, and
+// returns the unit of work it was applied in.
+func (l *testLedger) dispatch(t *testing.T, eventType string, object interface{}) (*eventTx, error) {
+	t.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("error encoding %s object: %v", eventType, err)
+	}
+	tx := &eventTx{users: l.users, transactions: l.transactions}
+	err = dispatcher.Dispatch(context.Background(), tx, StripeWebhookEvent{ID: "evt_1", Type: eventType, Data: StripeData{Object: raw}})
+	return tx, err
+}
+
+// checkBalances fails the test unless user_1 has the given balances, in cents.
+func (l *testLedger) checkBalances(t *testing.T, account, pending, held, withdrawable int64) {
+	t.Helper()
+	u, err := l.users.GetUser(context.Background(), "user_1")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.AccountBalance != account || u.PendingBalance != pending || u.HeldBalance != held || u.WithdrawableBalance != withdrawable {
+		t.Errorf("balances = account %d, pending %d, held %d, withdrawable %d; want %d, %d, %d, %d",
+			u.AccountBalance, u.PendingBalance, u.HeldBalance, u.WithdrawableBalance, account, pending, held, withdrawable)
+	}
+}
+
+// checkStatus fails the test unless the row has the given status.
+func (l *testLedger) checkStatus(t *testing.T, transactionID, want string) {
+	t.Helper()
+	row, err := l.transactions.GetTransaction(context.Background(), transactionID)
+	if err != nil {
+		t.Fatalf("GetTransaction(%s): %v", transactionID, err)
+	}
+	if row.TransactionStatus != want {
+		t.Errorf("%s is %q, want %q", transactionID, row.TransactionStatus, want)
+	}
+}
+
+func paymentIntent(amount int64) map[string]interface{} {
+	return map[string]interface{}{"id": "pi_1", "amount": amount, "currency": "usd", "metadata": map[string]string{"UserID": "user_1"}}
+}
+
+func TestPaymentIntentSucceeded(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string // Status of the row before the event, or "" for none
+		pending     int64
+		wantPending int64
+		wantAccount int64
+		wantTopUp   bool
+	}{
+		{"no row", "", 0, 0, 5000, true},
+		{"pending", "Pending", 5000, 0, 5000, true},
+		{"processing", "Processing", 5000, 0, 5000, true},
+		{"authorized", "Authorized", 5000, 0, 5000, true},
+		{"failed and retried", "Failed", 0, 0, 5000, true},
+		{"already completed", "Completed", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(0, tt.pending, 0, 0)
+			if tt.status != "" {
+				l.putTransaction(t, "pi_1", "Deposit", tt.status, 5000)
+			}
+
+			tx, err := l.dispatch(t, "payment_intent.succeeded", paymentIntent(5000))
+			if err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			l.checkStatus(t, "pi_1", "Completed")
+			l.checkBalances(t, tt.wantAccount, tt.wantPending, 0, 0)
+			if row, _ := l.transactions.GetTransaction(context.Background(), "pi_1"); tt.status == "" && row.Currency != "usd" {
+				t.Errorf("Currency = %q, want the payment's currency", row.Currency)
+			}
+			if topUp := len(tx.committed) > 0; topUp != tt.wantTopUp {
+				t.Errorf("auto top-up queued = %t, want %t", topUp, tt.wantTopUp)
+			}
+		})
+	}
+}
+
+func TestPaymentIntentAmountCapturableUpdated(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string // Status of the row before the event, or "" for none
+		pending int64
+	}{
+		{"no row", "", 0},
+		{"pending", "Pending", 5000},
+		{"failed and retried", "Failed", 0},
+		{"already authorized", "Authorized", 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(0, tt.pending, 0, 0)
+			if tt.status != "" {
+				l.putTransaction(t, "pi_1", "Deposit", tt.status, 5000)
+			}
+
+			if _, err := l.dispatch(t, "payment_intent.amount_capturable_updated", paymentIntent(5000)); err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			// The authorised amount is pending exactly once, however the row got here
+			l.checkStatus(t, "pi_1", "Authorized")
+			l.checkBalances(t, 0, 5000, 0, 0)
+		})
+	}
+
+	// Once authorised, the deposit is either captured, which Stripe reports as a success, or canceled
+	outcomes := []struct {
+		eventType   string
+		wantStatus  string
+		wantAccount int64
+	}{
+		{"payment_intent.succeeded", "Completed", 5000},
+		{"payment_intent.canceled", "Canceled", 0},
+	}
+	for _, tt := range outcomes {
+		t.Run(tt.eventType, func(t *testing.T) {
+			l := newTestLedger(0, 0, 0, 0)
+			if _, err := l.dispatch(t, "payment_intent.amount_capturable_updated", paymentIntent(5000)); err != nil {
+				t.Fatalf("Dispatch authorized: %v", err)
+			}
+			if _, err := l.dispatch(t, tt.eventType, paymentIntent(5000)); err != nil {
+				t.Fatalf("Dispatch %s: %v", tt.eventType, err)
+			}
+			l.checkStatus(t, "pi_1", tt.wantStatus)
+			l.checkBalances(t, tt.wantAccount, 0, 0, 0)
+		})
+	}
+}
+
+func TestPaymentIntentFailedAndCanceled(t *testing.T) {
+	tests := []struct {
+		name        string
+		eventType   string
+		status      string
+		pending     int64
+		wantStatus  string
+		wantPending int64
+	}{
+		{"pending fails", "payment_intent.payment_failed", "Pending", 5000, "Failed", 0},
+		{"pending is canceled", "payment_intent.canceled", "Pending", 5000, "Canceled", 0},
+		{"failed is canceled", "payment_intent.canceled", "Failed", 0, "Canceled", 0},
+		{"authorized is canceled", "payment_intent.canceled", "Authorized", 5000, "Canceled", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(0, tt.pending, 0, 0)
+			l.putTransaction(t, "pi_1", "Deposit", tt.status, 5000)
+
+			if _, err := l.dispatch(t, tt.eventType, paymentIntent(5000)); err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			l.checkStatus(t, "pi_1", tt.wantStatus)
+			l.checkBalances(t, 0, tt.wantPending, 0, 0)
+		})
+	}
+
+	t.Run("completed can't fail", func(t *testing.T) {
+		l := newTestLedger(5000, 0, 0, 5000)
+		l.putTransaction(t, "pi_1", "Deposit", "Completed", 5000)
+
+		_, err := l.dispatch(t, "payment_intent.payment_failed", paymentIntent(5000))
+		if !errors.Is(err, repository.ErrIllegalTransition) {
+			t.Errorf("err = %v, want ErrIllegalTransition", err)
+		}
+		l.checkStatus(t, "pi_1", "Completed")
+		l.checkBalances(t, 5000, 0, 0, 5000)
+	})
+}
+
+func charge(amount, refunded int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              "ch_1",
+		"amount":          amount,
+		"amount_refunded": refunded,
+		"refunded":        refunded == amount,
+		"payment_intent":  "pi_1",
+		"metadata":        map[string]string{"UserID": "user_1"},
+	}
+}
+
+func TestChargeRefunded(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           string
+		account          int64
+		pending          int64
+		withdrawable     int64
+		wantAccount      int64
+		wantPending      int64
+		wantWithdrawable int64
+		wantTopUp        bool
+	}{
+		{"completed", "Completed", 8000, 0, 8000, 3000, 0, 3000, true},
+		{"completed and partly spent", "Completed", 2000, 0, 2000, -3000, 0, 0, true},
+		{"refund before success, pending", "Pending", 0, 5000, 0, 0, 0, 0, false},
+		{"refund before success, processing", "Processing", 0, 5000, 0, 0, 0, 0, false},
+		{"refund before success, no row", "", 0, 0, 0, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(tt.account, tt.pending, 0, tt.withdrawable)
+			if tt.status != "" {
+				l.putTransaction(t, "pi_1", "Deposit", tt.status, 5000)
+			}
+
+			tx, err := l.dispatch(t, "charge.refunded", charge(5000, 5000))
+			if err != nil {
+				t.Fatalf("Dispatch: %v", err)
+			}
+			l.checkStatus(t, "pi_1", "Refunded")
+			l.checkBalances(t, tt.wantAccount, tt.wantPending, 0, tt.wantWithdrawable)
+			if topUp := len(tx.committed) > 0; topUp != tt.wantTopUp {
+				t.Errorf("auto top-up queued = %t, want %t", topUp, tt.wantTopUp)
+			}
+
+			// The success that arrives after the refund must not credit the deposit
+			_, err = l.dispatch(t, "payment_intent.succeeded", paymentIntent(5000))
+			if !errors.Is(err, repository.ErrIllegalTransition) {
+				t.Errorf("late success: err = %v, want ErrIllegalTransition", err)
+			}
+		})
+	}
+
+	t.Run("adyen refund", func(t *testing.T) {
+		l := newTestLedger(8000, 0, 0, 8000)
+		l.putTransaction(t, "pi_1", "Deposit", "Completed", 5000)
+
+		// Adyen reports only the amount refunded, not the amount charged or whether it was all of it
+		refund := map[string]interface{}{
+			"id":              "adyen_REF_REFUND_true",
+			"amount":          0,
+			"amount_refunded": 5000,
+			"payment_intent":  "pi_1",
+			"metadata":        map[string]string{"UserID": "user_1", "Provider": "adyen"},
+		}
+		if _, err := l.dispatch(t, "charge.refunded", refund); err != nil {
+			t.Fatalf("Dispatch: %v", err)
+		}
+		l.checkStatus(t, "pi_1", "Refunded")
+		l.checkBalances(t, 3000, 0, 0, 3000)
+	})
+
+	t.Run("partial refund", func(t *testing.T) {
+		l := newTestLedger(5000, 0, 0, 5000)
+		l.putTransaction(t, "pi_1", "Deposit", "Completed", 5000)
+
+		if _, err := l.dispatch(t, "charge.refunded", charge(5000, 1000)); err != nil {
+			t.Fatalf("Dispatch: %v", err)
+		}
+		l.checkStatus(t, "pi_1", "Completed")
+		l.checkBalances(t, 5000, 0, 0, 5000)
+	})
+}
+
+func TestDisputes(t *testing.T) {
+	tests := []struct {
+		status      string
+		wantStatus  string
+		wantAccount int64
+		wantHeld    int64
+	}{
+		{"won", "Released", 5000, 0},
+		{"warning_closed", "Released", 5000, 0},
+		{"lost", "Lost", 3000, 0},
+		{"under_review", "Held", 3000, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			l := newTestLedger(5000, 0, 0, 5000)
+			l.putTransaction(t, "pi_1", "Deposit", "Completed", 5000)
+			dispute := map[string]interface{}{"id": "dp_1", "amount": 2000, "payment_intent": "pi_1", "status": "needs_response"}
+
+			tx, err := l.dispatch(t, "charge.dispute.created", dispute)
+			if err != nil {
+				t.Fatalf("Dispatch created: %v", err)
+			}
+			l.checkStatus(t, "dp_1", "Held")
+			l.checkBalances(t, 3000, 0, 2000, 3000)
+			if len(tx.committed) == 0 {
+				t.Errorf("no auto top-up queued after the hold")
+			}
+
+			dispute["status"] = tt.status
+			if _, err := l.dispatch(t, "charge.dispute.closed", dispute); err != nil {
+				t.Fatalf("Dispatch closed: %v", err)
+			}
+			l.checkStatus(t, "dp_1", tt.wantStatus)
+			// A released hold is spendable again, but only withdrawable once the user's withdrawals allow it
+			l.checkBalances(t, tt.wantAccount, 0, tt.wantHeld, 3000)
+		})
+	}
+}
+
+// openTestDatabase points the worker at a new SQLite database with the migrations applied, holding user_1 with no
+// balance. StripeObjectVersions only exists in SQL, so events are applied to it through applyEvent.
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	t.Setenv("STAGE", "local")
+	t.Setenv("LOCAL_DB_PATH", filepath.Join(t.TempDir(), "test.db"))
+	testDB, testDialect, err := database.Open("us-west-2")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	previousDB, previousDialect := db, dialect
+	db, dialect = testDB, testDialect
+	t.Cleanup(func() {
+		db, dialect = previousDB, previousDialect
+		testDB.Close()
+	})
+
+	_, err = db.Exec(`INSERT INTO Users (UserID, Username, Email, DateOfBirth) VALUES ('user_1', 'user_1', 'user_1@example.com', '2000-01-01')`)
+	if err != nil {
+		t.Fatalf("error inserting user_1: %v", err)
+	}
+}
+
+func TestApplyEventSkipsStaleEvents(t *testing.T) {
+	openTestDatabase(t)
+	ctx := context.Background()
+	transactions := repository.NewSQLTransactionRepository(db)
+
+	// pi_1 was credited by a payment_intent.succeeded created at 200; pi_2 is still pending
+	for _, row := range []struct{ id, status string }{{"pi_1", "Completed"}, {"pi_2", "Pending"}} {
+		err := transactions.InsertTransaction(ctx, &repository.Transaction{
+			TransactionID: row.id, UserID: "user_1", TransactionType: "Deposit", Amount: 5000,
+			TransactionStatus: row.status, TransactionDate: "2024-01-01 00:00:00", Provider: "stripe",
+		})
+		if err != nil {
+			t.Fatalf("InsertTransaction(%s): %v", row.id, err)
+		}
+	}
+	err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+		_, err := claimObjectVersion(ctx, tx, "pi_1", 200)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("claimObjectVersion: %v", err)
+	}
+
+	tests := []struct {
+		id          string
+		wantStatus  string
+		wantVersion int64
+	}{
+		// The failure was created before the success already applied, so it is skipped
+		{"pi_1", "Completed", 200},
+		// The same failure applies to an intent no later event has been applied to
+		{"pi_2", "Failed", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			object, _ := json.Marshal(map[string]interface{}{"id": tt.id, "amount": 5000, "metadata": map[string]string{"UserID": "user_1"}})
+			event := StripeWebhookEvent{ID: "evt_" + tt.id, Type: "payment_intent.payment_failed", Created: 100, Data: StripeData{Object: object}}
+			if err := applyEvent(ctx, event); err != nil {
+				t.Fatalf("applyEvent: %v", err)
+			}
+
+			row, err := transactions.GetTransaction(ctx, tt.id)
+			if err != nil {
+				t.Fatalf("GetTransaction: %v", err)
+			}
+			if row.TransactionStatus != tt.wantStatus {
+				t.Errorf("%s is %q, want %q", tt.id, row.TransactionStatus, tt.wantStatus)
+			}
+			var version int64
+			if err := db.QueryRow(`SELECT LastEventCreated FROM StripeObjectVersions WHERE ObjectID = ?`, tt.id).Scan(&version); err != nil {
+				t.Fatalf("error reading the version of %s: %v", tt.id, err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("LastEventCreated = %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
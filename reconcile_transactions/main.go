@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// ReconciliationOptions is read from the "detail" of the scheduled event. All fields are optional; by default the
+// job checks the reconcileWindow that ended reconcileSettleDelay ago and only reports mismatches.
+type ReconciliationOptions struct {
+    From string `json:"from"` // RFC 3339, inclusive
+    To   string `json:"to"`   // RFC 3339, exclusive
+    Fix  bool   `json:"fix"`  // Apply the safe fixes described on fixMismatch
+}
+
+// StripeRecord is a Stripe object reduced to what is compared against TransactionHistory. Amount is in minor units (cents).
+type StripeRecord struct {
+    TransactionID string
+    Object        string // "payment_intent", "charge" or "refund"
+    Amount        int64
+    Status        string // Stripe status of the object
+}
+
+// Mismatch is one disagreement between Stripe and TransactionHistory. Amounts are in minor units (cents).
+type Mismatch struct {
+    Kind          string `json:"kind"`
+    Object        string `json:"object"`
+    TransactionID string `json:"transaction_id"`
+    StripeAmount  int64  `json:"stripe_amount,omitempty"`
+    LocalAmount   int64  `json:"local_amount,omitempty"`
+    StripeStatus  string `json:"stripe_status,omitempty"`
+    LocalStatus   string `json:"local_status,omitempty"`
+    Fixed         bool   `json:"fixed"`
+}
+
+// ReconciliationReport is the result of one run. Counts holds the number of mismatches of each kind.
+type ReconciliationReport struct {
+    From          time.Time      `json:"from"`
+    To            time.Time      `json:"to"`
+    StripeObjects int            `json:"stripe_objects"`
+    Mismatches    []*Mismatch    `json:"mismatches"`
+    Counts        map[string]int `json:"counts"`
+}
+
+// Mismatch kinds
+const (
+    MismatchMissingLocally  = "missing_locally"
+    MismatchMissingInStripe = "missing_in_stripe"
+    MismatchAmount          = "amount_mismatch"
+    MismatchStatus          = "status_mismatch"
+)
+
+// Clock lets the job run against a fixed time locally instead of the wall clock.
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c).UTC() }
+
+const (
+    // Length of the window checked by a scheduled run
+    reconcileWindow = 24 * time.Hour
+    // Objects younger than this are skipped so that webhooks still in flight are not reported as mismatches
+    reconcileSettleDelay = time.Hour
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+var router *payments.Router
+var clock Clock = systemClock{}
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+
+// getLocalTransaction returns the TransactionHistory row with the given TransactionID, or nil if there is none.
+func getLocalTransaction(ctx context.Context, transactionID string) (*repository.Transaction, error) {
+    t, err := transactions.GetTransaction(ctx, transactionID)
+    if errors.Is(err, repository.ErrNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("getLocalTransaction: %v", err)
+    }
+    return t, nil
+}
+
+// listLocalDeposits returns the Stripe "Deposit" rows dated within [from, to). Rows without a provider predate it and
+// were all Stripe's; other providers' deposits are not in Stripe and would all be reported missing there.
+func listLocalDeposits(ctx context.Context, from, to time.Time) ([]*repository.Transaction, error) {
+    return transactions.FindTransactions(ctx, &repository.TransactionQuery{
+        TransactionType: "Deposit",
+        Provider:        "stripe",
+        From:            from.Format(mysqlDateTimeLayout),
+        To:              to.Format(mysqlDateTimeLayout),
+    })
+}
+
+// listStripeRecords pages through the PaymentIntents, charges and refunds created within [from, to). Deposits are
+// recorded under their PaymentIntent ID, so a charge is only kept when its PaymentIntent was not listed itself
+// (it was created before the window) or when it was made without one. Refunds have no row of their own: they are
+// checked against the deposit of the payment they refunded, with the amount that was charged and a status of
+// "refunded" or "partially_refunded".
+func listStripeRecords(ctx context.Context, provider payments.PaymentProvider, from, to time.Time) ([]*StripeRecord, error) {
+    created := &payments.ListParams{CreatedFrom: from, CreatedTo: to}
+    var records []*StripeRecord
+    seen := map[string]bool{}
+
+    intents, err := provider.ListIntents(ctx, created)
+    if err != nil {
+        return nil, fmt.Errorf("listing payment intents: %v", err)
+    }
+    for _, intent := range intents {
+        records = append(records, &StripeRecord{TransactionID: intent.ID, Object: "payment_intent", Amount: intent.Amount, Status: string(intent.Status)})
+        seen[intent.ID] = true
+    }
+
+    charges, err := provider.ListCharges(ctx, created)
+    if err != nil {
+        return nil, fmt.Errorf("listing charges: %v", err)
+    }
+    for _, ch := range charges {
+        transactionID := ch.IntentID
+        if transactionID == "" {
+            transactionID = ch.ID
+        }
+        if seen[transactionID] {
+            continue
+        }
+        records = append(records, &StripeRecord{TransactionID: transactionID, Object: "charge", Amount: ch.Amount, Status: ch.Status})
+        seen[transactionID] = true
+    }
+
+    // Refunds come with their charge, so that each can be matched to its payment's deposit and told apart as full or partial
+    refunds, err := provider.ListRefunds(ctx, created)
+    if err != nil {
+        return nil, fmt.Errorf("listing refunds: %v", err)
+    }
+    refunded := map[string]bool{}
+    for _, r := range refunds {
+        if r.Status == "failed" || r.Charge == nil {
+            continue
+        }
+        transactionID := r.Charge.IntentID
+        if transactionID == "" {
+            transactionID = r.Charge.ID
+        }
+        // A payment refunded in several parts is checked once, against the charge's total
+        if refunded[transactionID] {
+            continue
+        }
+        status := "partially_refunded"
+        if r.Charge.Refunded {
+            status = "refunded"
+        }
+        records = append(records, &StripeRecord{TransactionID: transactionID, Object: "refund", Amount: r.Charge.Amount, Status: status})
+        refunded[transactionID] = true
+    }
+
+    return records, nil
+}
+
+// fetchPaymentIntentRecord retrieves a single PaymentIntent. found is false if Stripe has no such object.
+func fetchPaymentIntentRecord(ctx context.Context, provider payments.PaymentProvider, id string) (record *StripeRecord, found bool, err error) {
+    intent, err := provider.GetIntent(ctx, id)
+    if errors.Is(err, payments.ErrNotFound) {
+        return nil, false, nil
+    }
+    if err != nil {
+        return nil, false, fmt.Errorf("fetchPaymentIntentRecord: %v", err)
+    }
+    return &StripeRecord{TransactionID: intent.ID, Object: "payment_intent", Amount: intent.Amount, Status: string(intent.Status)}, true, nil
+}
+
+// expectedStatuses returns the TransactionStatus values that agree with a Stripe object. required is false when
+// it is normal for the object to have no row, such as an intent that was never confirmed.
+func expectedStatuses(record *StripeRecord) (statuses []string, required bool) {
+    if record.Object == "refund" {
+        // The worker marks a deposit refunded in full "Refunded" and only logs partial refunds
+        if record.Status == "refunded" {
+            return []string{"Refunded"}, true
+        }
+        return []string{"Completed"}, true
+    }
+
+    switch record.Status {
+    case "succeeded":
+        // A refunded payment intent still says "succeeded"
+        return []string{"Completed", "Refunded"}, true
+    case "processing", "pending":
+        return []string{"Pending", "Processing"}, true
+    case "canceled":
+        return []string{"Canceled", "Failed"}, false
+    case "failed", "requires_payment_method":
+        return []string{"Failed"}, false
+    case "requires_capture":
+        // Authorised with manual capture, "Pending" until the webhook reports it
+        return []string{"Pending", "Authorized"}, false
+    default:
+        // requires_action and requires_confirmation: not confirmed yet
+        return []string{"Pending"}, false
+    }
+}
+
+// compareRecord returns the mismatch between a Stripe object and its row, or nil if they agree. local is nil if
+// there is no row.
+func compareRecord(record *StripeRecord, local *repository.Transaction) *Mismatch {
+    statuses, required := expectedStatuses(record)
+    m := &Mismatch{
+        Object:        record.Object,
+        TransactionID: record.TransactionID,
+        StripeAmount:  record.Amount,
+        StripeStatus:  record.Status,
+    }
+
+    if local == nil {
+        if !required {
+            return nil
+        }
+        m.Kind = MismatchMissingLocally
+        return m
+    }
+
+    m.LocalAmount = local.Amount
+    m.LocalStatus = local.TransactionStatus
+    if local.Amount != record.Amount {
+        m.Kind = MismatchAmount
+        return m
+    }
+    for _, status := range statuses {
+        if local.TransactionStatus == status {
+            return nil
+        }
+    }
+    m.Kind = MismatchStatus
+    return m
+}
+
+// finishDeposit moves an in-flight deposit to status and adjusts the balances in one database transaction, under the
+// user's lock. The row is read again under the lock and only moved if it is still in flight, so a webhook arriving at
+// the same time can't cause the balance to be adjusted twice.
+func finishDeposit(ctx context.Context, local *repository.Transaction, status string, now time.Time) (bool, error) {
+    moved := false
+    err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        txUsers := repository.NewSQLUserRepository(tx, dialect)
+        txTransactions := repository.NewSQLTransactionRepository(tx)
+        if err := txUsers.LockUser(ctx, local.UserID); err != nil {
+            return err
+        }
+
+        deposit, err := txTransactions.GetTransaction(ctx, local.TransactionID)
+        if err != nil {
+            return err
+        }
+        if !inFlight(deposit.TransactionStatus) {
+            return nil
+        }
+        moved, err = txTransactions.TransitionTransaction(ctx, deposit.TransactionID, deposit.TransactionStatus, status, now.Format(mysqlDateTimeLayout))
+        if err != nil || !moved {
+            return err
+        }
+
+        if err := txUsers.AddPendingBalance(ctx, deposit.UserID, -deposit.Amount); err != nil {
+            return err
+        }
+        if status == "Completed" {
+            return txUsers.AddAccountBalance(ctx, deposit.UserID, deposit.Amount)
+        }
+        return nil
+    })
+    if err != nil {
+        return false, err
+    }
+    return moved, nil
+}
+
+// inFlight reports whether a deposit in status is still held in the user's pending balance.
+func inFlight(status string) bool {
+    return status == "Pending" || status == "Processing" || status == "Authorized"
+}
+
+// fixMismatch applies the fixes that are safe to make without a person looking at them: a deposit still "Pending",
+// "Processing" or "Authorized" whose payment has since succeeded or failed is finished the same way the webhook
+// would have. Amount mismatches, missing rows and refunds are only reported.
+func fixMismatch(ctx context.Context, m *Mismatch, local *repository.Transaction, now time.Time) (bool, error) {
+    if m.Kind != MismatchStatus || m.Object == "refund" || local.TransactionType != "Deposit" {
+        return false, nil
+    }
+    if !inFlight(local.TransactionStatus) {
+        return false, nil
+    }
+
+    switch m.StripeStatus {
+    case "succeeded":
+        return finishDeposit(ctx, local, "Completed", now)
+    case "canceled":
+        return finishDeposit(ctx, local, "Canceled", now)
+    case "failed", "requires_payment_method":
+        return finishDeposit(ctx, local, "Failed", now)
+    }
+    return false, nil
+}
+
+// reconcileWindowFor resolves the window to check from the options, defaulting to the reconcileWindow that ended
+// reconcileSettleDelay before now.
+func reconcileWindowFor(opts ReconciliationOptions, now time.Time) (from, to time.Time, err error) {
+    to = now.Add(-reconcileSettleDelay).Truncate(time.Hour)
+    if opts.To != "" {
+        if to, err = time.Parse(time.RFC3339, opts.To); err != nil {
+            return from, to, fmt.Errorf("invalid to: %v", err)
+        }
+    }
+    from = to.Add(-reconcileWindow)
+    if opts.From != "" {
+        if from, err = time.Parse(time.RFC3339, opts.From); err != nil {
+            return from, to, fmt.Errorf("invalid from: %v", err)
+        }
+    }
+    if !from.Before(to) {
+        return from, to, fmt.Errorf("from must be before to")
+    }
+    return from.UTC(), to.UTC(), nil
+}
+
+// reconcileTransactions() is triggered by an EventBridge schedule. It checks that TransactionHistory agrees with
+// Stripe for a time window:
+// - Every PaymentIntent and charge Stripe created in the window is matched to the row with the same
+//   TransactionID, and every refund to the row of the payment it refunded. Rows that are missing, or whose amount
+//   or status disagree, are reported.
+// - Every "Deposit" row dated in the window that wasn't matched is looked up in Stripe, and reported as missing
+//   in Stripe if it doesn't exist there.
+// With the "fix" option, safe status mismatches are also corrected (see fixMismatch).
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The scheduled EventBridge event. Its detail may hold ReconciliationOptions.
+//
+// Returns:
+// - ReconciliationReport: The mismatches found, which is also logged as JSON.
+// - error: Non-nil if Stripe or the database could not be read. Failed fixes are only logged.
+func reconcileTransactions(ctx context.Context, event events.CloudWatchEvent) (*ReconciliationReport, error) {
+    now := clock.Now()
+
+    var opts ReconciliationOptions
+    if len(event.Detail) > 0 {
+        if err := json.Unmarshal(event.Detail, &opts); err != nil {
+            return nil, fmt.Errorf("invalid reconciliation options: %v", err)
+        }
+    }
+    from, to, err := reconcileWindowFor(opts, now)
+    if err != nil {
+        return nil, err
+    }
+
+    report := &ReconciliationReport{From: from, To: to, Mismatches: []*Mismatch{}, Counts: map[string]int{}}
+    record := func(m *Mismatch, local *repository.Transaction) {
+        if opts.Fix && local != nil {
+            fixed, err := fixMismatch(ctx, m, local, now)
+            if err != nil {
+                log.Printf("Error fixing %s for %s: %v", m.Kind, m.TransactionID, err)
+            }
+            m.Fixed = fixed
+        }
+        report.Mismatches = append(report.Mismatches, m)
+        report.Counts[m.Kind]++
+    }
+
+    provider, err := router.Provider(payments.Stripe)
+    if err != nil {
+        return nil, err
+    }
+    records, err := listStripeRecords(ctx, provider, from, to)
+    if err != nil {
+        return nil, err
+    }
+    report.StripeObjects = len(records)
+
+    matched := map[string]bool{}
+    for _, r := range records {
+        matched[r.TransactionID] = true
+        local, err := getLocalTransaction(ctx, r.TransactionID)
+        if err != nil {
+            return nil, err
+        }
+        if m := compareRecord(r, local); m != nil {
+            record(m, local)
+        }
+    }
+
+    deposits, err := listLocalDeposits(ctx, from, to)
+    if err != nil {
+        return nil, err
+    }
+    for _, local := range deposits {
+        if matched[local.TransactionID] {
+            continue
+        }
+        // The intent may have been created before the window and confirmed inside it
+        r, found, err := fetchPaymentIntentRecord(ctx, provider, local.TransactionID)
+        if err != nil {
+            return nil, err
+        }
+        if !found {
+            record(&Mismatch{
+                Kind:          MismatchMissingInStripe,
+                Object:        "payment_intent",
+                TransactionID: local.TransactionID,
+                LocalAmount:   local.Amount,
+                LocalStatus:   local.TransactionStatus,
+            }, nil)
+            continue
+        }
+        if m := compareRecord(r, local); m != nil {
+            record(m, local)
+        }
+    }
+
+    if out, err := json.Marshal(report); err == nil {
+        log.Printf("Reconciliation report: %s", out)
+    }
+    return report, nil
+}
+
+func main() {
+    // For local runs the window and fix option can be given as flags instead of in event.json
+    fakeNow := flag.String("now", "", "run as if the current time were this RFC 3339 timestamp")
+    from := flag.String("from", "", "start of the window to check, RFC 3339")
+    to := flag.String("to", "", "end of the window to check, RFC 3339")
+    fix := flag.Bool("fix", false, "apply safe fixes")
+    flag.Parse()
+    if *fakeNow != "" {
+        parsed, err := time.Parse(time.RFC3339, *fakeNow)
+        if err != nil {
+            log.Fatalf("Invalid -now: %v", err)
+        }
+        clock = fixedClock(parsed)
+    }
+
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event events.CloudWatchEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    if *from != "" || *to != "" || *fix {
+        event.Detail, _ = json.Marshal(ReconciliationOptions{From: *from, To: *to, Fix: *fix})
+    }
+
+    ctx := context.Background()
+    report, err := reconcileTransactions(ctx, event)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Printf("Checked %d Stripe objects from %s to %s, found %d mismatches: %v\n",
+        report.StripeObjects, report.From.Format(time.RFC3339), report.To.Format(time.RFC3339), len(report.Mismatches), report.Counts)
+
+    //lambda.Start(reconcileTransactions)
+}
@@ -0,0 +1,12 @@
+module github.com/betchya/lambdas/redrive_webhook_events
+
+go 1.21.4
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/aws/aws-lambda-go v1.47.0 // indirect
+	github.com/aws/aws-sdk-go v1.52.3 // indirect
+	github.com/go-sql-driver/mysql v1.8.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/stripe/stripe-go v70.15.0+incompatible // indirect
+)
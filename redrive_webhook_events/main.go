@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// RedriveRequest selects how many dead-lettered events to send back to the webhook queue
+type RedriveRequest struct {
+    MaxMessages int  `json:"max_messages"` // 0 redrives every message in the dead-letter queue
+    DryRun      bool `json:"dry_run"`      // Print the messages without moving them
+}
+
+// RedriveResult summarises one run
+type RedriveResult struct {
+    Redriven int `json:"redriven"`
+    Failed   int `json:"failed"`
+}
+
+// Struct to keep the queue URLs and more params if needed
+type AWSParams struct {
+	queueURL string // SQS queue consumed by processWebhookEvents
+	dlqURL   string // Its dead-letter queue
+}
+
+// Largest batch SQS returns from a single receive
+const receiveBatchSize = 10
+
+// Globals
+var awsParams AWSParams
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// redriveMessage sends a dead-lettered message back to the webhook queue and removes it from the dead-letter
+// queue. The message is only deleted once it has been sent, so a failure leaves it in the dead-letter queue.
+func redriveMessage(svc *sqs.SQS, message *sqs.Message) error {
+    _, err := svc.SendMessage(&sqs.SendMessageInput{
+        QueueUrl:    aws.String(awsParams.queueURL),
+        MessageBody: message.Body,
+    })
+    if err != nil {
+        return fmt.Errorf("redriveMessage: %v", err)
+    }
+
+    _, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
+        QueueUrl:      aws.String(awsParams.dlqURL),
+        ReceiptHandle: message.ReceiptHandle,
+    })
+    if err != nil {
+        return fmt.Errorf("redriveMessage: %v", err)
+    }
+    return nil
+}
+
+// redriveWebhookEvents() moves Stripe events that processWebhookEvents gave up on from the dead-letter queue back
+// to the webhook queue, usually once the bug or outage that made them fail has been fixed. Events that were
+// processed in the meantime are skipped by the worker.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The RedriveRequest limiting the number of messages moved.
+//
+// Returns:
+// - RedriveResult: The number of messages moved and the number that could not be.
+// - error: Non-nil if the dead-letter queue could not be read.
+func redriveWebhookEvents(ctx context.Context, request RedriveRequest) (*RedriveResult, error) {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        return nil, err
+    }
+    svc := sqs.New(sess)
+
+    result := &RedriveResult{}
+    for request.MaxMessages == 0 || result.Redriven+result.Failed < request.MaxMessages {
+        batch := int64(receiveBatchSize)
+        if remaining := request.MaxMessages - result.Redriven - result.Failed; request.MaxMessages > 0 && remaining < receiveBatchSize {
+            batch = int64(remaining)
+        }
+
+        output, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+            QueueUrl:            aws.String(awsParams.dlqURL),
+            MaxNumberOfMessages: aws.Int64(batch),
+            WaitTimeSeconds:     aws.Int64(1),
+        })
+        if err != nil {
+            return result, fmt.Errorf("error reading dead-letter queue: %v", err)
+        }
+        if len(output.Messages) == 0 {
+            break
+        }
+
+        for _, message := range output.Messages {
+            if request.DryRun {
+                fmt.Printf("Dead-lettered: %s\n", aws.StringValue(message.Body))
+                result.Redriven++
+                continue
+            }
+            if err := redriveMessage(svc, message); err != nil {
+                log.Printf("Error redriving message %s: %v", aws.StringValue(message.MessageId), err)
+                result.Failed++
+                continue
+            }
+            result.Redriven++
+        }
+
+        // Messages received in a dry run stay invisible until their visibility timeout expires, so a second
+        // receive would only see the rest of the queue. One batch is enough to look at.
+        if request.DryRun {
+            break
+        }
+    }
+
+    log.Printf("Redrove %d webhook events, %d failed", result.Redriven, result.Failed)
+    return result, nil
+}
+
+func main() {
+    // Run from the command line: -max limits the number of messages moved and -dry-run only prints them
+    maxMessages := flag.Int("max", 0, "maximum number of messages to redrive, 0 for all")
+    dryRun := flag.Bool("dry-run", false, "print dead-lettered messages without moving them")
+    flag.Parse()
+
+    region := "us-west-2"
+	var err error
+
+    awsParams.queueURL, err = getParameter(region, "/application/dev/webhook_queue_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    awsParams.dlqURL, err = getParameter(region, "/application/dev/webhook_dlq_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+    log.Printf("Successfully retrieved queue URLs!")
+
+    // Without flags the request is read from event.json, like the other functions
+    request := RedriveRequest{MaxMessages: *maxMessages, DryRun: *dryRun}
+    if flag.NFlag() == 0 {
+        file, err := os.ReadFile("event.json")
+        if err != nil {
+            fmt.Printf("Failed to read file: %s\n", err)
+            return
+        }
+        if err := json.Unmarshal(file, &request); err != nil {
+            fmt.Printf("Failed to unmarshal request: %s\n", err)
+            return
+        }
+    }
+
+    ctx := context.Background()
+    result, err := redriveWebhookEvents(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Printf("Handler response: %+v\n", *result)
+
+    //lambda.Start(redriveWebhookEvents)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// DueSchedule holds the columns of a DepositSchedules row needed to run it. Amount is in minor units (cents).
+type DueSchedule struct {
+    ScheduleID      int64
+    UserID          string
+    Amount          int64
+    Currency        string
+    PaymentMethodID string
+    Frequency       string
+    NextRunAt       time.Time
+    FailureCount    int
+}
+
+// Clock lets the job run against a fixed time locally instead of the wall clock.
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c).UTC() }
+
+const (
+    // A schedule is suspended after this many failed attempts in a row
+    maxScheduleFailures = 3
+    // Delay before retrying a failed deposit, multiplied by the number of failures so far
+    scheduleRetryBackoff = 6 * time.Hour
+    // How long a claimed schedule is hidden from other runs while its deposit is in flight
+    scheduleClaimLease = 15 * time.Minute
+    // Maximum number of schedules processed per invocation
+    scheduleBatchSize = 100
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var users repository.UserRepository
+var router *payments.Router
+var clock Clock = systemClock{}
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// recordPendingDeposit logs a scheduled deposit as "Pending" and adds it to the user's pending balance. Both are
+// written in one database transaction under the user's lock, and only if the webhook hasn't recorded the deposit already.
+func recordPendingDeposit(ctx context.Context, deposit *repository.Transaction) error {
+    return database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        _, err := repository.RecordPendingDeposit(ctx, repository.NewSQLUserRepository(tx, dialect), repository.NewSQLTransactionRepository(tx), deposit)
+        return err
+    })
+}
+
+func notifyUser(userID, message string) error {
+    query := `INSERT INTO UserNotifications (UserID, Message, CreatedAt) VALUES (?, ?, ?)`
+    _, err := db.Exec(query, userID, message, clock.Now().Format(mysqlDateTimeLayout))
+    if err != nil {
+        return fmt.Errorf("notifyUser: %v", err)
+    }
+    return nil
+}
+
+// findDueSchedules returns active schedules whose next run, or pending retry, is at or before now.
+func findDueSchedules(now time.Time) ([]*DueSchedule, error) {
+    query := `SELECT ScheduleID, UserID, Amount, Currency, PaymentMethodID, Frequency, NextRunAt, FailureCount
+              FROM DepositSchedules
+              WHERE Status = 'Active' AND COALESCE(RetryAt, NextRunAt) <= ?
+              ORDER BY COALESCE(RetryAt, NextRunAt)
+              LIMIT ?`
+
+    rows, err := db.Query(query, now.Format(mysqlDateTimeLayout), scheduleBatchSize)
+    if err != nil {
+        return nil, fmt.Errorf("findDueSchedules: %v", err)
+    }
+    defer rows.Close()
+
+    var schedules []*DueSchedule
+    for rows.Next() {
+        var s DueSchedule
+        var nextRunAt string
+        if err := rows.Scan(&s.ScheduleID, &s.UserID, &s.Amount, &s.Currency, &s.PaymentMethodID, &s.Frequency, &nextRunAt, &s.FailureCount); err != nil {
+            return nil, fmt.Errorf("findDueSchedules: %v", err)
+        }
+        if s.NextRunAt, err = time.Parse(mysqlDateTimeLayout, nextRunAt); err != nil {
+            return nil, fmt.Errorf("findDueSchedules: %v", err)
+        }
+        schedules = append(schedules, &s)
+    }
+    return schedules, rows.Err()
+}
+
+// claimSchedule pushes RetryAt forward by scheduleClaimLease so that an overlapping run skips this schedule.
+// It returns false if another run already claimed it.
+func claimSchedule(scheduleID int64, now time.Time) (bool, error) {
+    query := `UPDATE DepositSchedules SET RetryAt = ?
+              WHERE ScheduleID = ? AND Status = 'Active' AND COALESCE(RetryAt, NextRunAt) <= ?`
+
+    result, err := db.Exec(query, now.Add(scheduleClaimLease).Format(mysqlDateTimeLayout), scheduleID, now.Format(mysqlDateTimeLayout))
+    if err != nil {
+        return false, fmt.Errorf("claimSchedule: %v", err)
+    }
+    rows, err := result.RowsAffected()
+    if err != nil {
+        return false, fmt.Errorf("claimSchedule: %v", err)
+    }
+    return rows == 1, nil
+}
+
+// nextRunAfter advances a schedule's anchor by its frequency until it is in the future. Missed periods are
+// skipped rather than charged in a burst.
+func nextRunAfter(frequency string, anchor, now time.Time) time.Time {
+    next := anchor
+    for !next.After(now) {
+        if frequency == "monthly" {
+            next = next.AddDate(0, 1, 0)
+        } else {
+            next = next.AddDate(0, 0, 7)
+        }
+    }
+    return next
+}
+
+func markScheduleSucceeded(s *DueSchedule, now time.Time) error {
+    query := `UPDATE DepositSchedules SET NextRunAt = ?, RetryAt = NULL, FailureCount = 0 WHERE ScheduleID = ?`
+    _, err := db.Exec(query, nextRunAfter(s.Frequency, s.NextRunAt, now).Format(mysqlDateTimeLayout), s.ScheduleID)
+    if err != nil {
+        return fmt.Errorf("markScheduleSucceeded: %v", err)
+    }
+    return nil
+}
+
+// markScheduleFailed schedules a retry with a growing backoff, or suspends the schedule once it has failed
+// maxScheduleFailures times in a row.
+func markScheduleFailed(s *DueSchedule, now time.Time, reason string) error {
+    failures := s.FailureCount + 1
+    log.Printf("Deposit schedule %d failed (%d/%d): %s", s.ScheduleID, failures, maxScheduleFailures, reason)
+
+    if failures >= maxScheduleFailures {
+        query := `UPDATE DepositSchedules SET Status = 'Suspended', FailureCount = ?, RetryAt = NULL WHERE ScheduleID = ?`
+        if _, err := db.Exec(query, failures, s.ScheduleID); err != nil {
+            return fmt.Errorf("markScheduleFailed: %v", err)
+        }
+        if err := notifyUser(s.UserID, "Your recurring deposit has been suspended after repeated failures: "+reason); err != nil {
+            log.Printf("Error notifying user: %v", err)
+        }
+        return nil
+    }
+
+    retryAt := now.Add(scheduleRetryBackoff * time.Duration(failures))
+    query := `UPDATE DepositSchedules SET FailureCount = ?, RetryAt = ? WHERE ScheduleID = ?`
+    if _, err := db.Exec(query, failures, retryAt.Format(mysqlDateTimeLayout), s.ScheduleID); err != nil {
+        return fmt.Errorf("markScheduleFailed: %v", err)
+    }
+    return nil
+}
+
+// runSchedule creates and confirms an off-session payment intent for one schedule and records the result.
+func runSchedule(ctx context.Context, s *DueSchedule, now time.Time) error {
+    user, err := users.GetUser(ctx, s.UserID)
+    if err != nil {
+        return fmt.Errorf("error retrieving user: %w", err)
+    }
+    if user.StripeCustomerID == nil {
+        return markScheduleFailed(s, now, "no Stripe customer on file")
+    }
+
+    // The payment method is saved at Stripe, so the deposit is pinned to it rather than failed over
+    intent, err := router.CreateIntent(ctx, payments.Deposit{Currency: s.Currency, Amount: s.Amount, Provider: payments.Stripe}, &payments.IntentParams{
+        UserID:          s.UserID,
+        CustomerID:      *user.StripeCustomerID,
+        Amount:          s.Amount,
+        Currency:        s.Currency,
+        PaymentMethodID: s.PaymentMethodID,
+        OffSession:      true,
+        Confirm:         true,
+        // One key per period and attempt, so a crashed run that is retried never charges twice
+        IdempotencyKey:  fmt.Sprintf("deposit-schedule-%d-%d-%d", s.ScheduleID, s.NextRunAt.Unix(), s.FailureCount),
+        Metadata:        map[string]string{"ScheduleID": fmt.Sprint(s.ScheduleID)},
+    })
+    if err != nil {
+        return markScheduleFailed(s, now, err.Error())
+    }
+    if intent.Status != payments.StatusSucceeded {
+        return markScheduleFailed(s, now, "payment ended in status "+string(intent.Status))
+    }
+
+    deposit := &repository.Transaction{
+        TransactionID:     intent.ID,
+        UserID:            s.UserID,
+        TransactionType:   "Deposit",
+        Amount:            intent.Amount,
+        TransactionStatus: "Pending",
+        TransactionDate:   now.Format(mysqlDateTimeLayout),
+        Provider:          string(intent.Provider),
+        Currency:          intent.Currency,
+    }
+    if err := recordPendingDeposit(ctx, deposit); err != nil {
+        log.Printf("Error recording scheduled deposit: %v", err)
+    }
+    return markScheduleSucceeded(s, now)
+}
+
+// runDepositSchedules() is triggered by an EventBridge schedule. It finds every deposit schedule that is due,
+// charges its saved payment method off-session and writes the deposit to TransactionHistory as "Pending", so the
+// webhook credits it the same way as any other deposit.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The scheduled EventBridge event. Its contents are not used; the current time comes from clock.
+//
+// Returns:
+// - error: Non-nil only if the due schedules could not be loaded. Failures of individual schedules are
+//   recorded on the schedule and retried with backoff, and the schedule is suspended after maxScheduleFailures.
+func runDepositSchedules(ctx context.Context, event events.CloudWatchEvent) error {
+    now := clock.Now()
+
+    schedules, err := findDueSchedules(now)
+    if err != nil {
+        return err
+    }
+    log.Printf("Found %d due deposit schedules", len(schedules))
+
+    for _, s := range schedules {
+        claimed, err := claimSchedule(s.ScheduleID, now)
+        if err != nil {
+            log.Printf("Error claiming deposit schedule %d: %v", s.ScheduleID, err)
+            continue
+        }
+        if !claimed {
+            continue
+        }
+        if err := runSchedule(ctx, s, now); err != nil {
+            log.Printf("Error running deposit schedule %d: %v", s.ScheduleID, err)
+        }
+    }
+    return nil
+}
+
+func main() {
+    // For local runs, -now pins the clock so due schedules can be exercised without waiting
+    fakeNow := flag.String("now", "", "run as if the current time were this RFC 3339 timestamp")
+    flag.Parse()
+    if *fakeNow != "" {
+        parsed, err := time.Parse(time.RFC3339, *fakeNow)
+        if err != nil {
+            log.Fatalf("Invalid -now: %v", err)
+        }
+        clock = fixedClock(parsed)
+    }
+
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    users = repository.NewSQLUserRepository(db, dialect)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event events.CloudWatchEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    ctx := context.Background()
+    if err := runDepositSchedules(ctx, event); err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Println("Deposit schedule run finished")
+
+    //lambda.Start(runDepositSchedules)
+}
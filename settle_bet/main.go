@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awslambda "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// BetEvent is sent by the betting service whenever a bet changes state. Stake and Payout are in minor units (cents).
+type BetEvent struct {
+    Type   string `json:"type"`   // "placed", "settled" or "voided"
+    BetID  string `json:"BetID"`
+    UserID string `json:"UserID"`
+    Stake  int64  `json:"stake"`
+    Payout int64  `json:"payout"` // Total returned to the user on settlement, 0 for a losing bet
+}
+
+// ErrInsufficientFunds is returned when a bet is placed for more than the user's available balance.
+var ErrInsufficientFunds = errors.New("insufficient available balance")
+
+// Lambda that reloads a user's wallet when their balance drops below their auto top-up threshold
+const autoTopUpFunctionName = "auto_top_up"
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// stakeTransactionID is the TransactionHistory ID of a bet's stake. Keying the row by bet makes every event idempotent.
+func stakeTransactionID(betID string) string {
+    return betID + "-stake"
+}
+
+// triggerAutoTopUp asynchronously invokes the auto top-up Lambda after a balance change so it can check the
+// user's threshold. Failures are only logged; a missed check must never fail the webhook.
+func triggerAutoTopUp(userID string) {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return
+    }
+
+    payload, err := json.Marshal(map[string]string{"UserID": userID})
+    if err != nil {
+        log.Printf("Error marshaling auto top-up event: %v", err)
+        return
+    }
+
+    _, err = awslambda.New(sess).Invoke(&awslambda.InvokeInput{
+        FunctionName:   aws.String(autoTopUpFunctionName),
+        InvocationType: aws.String(awslambda.InvocationTypeEvent),
+        Payload:        payload,
+    })
+    if err != nil {
+        log.Printf("Error invoking auto top-up for user %s: %v", userID, err)
+    }
+}
+
+// placeBet holds the stake of a new bet. The user is locked while their balance is checked, the stake is held and its
+// "Held" row is written, all in one database transaction, so a repeated or concurrent event holds it only once.
+func placeBet(ctx context.Context, event BetEvent, now time.Time) error {
+    placed := false
+    err := database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        users := repository.NewSQLUserRepository(tx, dialect)
+        transactions := repository.NewSQLTransactionRepository(tx)
+        if err := users.LockUser(ctx, event.UserID); err != nil {
+            return err
+        }
+
+        _, err := transactions.GetTransaction(ctx, stakeTransactionID(event.BetID))
+        if err == nil {
+            log.Printf("Bet %s was already placed", event.BetID)
+            return nil
+        }
+        if !errors.Is(err, repository.ErrNotFound) {
+            return err
+        }
+
+        user, err := users.GetUser(ctx, event.UserID)
+        if err != nil {
+            return err
+        }
+        if user.AccountBalance < event.Stake {
+            return ErrInsufficientFunds
+        }
+        // Withdrawable funds are spent last, so the withdrawable balance only shrinks once the non-withdrawable part
+        // of the balance is used up
+        if err := users.HoldBalance(ctx, event.UserID, event.Stake); err != nil {
+            return err
+        }
+        err = transactions.InsertTransaction(ctx, &repository.Transaction{
+            TransactionID:     stakeTransactionID(event.BetID),
+            UserID:            event.UserID,
+            TransactionType:   "BetStake",
+            Amount:            event.Stake,
+            TransactionStatus: "Held",
+            TransactionDate:   now.Format(mysqlDateTimeLayout),
+        })
+        if err != nil {
+            return err
+        }
+        placed = true
+        return nil
+    })
+    if err != nil || !placed {
+        return err
+    }
+
+    // The stake may have taken the user below their auto top-up threshold
+    triggerAutoTopUp(event.UserID)
+    return nil
+}
+
+// closeBet releases the held stake of a settled or voided bet. The stake and its owner are taken from the "Held" row,
+// which is moved to "Settled" or "Refunded" in the same database transaction as the balances, so a repeated event
+// does not pay out twice.
+func closeBet(ctx context.Context, event BetEvent, now time.Time) error {
+    return database.WithTransaction(ctx, db, func(tx *sql.Tx) error {
+        users := repository.NewSQLUserRepository(tx, dialect)
+        transactions := repository.NewSQLTransactionRepository(tx)
+
+        stake, err := transactions.GetTransaction(ctx, stakeTransactionID(event.BetID))
+        if errors.Is(err, repository.ErrNotFound) {
+            log.Printf("Bet %s has no held stake, ignoring %s event", event.BetID, event.Type)
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err := users.LockUser(ctx, stake.UserID); err != nil {
+            return err
+        }
+        if stake.UserID != event.UserID {
+            log.Printf("Bet %s was placed by %s, not %s; closing it for %s", event.BetID, stake.UserID, event.UserID, stake.UserID)
+        }
+
+        status := "Settled"
+        if event.Type == "voided" {
+            status = "Refunded"
+        }
+        // Only a stake that is still "Held" is moved, so only one of two events for the same bet releases it
+        moved, err := transactions.TransitionTransaction(ctx, stake.TransactionID, "Held", status, now.Format(mysqlDateTimeLayout))
+        if err != nil {
+            return err
+        }
+        if !moved {
+            log.Printf("Bet %s has no held stake, ignoring %s event", event.BetID, event.Type)
+            return nil
+        }
+
+        if event.Type == "voided" {
+            // Returned to the available balance, but not made withdrawable
+            return users.HoldBalance(ctx, stake.UserID, -stake.Amount)
+        }
+        if err := users.ReleaseHeldBalance(ctx, stake.UserID, stake.Amount); err != nil {
+            return err
+        }
+        if event.Payout == 0 {
+            return nil
+        }
+        if err := users.AddWinnings(ctx, stake.UserID, event.Payout); err != nil {
+            return err
+        }
+        return transactions.InsertTransaction(ctx, &repository.Transaction{
+            TransactionID:     event.BetID + "-payout",
+            UserID:            stake.UserID,
+            TransactionType:   "BetPayout",
+            Amount:            event.Payout,
+            TransactionStatus: "Completed",
+            TransactionDate:   now.Format(mysqlDateTimeLayout),
+        })
+    })
+}
+
+// settleBet() moves funds between a user's balances as their bets change state. It is invoked by the betting
+// service with a BetEvent:
+// - "placed": the stake moves from the available balance to held funds. Fails with ErrInsufficientFunds if
+//   the user can't cover it.
+// - "settled": the stake leaves held funds and the payout (0 for a losing bet) is credited to the available
+//   balance. Winnings are also added to the withdrawable balance.
+// - "voided": the stake is returned from held funds to the available balance.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The BetEvent describing the change.
+//
+// Returns:
+// - error: Non-nil if the event is invalid or the balances could not be updated.
+func settleBet(ctx context.Context, event BetEvent) error {
+    if event.BetID == "" || event.UserID == "" || event.Stake <= 0 || event.Payout < 0 {
+        return fmt.Errorf("invalid bet event: %+v", event)
+    }
+
+    now := time.Now().UTC()
+    switch event.Type {
+        case "placed":
+            return placeBet(ctx, event, now)
+        case "settled", "voided":
+            return closeBet(ctx, event, now)
+        default:
+            return fmt.Errorf("unknown bet event type %q", event.Type)
+    }
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event BetEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    ctx := context.Background()
+    if err := settleBet(ctx, event); err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Printf("Processed %s event for bet %s\n", event.Type, event.BetID)
+
+    //lambda.Start(settleBet)
+}
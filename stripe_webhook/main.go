@@ -4,53 +4,92 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	stripewebhook "github.com/stripe/stripe-go/webhook"
 )
 
-type StripeWebhookEvent struct {
-    Type string     `json:"type"`       // Type of event
-    Data StripeData `json:"data"`       // Nested data object
+// Struct to keep the secret key and more params if needed
+type AWSParams struct {
+	webhookSecret string // Signing secret of the Stripe webhook endpoint
+	adyenHMACKey  string // Key Adyen signs notifications with, empty if Adyen is not set up
+	queueURL      string // SQS queue consumed by processWebhookEvents
 }
 
-// StripeData contains the data object from Stripe webhook JSON
-type StripeData struct {
-    Object PaymentIntent `json:"object"` // Details of the payment intent
+// EventQueue hands verified events to the worker. It is SQS when deployed and an in-memory queue for local runs.
+type EventQueue interface {
+    Enqueue(body string) error
 }
 
-// PaymentIntent holds the specific details about the payment intent
-type PaymentIntent struct {
-    ID          string `json:"id"`          // Transaction ID
-    Amount      int64  `json:"amount"`      // Amount in cents
-    Currency    string `json:"currency"`    // Currency code, e.g., "usd"
-    Description string `json:"description"` // Description of the payment
-    Customer    string `json:"customer"`    // Customer ID
+type sqsQueue struct {
+    svc *sqs.SQS
+    url string
 }
 
-// Struct to keep the secret key and more params if needed
-type AWSParams struct {
-	stripeKey string
+func newSQSQueue(url string) (*sqsQueue, error) {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &sqsQueue{svc: sqs.New(sess), url: url}, nil
+}
+
+func (q *sqsQueue) Enqueue(body string) error {
+    _, err := q.svc.SendMessage(&sqs.SendMessageInput{
+        QueueUrl:    aws.String(q.url),
+        MessageBody: aws.String(body),
+    })
+    return err
 }
 
-type ConfirmPaymentRequest struct {
-    PaymentIntentID string `json:"PaymentIntentID"`
+// memoryQueue stands in for SQS when running locally. It only keeps the messages so main can log them; nothing
+// consumes them, so to apply them, put them in the Records of process_webhook_events' event.json and run the worker.
+type memoryQueue struct {
+    mu       sync.Mutex
+    messages []string
+}
+
+func (q *memoryQueue) Enqueue(body string) error {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.messages = append(q.messages, body)
+    return nil
 }
 
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
 // Globals 
 var db *sql.DB
+var dialect database.Dialect
 var awsParams AWSParams
+var queue EventQueue
+var webhookProviders map[payments.ProviderName]payments.PaymentProvider
 
 // getParameter retrieves a parameter from AWS SSM.
 func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
     sess, err := session.NewSession(&aws.Config{
         Region: aws.String(region),
 		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors 
@@ -74,156 +113,156 @@ func getParameter(region, paramName string) (string, error) {
     return *param.Parameter.Value, nil
 }
 
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
 func initializeDatabase() error {
-    sess, err := session.NewSession(&aws.Config{
-        Region: aws.String("us-west-2"),
-    })
-    if err != nil {
-        log.Printf("Error creating AWS session: %v", err)
-        return err
-    }
-
-    ssmSvc := ssm.New(sess)
-    paramName := "/application/dev/database/credentials"
-    withDecryption := true
-    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
-        Name:           &paramName,
-        WithDecryption: &withDecryption,
-    })
-    if err != nil {
-        log.Printf("Error getting parameter: %v", err)
-        return err
-    }
-
-    var dbCreds struct {
-        Username string `json:"username"`
-        Password string `json:"password"`
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
-    }
-    err = json.Unmarshal([]byte(*param.Parameter.Value), &dbCreds)
-    if err != nil {
-        log.Printf("Error parsing JSON: %v", err)
-        return err
-    }
-
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/user_management", dbCreds.Username, dbCreds.Password, dbCreds.Host, dbCreds.Port)
-    db, err = sql.Open("mysql", dsn)
+    var err error
+    db, dialect, err = database.Open("us-west-2")
     if err != nil {
         log.Printf("Error opening database: %v", err)
         return err
     }
 
-    // Setting up the connection pool
-    db.SetMaxOpenConns(10)
-    db.SetMaxIdleConns(5)
-    db.SetConnMaxLifetime(0) // Connections are recycled forever
-
-    if err = db.Ping(); err != nil {
-        log.Printf("Failed to connect to database: %v", err)
-        return err
-    }
-
-    fmt.Println("Connected to the MySQL database successfully!")
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
     return nil
 }
 
-func updateUserBalance(userID string, amount int64) error {
-	// Amount is in cents, convert:
-	amountInDollars := float64(amount) / 100.0
-    query := `UPDATE Users SET AccountBalance = AccountBalance + ? WHERE UserID = ?`
-    _, err := db.Exec(query, amountInDollars, userID)
+// saveWebhookEvent persists a verified event before it is acknowledged. It returns the status of the stored row,
+// which is "Processed" when Stripe redelivers an event the worker has already applied.
+func saveWebhookEvent(eventID, eventType, payload string) (string, error) {
+    query := `INSERT INTO WebhookEvents (EventID, EventType, Payload, Status, Attempts, ReceivedAt)
+              VALUES (?, ?, ?, 'Received', 0, ?) ` + dialect.OnConflictDoNothing("EventID")
+    _, err := db.Exec(query, eventID, eventType, payload, time.Now().UTC().Format(mysqlDateTimeLayout))
     if err != nil {
-        return fmt.Errorf("updateUserBalance: %v", err)
+        return "", fmt.Errorf("saveWebhookEvent: %v", err)
     }
-    return nil
-}
 
-func updateTransactionHistory(transactionID, status string, transactionDate time.Time) error {
-    query := `UPDATE TransactionHistory SET TransactionStatus = ?, TransactionDate = ? WHERE TransactionID = ?`
-    _, err := db.Exec(query, status, transactionDate, transactionID)
-    if err != nil {
-        return fmt.Errorf("updateTransactionHistory: %v", err)
+    var status string
+    if err := db.QueryRow(`SELECT Status FROM WebhookEvents WHERE EventID = ?`, eventID).Scan(&status); err != nil {
+        return "", fmt.Errorf("saveWebhookEvent: %v", err)
     }
-    return nil
+    return status, nil
 }
 
-// webhook() processes incoming Stripe webhook events via AWS API Gateway.
-// If the event type is "payment_intent.succeeded", it updates the transaction history in the database to mark the 
-// transaction as completed and adjusts the user's balance according to the amount specified in the
-// webhook event. The function responds to the API Gateway with a message indicating
-// successful handling of the webhook.
+// Hex HMAC key the -local flag signs Adyen notifications with
+const localAdyenHMACKey = "6c6f63616c2d616479656e2d686d61632d6b6579"
+
+// webhook() receives payment provider notifications via AWS API Gateway. The provider is taken from the
+// {provider} path parameter, "stripe" if there is none, so Stripe events and Adyen notifications share the endpoint.
+// It verifies the notification's signature, persists every event it carries to WebhookEvents and puts them on the
+// webhook queue, and only then acknowledges it. Adyen notifications are turned into the Stripe-shaped events the
+// worker reads. The balances are updated asynchronously by processWebhookEvents, so a slow or failing database no
+// longer makes the provider retry the event.
 //
 // Parameters:
 // - ctx: Context associated with the request, used for managing cancellation signals and deadlines.
 // - request: The incoming request object from API Gateway containing the webhook data.
 //
 // Returns:
-// - APIGatewayProxyResponse: Struct containing the HTTP status code and response body. This is used
-//   by API Gateway to form the HTTP response.
+// - APIGatewayProxyResponse: 200 once the events are queued (or were already processed), 404 for an unknown
+//   provider, 400 if the signature is invalid, and 500 if an event could not be persisted or queued, in which
+//   case the provider retries it. Adyen is answered with "[accepted]", as it expects.
 // - error: Error object that will be nil if successful, or contains an error
 //   message if an error occurs.
 func webhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    providerName := payments.Stripe
+    if name := request.PathParameters["provider"]; name != "" {
+        providerName = payments.ProviderName(name)
+    }
+    provider, ok := webhookProviders[providerName]
+    if !ok {
+        return events.APIGatewayProxyResponse{
+            StatusCode: http.StatusNotFound,
+            Body:       fmt.Sprintf("Unknown payment provider %s", providerName),
+        }, nil
+    }
 
-	var webhookEvent StripeWebhookEvent
-
-    err := json.Unmarshal([]byte(request.Body), &webhookEvent)
+    webhookEvents, err := provider.ParseWebhook([]byte(request.Body), request.Headers)
     if err != nil {
-        fmt.Printf("Error unmarshaling JSON: %v\n", err)
+        fmt.Printf("Error verifying webhook signature: %v\n", err)
         return events.APIGatewayProxyResponse{
-            StatusCode: http.StatusInternalServerError,
-            Body:       "Error processing request",
+            StatusCode: http.StatusBadRequest,
+            Body:       "Invalid signature",
         }, nil
     }
 
-    fmt.Printf("Event Type: %s\n", webhookEvent.Type)
-    fmt.Printf("Transaction ID: %s\n", webhookEvent.Data.Object.ID)
-    fmt.Printf("Amount: %d\n", webhookEvent.Data.Object.Amount)
-    fmt.Printf("Currency: %s\n", webhookEvent.Data.Object.Currency)
-    fmt.Printf("Description: %s\n", webhookEvent.Data.Object.Description)
-    fmt.Printf("Customer ID: %s\n", webhookEvent.Data.Object.Customer)
-
-	if webhookEvent.Type == "payment_intent.succeeded"{
-		// Update transaction history 
-        if err := updateTransactionHistory(webhookEvent.Data.Object.ID, "Completed", time.Now()); err != nil {
-            fmt.Printf("Error updating transaction history: %v\n", err)
+    var queued []string
+    for _, event := range webhookEvents {
+        fmt.Printf("Event ID: %s\n", event.ID)
+        fmt.Printf("Event Type: %s\n", event.Type)
+
+        status, err := saveWebhookEvent(event.ID, event.Type, string(event.Payload))
+        if err != nil {
+            fmt.Printf("Error saving event: %v\n", err)
             return events.APIGatewayProxyResponse{
                 StatusCode: http.StatusInternalServerError,
-                Body:       "Failed to update transaction history",
+                Body:       "Error processing request",
             }, nil
         }
+        if status == "Processed" {
+            log.Printf("Event %s was already processed", event.ID)
+            continue
+        }
 
-        // Update user balance
-        if err := updateUserBalance(request.RequestContext.Identity.CognitoIdentityPoolID, webhookEvent.Data.Object.Amount); err != nil {
-            fmt.Printf("Error updating user balance: %v\n", err)
+        if err := queue.Enqueue(string(event.Payload)); err != nil {
+            fmt.Printf("Error queueing event: %v\n", err)
             return events.APIGatewayProxyResponse{
                 StatusCode: http.StatusInternalServerError,
-                Body:       "Failed to update user balance",
+                Body:       "Error processing request",
             }, nil
         }
+        queued = append(queued, event.ID)
+    }
 
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusOK,
-			Body:       fmt.Sprintf("Received confirmation from Stripe: %s", webhookEvent.Data.Object.Description),
-		}, nil
-	}
-
+    body := fmt.Sprintf("Queued events: %s", strings.Join(queued, ", "))
+    if providerName == payments.Adyen {
+        body = payments.AdyenAccepted
+    }
 	return events.APIGatewayProxyResponse{
         StatusCode: http.StatusOK,
-        Body:       fmt.Sprintf("Received confirmation from Stripe: %s", webhookEvent.Data.Object.Description),
+        Body:       body,
     }, nil
 }
 
 func main() {
+    // For local runs, -local signs event.json with a test secret and queues to memory instead of SQS. The event is
+    // signed for the provider in its "provider" path parameter.
+    local := flag.Bool("local", false, "use an in-memory queue and a local signing secret")
+    flag.Parse()
+
     region := "us-west-2"
-    paramName := "/application/dev/stripe_key"
 	var err error
 
-    awsParams.stripeKey, err = getParameter(region, paramName)
-    if err != nil {
-        log.Fatalf("Failed to get parameter: %v", err)
+    if *local {
+        awsParams.webhookSecret = "whsec_local"
+        awsParams.adyenHMACKey = localAdyenHMACKey
+        queue = &memoryQueue{}
+    } else {
+        awsParams.webhookSecret, err = getParameter(region, "/application/dev/stripe_webhook_secret")
+        if err != nil {
+            log.Fatalf("Failed to get parameter: %v", err)
+        }
+        awsParams.adyenHMACKey, err = getParameter(region, "/application/dev/adyen_hmac_key")
+        if err != nil {
+            log.Printf("Adyen notifications are disabled: %v", err)
+        }
+        awsParams.queueURL, err = getParameter(region, "/application/dev/webhook_queue_url")
+        if err != nil {
+            log.Fatalf("Failed to get parameter: %v", err)
+        }
+        queue, err = newSQSQueue(awsParams.queueURL)
+        if err != nil {
+            log.Fatalf("Failed to create queue client: %v", err)
+        }
+    }
+    log.Printf("Successfully retrieved webhook parameters!")
+
+    webhookProviders = map[payments.ProviderName]payments.PaymentProvider{
+        payments.Stripe: payments.NewStripe(payments.StripeConfig{WebhookSecret: awsParams.webhookSecret}),
+    }
+    if awsParams.adyenHMACKey != "" {
+        webhookProviders[payments.Adyen] = payments.NewAdyen(payments.AdyenConfig{HMACKey: awsParams.adyenHMACKey})
     }
-    log.Printf("Successfully retrieved stripe key!")
 
     if err := initializeDatabase(); err != nil {
         log.Fatalf("Database initialization failed: %v", err)
@@ -244,6 +283,22 @@ func main() {
         return
     }
 
+    if *local && request.PathParameters["provider"] == string(payments.Adyen) {
+        signed, err := payments.SignAdyenNotification([]byte(request.Body), awsParams.adyenHMACKey)
+        if err != nil {
+            fmt.Printf("Failed to sign notification: %s\n", err)
+            return
+        }
+        request.Body = string(signed)
+    } else if *local {
+        now := time.Now()
+        signature := stripewebhook.ComputeSignature(now, []byte(request.Body), awsParams.webhookSecret)
+        if request.Headers == nil {
+            request.Headers = map[string]string{}
+        }
+        request.Headers["Stripe-Signature"] = fmt.Sprintf("t=%d,v1=%x", now.Unix(), signature)
+    }
+
     // Call the handler with the unmarshalled request
     ctx := context.Background()
     response, err := webhook(ctx, request)
@@ -254,6 +309,10 @@ func main() {
 
     // Print the response
     fmt.Printf("Handler response: %+v\n", response)
-}
-
 
+    if q, ok := queue.(*memoryQueue); ok {
+        for _, message := range q.messages {
+            fmt.Printf("Queued: %s\n", message)
+        }
+    }
+}
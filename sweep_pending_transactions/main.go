@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/betchya/lambdas/internal/config"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/payments"
+	"github.com/betchya/lambdas/internal/repository"
+)
+
+// SweepOptions is read from the "detail" of the scheduled event. All fields are optional.
+type SweepOptions struct {
+    MaxAge string `json:"max_age"` // Go duration, e.g. "2h". Rows "Pending" for longer than this are swept.
+}
+
+// StripeWebhookEvent is the subset of a Stripe event the webhook worker reads. The sweeper builds one from a freshly
+// fetched PaymentIntent so that the worker applies it exactly as if Stripe had delivered it. It has no event ID,
+// since it is not a real Stripe event.
+type StripeWebhookEvent struct {
+    Type    string     `json:"type"`
+    Created int64      `json:"created"` // When the intent was fetched, so older events for it are treated as stale
+    Data    StripeData `json:"data"`
+}
+
+// StripeData contains the data object of a Stripe event
+type StripeData struct {
+    Object PaymentIntent `json:"object"`
+}
+
+// PaymentIntent holds the fields of a payment intent the webhook reads
+type PaymentIntent struct {
+    ID       string            `json:"id"`
+    Amount   int64             `json:"amount"`
+    Currency string            `json:"currency"`
+    Customer string            `json:"customer"`
+    Metadata map[string]string `json:"metadata"`
+}
+
+// Clock lets the job run against a fixed time locally instead of the wall clock.
+type Clock interface {
+    Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now().UTC() }
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c).UTC() }
+
+// Struct to keep the parameters read from SSM
+type AWSParams struct {
+	queueURL string // SQS queue consumed by processWebhookEvents
+}
+
+const (
+    // Default age after which a "Pending" row is considered stale
+    defaultPendingMaxAge = 2 * time.Hour
+    // Maximum number of rows swept per invocation
+    sweepBatchSize = 100
+)
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+var awsParams AWSParams
+var router *payments.Router
+var clock Clock = systemClock{}
+
+// getParameter retrieves a parameter from AWS SSM.
+func getParameter(region, paramName string) (string, error) {
+    // Run locally, parameters come from the environment instead of SSM
+    if config.IsLocal() {
+        return config.LocalParameter(paramName)
+    }
+
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String(region),
+		CredentialsChainVerboseErrors: aws.Bool(true), // Verbose errors
+    })
+    if err != nil {
+        log.Printf("Error creating AWS session: %v", err)
+        return "", err
+    }
+
+    ssmSvc := ssm.New(sess)
+    withDecryption := true
+    param, err := ssmSvc.GetParameter(&ssm.GetParameterInput{
+        Name:           &paramName,
+        WithDecryption: &withDecryption,
+    })
+    if err != nil {
+        log.Printf("Error getting parameter '%s': %v", paramName, err)
+        return "", err
+    }
+
+    return *param.Parameter.Value, nil
+}
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+
+// findStalePending returns the IDs of Stripe "Deposit" rows that have been "Pending" since before cutoff, oldest
+// first. Rows without a provider predate it and were all Stripe's; other providers' payments can't be fetched here.
+func findStalePending(ctx context.Context, cutoff time.Time) ([]string, error) {
+    deposits, err := transactions.FindTransactions(ctx, &repository.TransactionQuery{
+        TransactionType: "Deposit",
+        Statuses:        []string{"Pending"},
+        Provider:        "stripe",
+        To:              cutoff.Format(mysqlDateTimeLayout),
+        Limit:           sweepBatchSize,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var ids []string
+    for _, deposit := range deposits {
+        ids = append(ids, deposit.TransactionID)
+    }
+    return ids, nil
+}
+
+// webhookEventType returns the Stripe event that corresponds to a payment intent's current status, or "" while
+// the payment has not reached a state the webhook acts on.
+func webhookEventType(status payments.IntentStatus) string {
+    switch status {
+    case payments.StatusSucceeded:
+        return "payment_intent.succeeded"
+    case payments.StatusProcessing:
+        return "payment_intent.processing"
+    case payments.StatusRequiresCapture:
+        return "payment_intent.amount_capturable_updated"
+    case payments.StatusRequiresPaymentMethod:
+        return "payment_intent.payment_failed"
+    case payments.StatusCanceled:
+        return "payment_intent.canceled"
+    }
+    return ""
+}
+
+// enqueueWebhookEvent puts event on the webhook queue, where processWebhookEvents applies it like any other event.
+func enqueueWebhookEvent(event StripeWebhookEvent) error {
+    sess, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-west-2"),
+    })
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+
+    body, err := json.Marshal(event)
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+
+    _, err = sqs.New(sess).SendMessage(&sqs.SendMessageInput{
+        QueueUrl:    aws.String(awsParams.queueURL),
+        MessageBody: aws.String(string(body)),
+    })
+    if err != nil {
+        return fmt.Errorf("enqueueWebhookEvent: %v", err)
+    }
+    return nil
+}
+
+// sweepTransaction re-fetches the payment intent behind a stale row and, if it has moved on, queues the matching event.
+func sweepTransaction(ctx context.Context, provider payments.PaymentProvider, transactionID string) error {
+    intent, err := provider.GetIntent(ctx, transactionID)
+    if err != nil {
+        return err
+    }
+
+    eventType := webhookEventType(intent.Status)
+    if eventType == "" {
+        log.Printf("Payment %s is still %s, leaving it pending", intent.ID, intent.Status)
+        return nil
+    }
+
+    // The worker reads who made the payment, and where, from the metadata
+    metadata := map[string]string{"UserID": intent.UserID, "Provider": string(intent.Provider)}
+    if intent.Wallet != "" {
+        metadata["Wallet"] = intent.Wallet
+    }
+    event := StripeWebhookEvent{
+        Type:    eventType,
+        Created: clock.Now().Unix(),
+        Data: StripeData{Object: PaymentIntent{
+            ID:       intent.ID,
+            Amount:   intent.Amount,
+            Currency: intent.Currency,
+            Customer: intent.CustomerID,
+            Metadata: metadata,
+        }},
+    }
+    if err := enqueueWebhookEvent(event); err != nil {
+        return err
+    }
+    log.Printf("Swept payment %s as %s", intent.ID, eventType)
+    return nil
+}
+
+// sweepPendingTransactions() is triggered by an EventBridge schedule. It finds deposits that have been "Pending"
+// for longer than the configured age, usually because their webhook event never arrived, re-fetches each payment
+// intent from Stripe, and queues the matching event for processWebhookEvents. The worker only moves a row out of
+// "Pending" once, so a deposit swept while its real event arrives is still credited exactly once.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - event: The scheduled EventBridge event. Its detail may hold SweepOptions.
+//
+// Returns:
+// - error: Non-nil if the options are invalid or the stale rows could not be loaded. Failures of individual rows
+//   are logged, and the row is retried on the next run.
+func sweepPendingTransactions(ctx context.Context, event events.CloudWatchEvent) error {
+
+    var opts SweepOptions
+    if len(event.Detail) > 0 {
+        if err := json.Unmarshal(event.Detail, &opts); err != nil {
+            return fmt.Errorf("invalid sweep options: %v", err)
+        }
+    }
+    maxAge := defaultPendingMaxAge
+    if opts.MaxAge != "" {
+        parsed, err := time.ParseDuration(opts.MaxAge)
+        if err != nil || parsed <= 0 {
+            return fmt.Errorf("invalid max_age %q", opts.MaxAge)
+        }
+        maxAge = parsed
+    }
+
+    ids, err := findStalePending(ctx, clock.Now().Add(-maxAge))
+    if err != nil {
+        return err
+    }
+    log.Printf("Found %d transactions pending for more than %s", len(ids), maxAge)
+
+    provider, err := router.Provider(payments.Stripe)
+    if err != nil {
+        return err
+    }
+    for _, id := range ids {
+        if err := sweepTransaction(ctx, provider, id); err != nil {
+            log.Printf("Error sweeping transaction %s: %v", id, err)
+        }
+    }
+    return nil
+}
+
+func main() {
+    // For local runs, -now pins the clock and -max-age overrides the age given in event.json
+    fakeNow := flag.String("now", "", "run as if the current time were this RFC 3339 timestamp")
+    maxAge := flag.String("max-age", "", "sweep rows pending for longer than this duration")
+    flag.Parse()
+    if *fakeNow != "" {
+        parsed, err := time.Parse(time.RFC3339, *fakeNow)
+        if err != nil {
+            log.Fatalf("Invalid -now: %v", err)
+        }
+        clock = fixedClock(parsed)
+    }
+
+    region := "us-west-2"
+	var err error
+
+    router, err = payments.OpenRouter(func(paramName string) (string, error) {
+        return getParameter(region, paramName)
+    })
+    if err != nil {
+        log.Fatalf("Failed to configure payment routing: %v", err)
+    }
+    log.Printf("Successfully configured payment routing!")
+
+    awsParams.queueURL, err = getParameter(region, "/application/dev/webhook_queue_url")
+    if err != nil {
+        log.Fatalf("Failed to get parameter: %v", err)
+    }
+
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    var event events.CloudWatchEvent
+    err = json.Unmarshal(file, &event)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal event: %s\n", err)
+        return
+    }
+
+    if *maxAge != "" {
+        event.Detail, _ = json.Marshal(SweepOptions{MaxAge: *maxAge})
+    }
+
+    ctx := context.Background()
+    if err := sweepPendingTransactions(ctx, event); err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    fmt.Println("Pending transaction sweep finished")
+
+    //lambda.Start(sweepPendingTransactions)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+	"github.com/betchya/lambdas/internal/database"
+	"github.com/betchya/lambdas/internal/repository"
+	_ "time/tzdata" // Lambda runtimes don't ship a timezone database
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Transaction is a row of the TransactionHistory table as shown on a statement
+type Transaction struct {
+    TransactionID     string
+    TransactionType   string
+    Amount            int64 // Minor units (cents)
+    TransactionStatus string
+    TransactionDate   string // Formatted in the statement's timezone
+}
+
+// Statement holds everything printed on an account statement. Amounts are in minor units (cents).
+type Statement struct {
+    UserID         string
+    Location       *time.Location
+    From           time.Time // Inclusive
+    To             time.Time // Exclusive
+    OpeningBalance int64
+    ClosingBalance int64
+    Transactions   []*Transaction
+    TotalsByType   map[string]int64
+}
+
+// Layout used for DATETIME columns
+const mysqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// Layout used for dates printed on statements
+const statementDateLayout = "2006-01-02 15:04 MST"
+
+// Globals
+var db *sql.DB
+var dialect database.Dialect
+var transactions repository.TransactionRepository
+
+// initializeDatabase connects to the database of the current stage: MySQL or Postgres with the credentials in SSM,
+// or the SQLite file when STAGE is "local".
+func initializeDatabase() error {
+    var err error
+    db, dialect, err = database.Open("us-west-2")
+    if err != nil {
+        log.Printf("Error opening database: %v", err)
+        return err
+    }
+
+    fmt.Printf("Connected to the %s database successfully!\n", dialect)
+    return nil
+}
+
+// balanceEffect returns how a transaction changed the user's available balance, in cents. Only settled
+// transactions count: pending deposits, refunded stakes and open dispute holds leave the balance unchanged.
+func balanceEffect(transactionType, status string, amount int64) int64 {
+    switch {
+    case transactionType == "Deposit" && status == "Completed":
+        return amount
+    case transactionType == "BetPayout" && status == "Completed":
+        return amount
+    case transactionType == "BetStake" && (status == "Held" || status == "Settled"):
+        return -amount
+    case transactionType == "Dispute" && status == "Lost":
+        return -amount
+    case transactionType == "Withdrawal" && status == "Completed":
+        return -amount
+    }
+    return 0
+}
+
+// openingBalance replays every transaction before from to work out the balance at the start of the statement.
+func openingBalance(ctx context.Context, userID string, from time.Time) (int64, error) {
+    totals, err := transactions.SumTransactions(ctx, &repository.TransactionQuery{UserID: userID, To: from.UTC().Format(mysqlDateTimeLayout)})
+    if err != nil {
+        return 0, err
+    }
+
+    var balance int64
+    for _, total := range totals {
+        balance += balanceEffect(total.TransactionType, total.TransactionStatus, total.Amount)
+    }
+    return balance, nil
+}
+
+// buildStatement loads the user's transactions between from and to and works out the balances and totals.
+func buildStatement(ctx context.Context, userID string, from, to time.Time, location *time.Location) (*Statement, error) {
+    opening, err := openingBalance(ctx, userID, from)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := transactions.FindTransactions(ctx, &repository.TransactionQuery{
+        UserID: userID,
+        From:   from.UTC().Format(mysqlDateTimeLayout),
+        To:     to.UTC().Format(mysqlDateTimeLayout),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    statement := &Statement{
+        UserID:         userID,
+        Location:       location,
+        From:           from,
+        To:             to,
+        OpeningBalance: opening,
+        ClosingBalance: opening,
+        TotalsByType:   map[string]int64{},
+    }
+    for _, row := range rows {
+        t := &Transaction{
+            TransactionID:     row.TransactionID,
+            TransactionType:   row.TransactionType,
+            Amount:            row.Amount,
+            TransactionStatus: row.TransactionStatus,
+            TransactionDate:   row.TransactionDate,
+        }
+        // Dates are stored in UTC, statements show them in the user's timezone
+        if stored, err := time.Parse(mysqlDateTimeLayout, t.TransactionDate); err == nil {
+            t.TransactionDate = stored.In(location).Format(statementDateLayout)
+        }
+
+        statement.Transactions = append(statement.Transactions, t)
+        statement.TotalsByType[t.TransactionType] += t.Amount
+        statement.ClosingBalance += balanceEffect(t.TransactionType, t.TransactionStatus, t.Amount)
+    }
+    return statement, nil
+}
+
+// formatAmount prints an amount in cents as dollars, e.g. -1234 as "-12.34".
+func formatAmount(cents int64) string {
+    sign := ""
+    if cents < 0 {
+        sign = "-"
+        cents = -cents
+    }
+    return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// sortedTypes returns the transaction types of a statement's totals in a stable order.
+func sortedTypes(totals map[string]int64) []string {
+    types := make([]string, 0, len(totals))
+    for t := range totals {
+        types = append(types, t)
+    }
+    sort.Strings(types)
+    return types
+}
+
+func renderCSV(statement *Statement) ([]byte, error) {
+    var buf bytes.Buffer
+    w := csv.NewWriter(&buf)
+
+    periodEnd := statement.To.Add(-time.Second)
+    w.Write([]string{"Statement for user", statement.UserID})
+    w.Write([]string{"Period", statement.From.Format("2006-01-02") + " to " + periodEnd.Format("2006-01-02"), statement.Location.String()})
+    w.Write([]string{"Opening balance", formatAmount(statement.OpeningBalance)})
+    w.Write(nil)
+    w.Write([]string{"Date", "Transaction ID", "Type", "Status", "Amount"})
+    for _, t := range statement.Transactions {
+        w.Write([]string{t.TransactionDate, t.TransactionID, t.TransactionType, t.TransactionStatus, formatAmount(t.Amount)})
+    }
+    w.Write(nil)
+    w.Write([]string{"Totals by type"})
+    for _, transactionType := range sortedTypes(statement.TotalsByType) {
+        w.Write([]string{transactionType, formatAmount(statement.TotalsByType[transactionType])})
+    }
+    w.Write([]string{"Closing balance", formatAmount(statement.ClosingBalance)})
+
+    w.Flush()
+    return buf.Bytes(), w.Error()
+}
+
+func renderPDF(statement *Statement) ([]byte, error) {
+    pdf := gofpdf.New("P", "mm", "Letter", "")
+    pdf.AddPage()
+
+    periodEnd := statement.To.Add(-time.Second)
+    pdf.SetFont("Helvetica", "B", 16)
+    pdf.Cell(0, 10, "Account statement")
+    pdf.Ln(10)
+    pdf.SetFont("Helvetica", "", 10)
+    pdf.Cell(0, 6, fmt.Sprintf("User %s, %s to %s (%s)", statement.UserID, statement.From.Format("2006-01-02"), periodEnd.Format("2006-01-02"), statement.Location))
+    pdf.Ln(6)
+    pdf.Cell(0, 6, "Opening balance: "+formatAmount(statement.OpeningBalance))
+    pdf.Ln(10)
+
+    widths := []float64{45, 60, 30, 30, 30}
+    pdf.SetFont("Helvetica", "B", 10)
+    for i, header := range []string{"Date", "Transaction ID", "Type", "Status", "Amount"} {
+        pdf.CellFormat(widths[i], 7, header, "B", 0, "L", false, 0, "")
+    }
+    pdf.Ln(-1)
+
+    pdf.SetFont("Helvetica", "", 9)
+    for _, t := range statement.Transactions {
+        pdf.CellFormat(widths[0], 6, t.TransactionDate, "", 0, "L", false, 0, "")
+        pdf.CellFormat(widths[1], 6, t.TransactionID, "", 0, "L", false, 0, "")
+        pdf.CellFormat(widths[2], 6, t.TransactionType, "", 0, "L", false, 0, "")
+        pdf.CellFormat(widths[3], 6, t.TransactionStatus, "", 0, "L", false, 0, "")
+        pdf.CellFormat(widths[4], 6, formatAmount(t.Amount), "", 1, "R", false, 0, "")
+    }
+    pdf.Ln(6)
+
+    pdf.SetFont("Helvetica", "B", 10)
+    pdf.Cell(0, 6, "Totals by type")
+    pdf.Ln(6)
+    pdf.SetFont("Helvetica", "", 10)
+    for _, transactionType := range sortedTypes(statement.TotalsByType) {
+        pdf.CellFormat(60, 6, transactionType, "", 0, "L", false, 0, "")
+        pdf.CellFormat(30, 6, formatAmount(statement.TotalsByType[transactionType]), "", 1, "R", false, 0, "")
+    }
+    pdf.Ln(4)
+    pdf.SetFont("Helvetica", "B", 10)
+    pdf.Cell(0, 6, "Closing balance: "+formatAmount(statement.ClosingBalance))
+
+    var buf bytes.Buffer
+    if err := pdf.Output(&buf); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// statementPeriod works out the statement's date range in the given timezone, either from month=YYYY-MM or from
+// from/to dates (YYYY-MM-DD, to inclusive). It defaults to the previous calendar month.
+func statementPeriod(params map[string]string, location *time.Location, now time.Time) (time.Time, time.Time, error) {
+    if month := params["month"]; month != "" {
+        start, err := time.ParseInLocation("2006-01", month, location)
+        if err != nil {
+            return time.Time{}, time.Time{}, fmt.Errorf("month must be YYYY-MM")
+        }
+        return start, start.AddDate(0, 1, 0), nil
+    }
+
+    if params["from"] != "" || params["to"] != "" {
+        from, err := time.ParseInLocation("2006-01-02", params["from"], location)
+        if err != nil {
+            return time.Time{}, time.Time{}, fmt.Errorf("from must be YYYY-MM-DD")
+        }
+        to, err := time.ParseInLocation("2006-01-02", params["to"], location)
+        if err != nil {
+            return time.Time{}, time.Time{}, fmt.Errorf("to must be YYYY-MM-DD")
+        }
+        if to.Before(from) {
+            return time.Time{}, time.Time{}, fmt.Errorf("to must not be before from")
+        }
+        return from, to.AddDate(0, 0, 1), nil
+    }
+
+    local := now.In(location)
+    thisMonth := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, location)
+    return thisMonth.AddDate(0, -1, 0), thisMonth, nil
+}
+
+// transactionStatement() produces an account statement of the caller's TransactionHistory as a CSV file or a PDF.
+// The statement shows the opening and closing balance of the period, every transaction in it and the totals per
+// transaction type. Period boundaries and dates are in the user's timezone.
+//
+// Query string parameters (all optional):
+// - format: "csv" (default) or "pdf".
+// - month: a YYYY-MM monthly statement. Otherwise from and to (YYYY-MM-DD, both inclusive) select the
+//   range, and with neither the previous month is used.
+// - timezone: an IANA timezone such as "America/New_York", defaults to UTC.
+//
+// Parameters:
+// - ctx: Context for managing request deadlines and cancellation signals.
+// - request: The APIGatewayProxyRequest for GET /statements.
+//
+// Returns:
+// - APIGatewayProxyResponse: The statement as an attachment. PDFs are base64 encoded for API Gateway.
+// - error: Provides details on any errors encountered during the function's execution. Returns nil if the operation is successful.
+func transactionStatement(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+    userID := request.RequestContext.Identity.CognitoIdentityPoolID
+    params := request.QueryStringParameters
+
+    location := time.UTC
+    if timezone := params["timezone"]; timezone != "" {
+        var err error
+        location, err = time.LoadLocation(timezone)
+        if err != nil {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "Unknown timezone"}, nil
+        }
+    }
+
+    format := params["format"]
+    if format == "" {
+        format = "csv"
+    }
+    if format != "csv" && format != "pdf" {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: "format must be csv or pdf"}, nil
+    }
+
+    from, to, err := statementPeriod(params, location, time.Now())
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest, Body: err.Error()}, nil
+    }
+
+    statement, err := buildStatement(ctx, userID, from, to, location)
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error building statement"}, err
+    }
+
+    filename := "statement-" + from.Format("2006-01-02") + "." + format
+    headers := map[string]string{"Content-Disposition": `attachment; filename="` + filename + `"`}
+
+    if format == "pdf" {
+        document, err := renderPDF(statement)
+        if err != nil {
+            return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error rendering statement"}, err
+        }
+        headers["Content-Type"] = "application/pdf"
+        return events.APIGatewayProxyResponse{
+            StatusCode:      http.StatusOK,
+            Headers:         headers,
+            Body:            base64.StdEncoding.EncodeToString(document),
+            IsBase64Encoded: true,
+        }, nil
+    }
+
+    document, err := renderCSV(statement)
+    if err != nil {
+        return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error rendering statement"}, err
+    }
+    headers["Content-Type"] = "text/csv"
+    return events.APIGatewayProxyResponse{
+        StatusCode: http.StatusOK,
+        Headers:    headers,
+        Body:       string(document),
+    }, nil
+}
+
+func main() {
+    if err := initializeDatabase(); err != nil {
+        log.Fatalf("Database initialization failed: %v", err)
+    }
+    transactions = repository.NewSQLTransactionRepository(db)
+
+	file, err := os.ReadFile("event.json")
+    if err != nil {
+        fmt.Printf("Failed to read file: %s\n", err)
+        return
+    }
+
+    // Unmarshal the JSON into an APIGatewayProxyRequest
+    var request events.APIGatewayProxyRequest
+    err = json.Unmarshal(file, &request)
+    if err != nil {
+        fmt.Printf("Failed to unmarshal request: %s\n", err)
+        return
+    }
+
+    // Call the handler with the unmarshalled request
+    ctx := context.Background()
+    response, err := transactionStatement(ctx, request)
+    if err != nil {
+        fmt.Printf("Handler error: %s\n", err)
+        return
+    }
+
+    // Print the response
+    fmt.Printf("Handler response: %+v\n", response)
+
+    //lambda.Start(transactionStatement)
+}